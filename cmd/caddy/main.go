@@ -8,7 +8,14 @@ import (
 	_ "github.com/caddyserver/caddy/v2/modules/standard"
 	_ "github.com/charbonnierg/caddy-nats/modules"
 	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/exprauth"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/jwtauth"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/nkeyauth"
 	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/oauth2"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/usersauth"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/webhook"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout/x509auth"
+	_ "github.com/charbonnierg/caddy-nats/modules/keystore"
 	_ "github.com/charbonnierg/caddy-nats/oauthproxy"
 	_ "github.com/charbonnierg/caddy-nats/oauthproxy/http_handler"
 	_ "github.com/charbonnierg/caddy-nats/oauthproxy/session_store"
@@ -15,6 +15,9 @@ import (
 var (
 	DEFAULT_AUTH_CALLOUT_SUBJECT = "$SYS.REQ.USER.AUTH"
 	DEFAULT_AUTH_CALLOUT_ACCOUNT = "AUTH"
+	// SERVER_XKEY_HEADER is the header holding the server public curve key
+	// when the authorization request is encrypted.
+	SERVER_XKEY_HEADER = "Nats-Server-Xkey"
 )
 
 // Handler is a function that handles auth callout requests
@@ -23,6 +26,8 @@ var (
 type Handler = func(req *jwt.AuthorizationRequestClaims) (*jwt.UserClaims, error)
 
 // Keystore is an interface for a keystore that can be used to retrieve the auth signing key for an account
+// The account is either an account name (server mode) or an account public key (operator mode).
+// The returned seed can be either the account identity key or one of the account signing keys.
 type Keystore interface {
 	Get(account string) (string, error)
 }
@@ -33,6 +38,7 @@ type Config struct {
 	Subject    string
 	Account    string
 	SigningKey string
+	XKey       string
 	Keystore   Keystore
 	Logger     *zap.Logger
 }
@@ -53,16 +59,20 @@ func NewConfig(handler Handler) *Config {
 // The handler function must return either user claims or an error.
 // Decoding the request, signing the user claims and signing the auth response is handled by the service.
 // The service can be configured with a signing key or a keystore.
+// When configured with a curve seed (xkey), encrypted requests are decrypted
+// and responses are encrypted for the server which sent the request.
 type Service struct {
 	logger       *zap.Logger
 	sk           nkeys.KeyPair
 	pk           string
+	curve        nkeys.KeyPair
 	subscription *nats.Subscription
 	Config       *Config
 }
 
 // NewService creates a new auth service with the given config.
-// It returns an error when the signing key or keystore is not set.
+// It returns an error when the signing key or keystore is not set,
+// or when the xkey is not a valid curve seed.
 func NewService(config *Config) (*Service, error) {
 	srv := &Service{
 		Config: config,
@@ -83,6 +93,13 @@ func NewService(config *Config) (*Service, error) {
 		srv.sk = sk
 		srv.pk = pk
 	}
+	if config.XKey != "" {
+		curve, err := nkeys.FromCurveSeed([]byte(config.XKey))
+		if err != nil {
+			return nil, errors.New("failed to decode auth xkey seed")
+		}
+		srv.curve = curve
+	}
 	return srv, nil
 }
 
@@ -122,9 +139,17 @@ func (s *Service) Close() error {
 // and returns a NATS message with the authorization response.
 // It returns nil when the request could not be handled.
 // The response is signed with the auth account keypair.
+// When the request is encrypted, the response is encrypted for the server.
 func (s *Service) handle(msg *nats.Msg) *nats.Msg {
+	// Decrypt the request if needed
+	serverXKey := msg.Header.Get(SERVER_XKEY_HEADER)
+	data, err := s.decrypt(msg.Data, serverXKey)
+	if err != nil {
+		s.logger.Error("failed to decrypt authorization request", zap.Error(err))
+		return nil
+	}
 	// Decode the request
-	request, err := jwt.DecodeAuthorizationRequestClaims(string(msg.Data))
+	request, err := jwt.DecodeAuthorizationRequestClaims(string(data))
 	if err != nil {
 		s.logger.Error("failed to decode authorization request", zap.Error(err))
 		return nil
@@ -141,12 +166,44 @@ func (s *Service) handle(msg *nats.Msg) *nats.Msg {
 		s.logger.Error("failed to sign authorization request", zap.Error(err))
 		return nil
 	}
+	// Encrypt the response if needed
+	encrypted, err := s.encrypt([]byte(payload), serverXKey)
+	if err != nil {
+		s.logger.Error("failed to encrypt authorization response", zap.Error(err))
+		return nil
+	}
 	return &nats.Msg{
 		Subject: msg.Reply,
-		Data:    []byte(payload),
+		Data:    encrypted,
 	}
 }
 
+// decrypt decrypts the request payload using the service curve keypair
+// and the server public xkey. Payload is returned as is when the server
+// did not send its public xkey, I.E, when the request is not encrypted.
+func (s *Service) decrypt(data []byte, serverXKey string) ([]byte, error) {
+	if serverXKey == "" {
+		return data, nil
+	}
+	if s.curve == nil {
+		return nil, errors.New("received an encrypted request but auth xkey is not configured")
+	}
+	return s.curve.Open(data, serverXKey)
+}
+
+// encrypt encrypts the response payload for the server using the service
+// curve keypair. Payload is returned as is when the server did not send
+// its public xkey, I.E, when the request was not encrypted.
+func (s *Service) encrypt(data []byte, serverXKey string) ([]byte, error) {
+	if serverXKey == "" {
+		return data, nil
+	}
+	if s.curve == nil {
+		return nil, errors.New("cannot encrypt response because auth xkey is not configured")
+	}
+	return s.curve.Seal(data, serverXKey)
+}
+
 // delegate calls the handler and returns either authorization response claims or an error
 // when an error is returned, the error is sent to the server and displayed to the user as
 // additional detail of the Unauthorized error.
@@ -189,42 +246,56 @@ func (s *Service) createSuccessResponse(request *jwt.AuthorizationRequestClaims,
 
 // signUserClaims signs the user claims with the target account keypair when a
 // keystore is configured. Otherwise, the auth account keypair from config is used.
-// This will work in server mode, but not in operator mode when target account is not the auth account.
+// In operator mode, the audience of the user claims must be the target account public key,
+// and the issuer account is set when the claims are signed by an account signing key.
+// Without a keystore, user claims cannot target an account other than the auth account
+// in operator mode, because the server would reject claims signed by the auth account.
 func (s *Service) signUserClaims(claims *jwt.UserClaims) (string, error) {
+	if s.Config.Keystore == nil && nkeys.IsValidPublicAccountKey(claims.Audience) && claims.Audience != s.Config.Account && claims.Audience != s.pk {
+		return "", fmt.Errorf("cannot sign user claims for account %s without a keystore", claims.Audience)
+	}
 	sk, pk, err := s.getKeyPair(claims.Audience)
 	if err != nil {
 		return "", err
 	}
 	claims.Issuer = pk
+	claims.IssuerAccount = issuerAccount(claims.Audience, pk)
 	return claims.Encode(sk)
 }
 
 // signAuthResponseClaims signs the auth response claims with the auth account keypair.
-// When a keystore is configured, the auth account keypair is fetched from the keystore.
-// Otherwise, the auth account keypair from config is used.
+// When a signing key is configured, it is used to sign the response.
+// Otherwise, the auth account keypair is fetched from the keystore.
 func (s *Service) signAuthResponseClaims(claims *jwt.AuthorizationResponseClaims) (string, error) {
 	sk, pk, err := s.getAuthAccountKeyPair()
 	if err != nil {
 		return "", err
 	}
 	claims.Issuer = pk
+	claims.IssuerAccount = issuerAccount(s.Config.Account, pk)
 	return claims.Encode(sk)
 }
 
-// getKeyPair returns the keypair for the target account when a keystore is configured.
-// Otherwise, the auth account keypair is returned.
-// This will work in server mode, but not in operator mode when target account is not the auth account.
+// getKeyPair returns the keypair and its public key for the target account when a keystore
+// is configured. Otherwise, the auth account keypair is returned.
 func (s *Service) getKeyPair(account string) (nkeys.KeyPair, string, error) {
 	if s.Config.Keystore != nil {
 		key, err := s.Config.Keystore.Get(account)
 		if err != nil {
 			return nil, "", err
 		}
-		pk, err := nkeys.FromSeed([]byte(key))
+		sk, err := nkeys.FromSeed([]byte(key))
 		if err != nil {
-			return nil, "", err
+			return nil, "", fmt.Errorf("invalid signing key for account %s", account)
+		}
+		pk, err := sk.PublicKey()
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid signing key for account %s", account)
 		}
-		return pk, "", nil
+		if !nkeys.IsValidPublicAccountKey(pk) {
+			return nil, "", fmt.Errorf("signing key for account %s is not an account key", account)
+		}
+		return sk, pk, nil
 	}
 	if s.sk != nil {
 		return s.sk, s.pk, nil
@@ -234,5 +305,18 @@ func (s *Service) getKeyPair(account string) (nkeys.KeyPair, string, error) {
 
 // getAuthAccountKeyPair returns the keypair for the account that is used to sign the auth response
 func (s *Service) getAuthAccountKeyPair() (nkeys.KeyPair, string, error) {
+	if s.sk != nil {
+		return s.sk, s.pk, nil
+	}
 	return s.getKeyPair(s.Config.Account)
 }
+
+// issuerAccount returns the issuer account to set in claims signed by the given public key
+// on behalf of the given account. It returns an empty string when the account is not an
+// account public key (server mode) or when claims are signed by the account identity key.
+func issuerAccount(account string, pk string) string {
+	if account == pk || !nkeys.IsValidPublicAccountKey(account) {
+		return ""
+	}
+	return account
+}
@@ -0,0 +1,429 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"go.uber.org/zap"
+)
+
+// newTestService creates a service which uses the username as target account.
+// A new account signing key is generated when no keystore is given.
+func newTestService(t *testing.T, xkey string, keystore Keystore) *Service {
+	t.Helper()
+	cfg := NewConfig(func(req *jwt.AuthorizationRequestClaims) (*jwt.UserClaims, error) {
+		if req.ConnectOptions.Username == "" {
+			return nil, errors.New("username is required")
+		}
+		claims := jwt.NewUserClaims(req.UserNkey)
+		claims.Audience = req.ConnectOptions.Username
+		return claims, nil
+	})
+	cfg.Logger = zap.NewNop()
+	cfg.XKey = xkey
+	cfg.Keystore = keystore
+	if keystore == nil {
+		cfg.SigningKey = newSeed(t, nkeys.CreateAccount)
+	}
+	srv, err := NewService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// newSeed creates a keypair using the given function and returns its seed.
+func newSeed(t *testing.T, create func() (nkeys.KeyPair, error)) string {
+	t.Helper()
+	kp, err := create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(seed)
+}
+
+// publicKey returns the public key of the given seed.
+func publicKey(t *testing.T, seed string) string {
+	t.Helper()
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// newRequest returns an authorization request for the given username,
+// signed by a new server key.
+func newRequest(t *testing.T, username string) []byte {
+	t.Helper()
+	serverKp, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPk, err := serverKp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPk, err := userKp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.NewAuthorizationRequestClaims(userPk)
+	claims.Server = jwt.ServerID{Name: "test", ID: serverPk}
+	claims.UserNkey = userPk
+	claims.ConnectOptions.Username = username
+	token, err := claims.Encode(serverKp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(token)
+}
+
+// decodeResponse decodes an authorization response and the user claims it holds.
+func decodeResponse(t *testing.T, data []byte) (*jwt.AuthorizationResponseClaims, *jwt.UserClaims) {
+	t.Helper()
+	response, err := jwt.DecodeAuthorizationResponseClaims(string(data))
+	if err != nil {
+		t.Fatalf("failed to decode authorization response: %s", err.Error())
+	}
+	if response.Jwt == "" {
+		return response, nil
+	}
+	user, err := jwt.DecodeUserClaims(response.Jwt)
+	if err != nil {
+		t.Fatalf("failed to decode user claims: %s", err.Error())
+	}
+	return response, user
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	serviceKp, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceSeed, err := serviceKp.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servicePk, err := serviceKp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKp, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPk, err := serverKp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestService(t, string(serviceSeed), nil)
+	// Server encrypts the request for the service
+	sealed, err := serverKp.Seal([]byte("request"), servicePk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := srv.decrypt(sealed, serverPk)
+	if err != nil {
+		t.Fatalf("failed to decrypt request: %s", err.Error())
+	}
+	if string(opened) != "request" {
+		t.Fatalf("unexpected decrypted request: %s", string(opened))
+	}
+	// Service encrypts the response for the server
+	encrypted, err := srv.encrypt([]byte("response"), serverPk)
+	if err != nil {
+		t.Fatalf("failed to encrypt response: %s", err.Error())
+	}
+	decrypted, err := serverKp.Open(encrypted, servicePk)
+	if err != nil {
+		t.Fatalf("server failed to decrypt response: %s", err.Error())
+	}
+	if string(decrypted) != "response" {
+		t.Fatalf("unexpected decrypted response: %s", string(decrypted))
+	}
+}
+
+func TestHandleEncryptedRequest(t *testing.T) {
+	serviceSeed := newSeed(t, nkeys.CreateCurveKeys)
+	servicePk := publicKey(t, serviceSeed)
+	serverKp, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPk, err := serverKp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestService(t, serviceSeed, nil)
+	sealed, err := serverKp.Seal(newRequest(t, "APP"), servicePk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &nats.Msg{Subject: DEFAULT_AUTH_CALLOUT_SUBJECT, Reply: "reply", Data: sealed, Header: nats.Header{}}
+	msg.Header.Set(SERVER_XKEY_HEADER, serverPk)
+	reply := srv.handle(msg)
+	if reply == nil {
+		t.Fatal("expected a reply")
+	}
+	data, err := serverKp.Open(reply.Data, servicePk)
+	if err != nil {
+		t.Fatalf("failed to decrypt reply: %s", err.Error())
+	}
+	response, user := decodeResponse(t, data)
+	if response.Error != "" {
+		t.Fatalf("unexpected error: %s", response.Error)
+	}
+	if user == nil || user.Audience != "APP" {
+		t.Fatalf("unexpected user claims: %+v", user)
+	}
+}
+
+func TestHandleEncryptedRequestWithoutXKey(t *testing.T) {
+	srv := newTestService(t, "", nil)
+	serverPk := publicKey(t, newSeed(t, nkeys.CreateCurveKeys))
+	msg := &nats.Msg{Subject: DEFAULT_AUTH_CALLOUT_SUBJECT, Reply: "reply", Data: []byte("encrypted"), Header: nats.Header{}}
+	msg.Header.Set(SERVER_XKEY_HEADER, serverPk)
+	if _, err := srv.decrypt(msg.Data, serverPk); err == nil {
+		t.Fatal("expected an error when decrypting without xkey")
+	}
+	if reply := srv.handle(msg); reply != nil {
+		t.Fatal("expected no reply when request cannot be decrypted")
+	}
+}
+
+func TestHandlePlaintextRequest(t *testing.T) {
+	for _, xkey := range []string{"", newSeed(t, nkeys.CreateCurveKeys)} {
+		srv := newTestService(t, xkey, nil)
+		msg := &nats.Msg{Subject: DEFAULT_AUTH_CALLOUT_SUBJECT, Reply: "reply", Data: newRequest(t, "APP")}
+		reply := srv.handle(msg)
+		if reply == nil {
+			t.Fatal("expected a reply")
+		}
+		response, user := decodeResponse(t, reply.Data)
+		if response.Error != "" {
+			t.Fatalf("unexpected error: %s", response.Error)
+		}
+		if user == nil || user.Audience != "APP" || user.IssuerAccount != "" {
+			t.Fatalf("unexpected user claims: %+v", user)
+		}
+	}
+}
+
+func TestGetKeyPairRejectsNonAccountSeed(t *testing.T) {
+	account := publicKey(t, newSeed(t, nkeys.CreateAccount))
+	srv := newTestService(t, "", StaticKeystore{account: newSeed(t, nkeys.CreateUser)})
+	if _, _, err := srv.getKeyPair(account); err == nil {
+		t.Fatal("expected an error for a user seed")
+	}
+	srv = newTestService(t, "", StaticKeystore{account: "invalid"})
+	if _, _, err := srv.getKeyPair(account); err == nil {
+		t.Fatal("expected an error for an invalid seed")
+	}
+}
+
+func TestIssuerAccount(t *testing.T) {
+	identity := newSeed(t, nkeys.CreateAccount)
+	signing := newSeed(t, nkeys.CreateAccount)
+	account := publicKey(t, identity)
+	srv := newTestService(t, "", StaticKeystore{account: identity})
+	// Signed by the account identity key
+	claims := jwt.NewUserClaims(publicKey(t, newSeed(t, nkeys.CreateUser)))
+	claims.Audience = account
+	if _, err := srv.signUserClaims(claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != account || claims.IssuerAccount != "" {
+		t.Fatalf("unexpected issuer %s and issuer account %s", claims.Issuer, claims.IssuerAccount)
+	}
+	// Signed by an account signing key
+	srv = newTestService(t, "", StaticKeystore{account: signing})
+	claims = jwt.NewUserClaims(publicKey(t, newSeed(t, nkeys.CreateUser)))
+	claims.Audience = account
+	if _, err := srv.signUserClaims(claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != publicKey(t, signing) || claims.IssuerAccount != account {
+		t.Fatalf("unexpected issuer %s and issuer account %s", claims.Issuer, claims.IssuerAccount)
+	}
+	// Server mode account names never set an issuer account
+	if issuer := issuerAccount("APP", publicKey(t, signing)); issuer != "" {
+		t.Fatalf("unexpected issuer account %s", issuer)
+	}
+}
+
+func TestSignUserClaimsWithoutKeystore(t *testing.T) {
+	srv := newTestService(t, "", nil)
+	claims := jwt.NewUserClaims(publicKey(t, newSeed(t, nkeys.CreateUser)))
+	claims.Audience = publicKey(t, newSeed(t, nkeys.CreateAccount))
+	if _, err := srv.signUserClaims(claims); err == nil {
+		t.Fatal("expected an error when signing for another account without keystore")
+	}
+}
+
+func TestOperatorMode(t *testing.T) {
+	operatorKp, err := nkeys.CreateOperator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	operatorPk, err := operatorKp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	operatorJwt, err := jwt.NewOperatorClaims(operatorPk).Encode(operatorKp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeAccount := func(claims *jwt.AccountClaims) string {
+		token, err := claims.Encode(operatorKp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// System account
+	sysPk := publicKey(t, newSeed(t, nkeys.CreateAccount))
+	sysClaims := jwt.NewAccountClaims(sysPk)
+	sysClaims.Name = "SYS"
+	// App account, users are signed with a signing key
+	appPk := publicKey(t, newSeed(t, nkeys.CreateAccount))
+	appSigningSeed := newSeed(t, nkeys.CreateAccount)
+	appClaims := jwt.NewAccountClaims(appPk)
+	appClaims.Name = "APP"
+	appClaims.SigningKeys.Add(publicKey(t, appSigningSeed))
+	// Auth account, users are delegated to the auth callout service
+	authSeed := newSeed(t, nkeys.CreateAccount)
+	authPk := publicKey(t, authSeed)
+	authKp, err := nkeys.FromSeed([]byte(authSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceUserSeed := newSeed(t, nkeys.CreateUser)
+	authClaims := jwt.NewAccountClaims(authPk)
+	authClaims.Name = "AUTH"
+	authClaims.EnableExternalAuthorization(publicKey(t, serviceUserSeed))
+	authClaims.Authorization.AllowedAccounts.Add(appPk)
+	// Users of the auth account
+	encodeUser := func(seed string, deny bool) string {
+		claims := jwt.NewUserClaims(publicKey(t, seed))
+		if deny {
+			claims.Permissions.Pub.Deny.Add(">")
+			claims.Permissions.Sub.Deny.Add(">")
+		}
+		token, err := claims.Encode(authKp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	serviceUserJwt := encodeUser(serviceUserSeed, false)
+	sentinelSeed := newSeed(t, nkeys.CreateUser)
+	sentinelJwt := encodeUser(sentinelSeed, true)
+	// Start server
+	conf := filepath.Join(t.TempDir(), "nats.conf")
+	content := fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		operator: %s
+		system_account: %s
+		resolver: MEM
+		resolver_preload: {
+			%s: %s
+			%s: %s
+			%s: %s
+		}
+	`, operatorJwt, sysPk, sysPk, encodeAccount(sysClaims), appPk, encodeAccount(appClaims), authPk, encodeAccount(authClaims))
+	if err := os.WriteFile(conf, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := server.ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.NoLog = true
+	opts.NoSigs = true
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready for connections")
+	}
+	// Start auth callout service
+	cfg := NewConfig(func(req *jwt.AuthorizationRequestClaims) (*jwt.UserClaims, error) {
+		if req.ConnectOptions.Token != "secret" {
+			return nil, errors.New("invalid token")
+		}
+		claims := jwt.NewUserClaims(req.UserNkey)
+		claims.Audience = appPk
+		return claims, nil
+	})
+	cfg.Logger = zap.NewNop()
+	cfg.Account = authPk
+	cfg.Keystore = StaticKeystore{authPk: authSeed, appPk: appSigningSeed}
+	srv, err := NewService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceConn, err := nats.Connect(ns.ClientURL(), nats.UserJWTAndSeed(serviceUserJwt, serviceUserSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(serviceConn.Close)
+	if err := srv.Listen(serviceConn); err != nil {
+		t.Fatal(err)
+	}
+	if err := serviceConn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Users with an invalid token are rejected
+	if nc, err := nats.Connect(ns.ClientURL(), nats.UserJWTAndSeed(sentinelJwt, sentinelSeed), nats.Token("invalid")); err == nil {
+		nc.Close()
+		t.Fatal("expected an authorization error")
+	}
+	// Users with a valid token are moved to the app account
+	nc, err := nats.Connect(ns.ClientURL(), nats.UserJWTAndSeed(sentinelJwt, sentinelSeed), nats.Token("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	resp, err := nc.Request("$SYS.REQ.USER.INFO", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := struct {
+		Data struct {
+			Account string `json:"account"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Data.Account != appPk {
+		t.Fatalf("expected user to be bound to account %s, got %s", appPk, info.Data.Account)
+	}
+}
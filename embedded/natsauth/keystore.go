@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsauth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// ErrKeyNotFound is returned by keystores when no key is found for an account
+var ErrKeyNotFound = errors.New("signing key not found")
+
+// StaticKeystore is a keystore holding account signing keys in memory.
+// Keys of the map are account names (or account public keys in operator mode)
+// and values are account seeds (either identity keys or signing keys).
+type StaticKeystore map[string]string
+
+// Get returns the signing key for the given account.
+func (k StaticKeystore) Get(account string) (string, error) {
+	seed, ok := k[account]
+	if !ok {
+		return "", fmt.Errorf("%w for account %s", ErrKeyNotFound, account)
+	}
+	return seed, nil
+}
+
+// DirKeystore is a keystore reading account signing keys from a directory.
+// Each account signing key is stored in a file named after the account
+// (account name or account public key in operator mode) with the keystore
+// extension. Files may either contain a raw seed or a decorated nkey.
+type DirKeystore struct {
+	Directory string
+	Extension string
+}
+
+// NewDirKeystore creates a new directory keystore.
+// Extension defaults to ".nk" when empty.
+func NewDirKeystore(directory string, extension string) *DirKeystore {
+	if extension == "" {
+		extension = ".nk"
+	}
+	return &DirKeystore{Directory: directory, Extension: extension}
+}
+
+// Get returns the signing key for the given account.
+func (k *DirKeystore) Get(account string) (string, error) {
+	if account == "" || account == "." || account == ".." || strings.ContainsAny(account, `/\`) {
+		return "", fmt.Errorf("invalid account name: %q", account)
+	}
+	content, err := os.ReadFile(filepath.Join(k.Directory, account+k.Extension))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w for account %s", ErrKeyNotFound, account)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read signing key for account %s: %s", account, err.Error())
+	}
+	kp, err := nkeys.ParseDecoratedNKey(content)
+	if err != nil {
+		return "", fmt.Errorf("invalid signing key for account %s: %s", account, err.Error())
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return "", fmt.Errorf("invalid signing key for account %s: %s", account, err.Error())
+	}
+	return string(seed), nil
+}
+
+// KVKeystore is a keystore reading account signing keys from a JetStream
+// key value bucket. Keys of the bucket are account names (or account public keys
+// in operator mode) and values are account seeds.
+type KVKeystore struct {
+	bucket nats.KeyValue
+}
+
+// NewKVKeystore creates a new keystore backed by the given key value bucket.
+func NewKVKeystore(bucket nats.KeyValue) *KVKeystore {
+	return &KVKeystore{bucket: bucket}
+}
+
+// Get returns the signing key for the given account.
+func (k *KVKeystore) Get(account string) (string, error) {
+	entry, err := k.bucket.Get(account)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return "", fmt.Errorf("%w for account %s", ErrKeyNotFound, account)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get signing key for account %s: %s", account, err.Error())
+	}
+	return strings.TrimSpace(string(entry.Value())), nil
+}
+
+var (
+	_ Keystore = (StaticKeystore)(nil)
+	_ Keystore = (*DirKeystore)(nil)
+	_ Keystore = (*KVKeystore)(nil)
+)
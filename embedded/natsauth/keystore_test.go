@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestStaticKeystore(t *testing.T) {
+	seed := newSeed(t, nkeys.CreateAccount)
+	keystore := StaticKeystore{"APP": seed}
+	value, err := keystore.Get("APP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != seed {
+		t.Fatalf("unexpected seed: %s", value)
+	}
+	if _, err := keystore.Get("OTHER"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDirKeystore(t *testing.T) {
+	dir := t.TempDir()
+	seed := newSeed(t, nkeys.CreateAccount)
+	if err := os.WriteFile(filepath.Join(dir, "APP.nk"), []byte(seed+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "INVALID.nk"), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keystore := NewDirKeystore(dir, "")
+	value, err := keystore.Get("APP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != seed {
+		t.Fatalf("unexpected seed: %s", value)
+	}
+	if _, err := keystore.Get("OTHER"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := keystore.Get("INVALID"); err == nil || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected an invalid key error, got %v", err)
+	}
+}
+
+func TestDirKeystoreRejectsPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keys, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// A valid seed outside of the keystore directory must never be read
+	if err := os.WriteFile(filepath.Join(dir, "SECRET.nk"), []byte(newSeed(t, nkeys.CreateAccount)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keystore := NewDirKeystore(keys, "")
+	for _, account := range []string{"", ".", "..", "../SECRET", "sub/APP", `..\SECRET`} {
+		if _, err := keystore.Get(account); err == nil {
+			t.Fatalf("expected an error for account %q", account)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsoptions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+// Where we maintain the available service export response types
+var responseTypeMap = map[string]server.ServiceRespType{
+	"singleton": server.Singleton,
+	"stream":    server.Streamed,
+	"streamed":  server.Streamed,
+	"chunked":   server.Chunked,
+}
+
+// ParseResponseType parses a service export response type from a string
+func ParseResponseType(name string) (server.ServiceRespType, error) {
+	if name == "" {
+		return server.Singleton, nil
+	}
+	respType, ok := responseTypeMap[strings.ToLower(name)]
+	if !ok {
+		return server.Singleton, fmt.Errorf("invalid response type: %q", name)
+	}
+	return respType, nil
+}
+
+// GetJetStreamLimits returns the JetStream limits for the account.
+// It returns nil when no limits are configured, in which case the
+// server will use default (unlimited) limits.
+// When tiered limits are configured, limits are keyed by tier name,
+// otherwise limits are keyed by the empty string.
+func (a *Account) GetJetStreamLimits() (map[string]server.JetStreamAccountLimits, error) {
+	if a.Limits == nil || a.Limits.JetStream == nil {
+		return nil, nil
+	}
+	js := a.Limits.JetStream
+	if len(js.Tiers) == 0 {
+		return map[string]server.JetStreamAccountLimits{"": js.JetStreamTierLimits.serverLimits()}, nil
+	}
+	if js.JetStreamTierLimits != (JetStreamTierLimits{}) {
+		return nil, fmt.Errorf("account %q cannot have both global and tiered jetstream limits", a.Name)
+	}
+	limits := map[string]server.JetStreamAccountLimits{}
+	for tier, tierLimits := range js.Tiers {
+		if !isValidTier(tier) {
+			return nil, fmt.Errorf("account %q has an invalid jetstream limits tier: %q", a.Name, tier)
+		}
+		if tierLimits == nil {
+			tierLimits = &JetStreamTierLimits{}
+		}
+		limits[tier] = tierLimits.serverLimits()
+	}
+	return limits, nil
+}
+
+// serverLimits converts tier limits into server limits.
+// Zero values are converted to -1 (unlimited).
+func (l JetStreamTierLimits) serverLimits() server.JetStreamAccountLimits {
+	limits := server.JetStreamAccountLimits{
+		MaxMemory:            -1,
+		MaxStore:             -1,
+		MaxStreams:           -1,
+		MaxConsumers:         -1,
+		MaxAckPending:        -1,
+		MemoryMaxStreamBytes: -1,
+		StoreMaxStreamBytes:  -1,
+		MaxBytesRequired:     l.MaxBytesRequired,
+	}
+	if l.MaxMemory != 0 {
+		limits.MaxMemory = l.MaxMemory
+	}
+	if l.MaxStore != 0 {
+		limits.MaxStore = l.MaxStore
+	}
+	if l.MaxStreams != 0 {
+		limits.MaxStreams = l.MaxStreams
+	}
+	if l.MaxConsumers != 0 {
+		limits.MaxConsumers = l.MaxConsumers
+	}
+	if l.MaxAckPending != 0 {
+		limits.MaxAckPending = l.MaxAckPending
+	}
+	if l.MemoryMaxStreamBytes != 0 {
+		limits.MemoryMaxStreamBytes = l.MemoryMaxStreamBytes
+	}
+	if l.StoreMaxStreamBytes != 0 {
+		limits.StoreMaxStreamBytes = l.StoreMaxStreamBytes
+	}
+	return limits
+}
+
+// isValidTier returns true when tier is a replica count prefixed with "R".
+func isValidTier(tier string) bool {
+	replicas, err := strconv.Atoi(strings.TrimPrefix(tier, "R"))
+	return strings.HasPrefix(tier, "R") && err == nil && replicas > 0
+}
+
+// HasJetStreamResources returns true when streams, key value stores
+// or object stores are configured for the account.
+func (a *Account) HasJetStreamResources() bool {
+	return len(a.Streams) > 0 || len(a.KeyValueStores) > 0 || len(a.ObjectStores) > 0
+}
+
+// ManagerInboxPrefix is the inbox prefix of connections managing the JetStream
+// resources of accounts. Manager users are only allowed to subscribe to this prefix.
+const ManagerInboxPrefix = "_INBOX_JS_MANAGER"
+
+// ManagerKey returns the nkey of the user managing the JetStream resources
+// of the account, or nil when the account has no JetStream resources.
+// nats-server does not expose an in-process API to manage streams, so resources
+// are managed through a short-lived in-process connection. The manager is an
+// nkey user: its seed is only held in memory and a new key is generated each
+// time server options are built, so that it cannot be replayed or reused across
+// reloads. It is only allowed to use the JetStream API.
+func (a *Account) ManagerKey() nkeys.KeyPair {
+	return a.manager
+}
+
+// rotateManagerKey generates a new manager nkey when the account has JetStream resources.
+func (a *Account) rotateManagerKey() error {
+	a.manager = nil
+	if !a.HasJetStreamResources() {
+		return nil
+	}
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return fmt.Errorf("failed to create manager nkey: %s", err.Error())
+	}
+	a.manager = kp
+	return nil
+}
+
+// managerPublicKey returns the public key of the manager, or an empty string.
+func (a *Account) managerPublicKey() string {
+	if a.manager == nil {
+		return ""
+	}
+	pk, err := a.manager.PublicKey()
+	if err != nil {
+		return ""
+	}
+	return pk
+}
+
+// validateJetStreamResources verifies that JetStream resources of the account
+// have a name, and that stream consumers are durable.
+func (a *Account) validateJetStreamResources() error {
+	if a.HasJetStreamResources() && !a.JetStream {
+		return fmt.Errorf("account %q has jetstream resources but jetstream is not enabled", a.Name)
+	}
+	for _, stream := range a.Streams {
+		if stream.Name == "" {
+			return errors.New("stream name cannot be empty")
+		}
+		for _, consumer := range stream.Consumers {
+			if consumer.Durable == "" && consumer.Name == "" {
+				return fmt.Errorf("consumer of stream %q must have a durable name", stream.Name)
+			}
+		}
+	}
+	for _, kv := range a.KeyValueStores {
+		if kv.Bucket == "" {
+			return errors.New("key value store bucket cannot be empty")
+		}
+	}
+	for _, obj := range a.ObjectStores {
+		if obj.Bucket == "" {
+			return errors.New("object store bucket cannot be empty")
+		}
+	}
+	return nil
+}
+
+// newServerAccount creates a new server account with the given name.
+// Connection, subscription and payload limits of accounts which are not
+// backed by JWT claims are stored in unexported fields of server.Account,
+// and nats-server does not expose any setter nor any way to process a
+// configuration held in memory (the accounts parser is unexported, and
+// conf.Parse only returns a generic map). So when limits are configured,
+// a minimal configuration file holding the account limits is generated in
+// the temporary directory and processed in order to create the account.
+// Parser warnings are reported as errors, because the generated file is
+// not expected to produce any warning.
+func newServerAccount(name string, limits *AccountLimits) (*server.Account, error) {
+	if limits == nil {
+		return server.NewAccount(name), nil
+	}
+	values := map[string]int32{}
+	if limits.MaxConnections != 0 {
+		values["max_connections"] = limits.MaxConnections
+	}
+	if limits.MaxLeafnodes != 0 {
+		values["max_leafnodes"] = limits.MaxLeafnodes
+	}
+	if limits.MaxSubscriptions != 0 {
+		values["max_subscriptions"] = limits.MaxSubscriptions
+	}
+	if limits.MaxPayload != 0 {
+		values["max_payload"] = limits.MaxPayload
+	}
+	if len(values) == 0 {
+		return server.NewAccount(name), nil
+	}
+	content, err := json.Marshal(map[string]interface{}{
+		"accounts": map[string]interface{}{
+			name: map[string]interface{}{"limits": values},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode account limits: %s", err.Error())
+	}
+	file, err := os.CreateTemp("", "nats-account-*.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create account limits file: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write account limits file: %s", err.Error())
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write account limits file: %s", err.Error())
+	}
+	parsed := &server.Options{}
+	if err := parsed.ProcessConfigFile(file.Name()); err != nil {
+		return nil, fmt.Errorf("invalid account limits: %s", err.Error())
+	}
+	if len(parsed.Accounts) != 1 {
+		return nil, errors.New("invalid account limits: unexpected number of accounts")
+	}
+	return parsed.Accounts[0], nil
+}
+
+// lookupAccount returns the server account with the given name.
+// Accounts must have been added to server options before they can be looked up.
+func lookupAccount(opts *server.Options, name string) (*server.Account, error) {
+	if name == "" {
+		return nil, errors.New("account name cannot be empty")
+	}
+	for _, acc := range opts.Accounts {
+		if acc.Name == name {
+			return acc, nil
+		}
+	}
+	return nil, fmt.Errorf("account %q is not defined", name)
+}
+
+// lookupAccounts returns the server accounts with the given names.
+func lookupAccounts(opts *server.Options, names []string) ([]*server.Account, error) {
+	accounts := make([]*server.Account, 0, len(names))
+	for _, name := range names {
+		acc, err := lookupAccount(opts, name)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, acc)
+	}
+	return accounts, nil
+}
+
+// addExport adds a stream or service export to the given server account.
+func addExport(opts *server.Options, acc *server.Account, export *Export) error {
+	if export.Stream == "" && export.Service == "" {
+		return errors.New("either stream or service must be set")
+	}
+	if export.Stream != "" && export.Service != "" {
+		return errors.New("stream and service cannot be set at the same time")
+	}
+	if export.TokenRequired && len(export.Accounts) > 0 {
+		return errors.New("token_required and accounts cannot be set at the same time")
+	}
+	// A nil slice means a public export, an empty slice means that a token is required
+	var accounts []*server.Account
+	if export.TokenRequired {
+		accounts = []*server.Account{}
+	} else if len(export.Accounts) > 0 {
+		approved, err := lookupAccounts(opts, export.Accounts)
+		if err != nil {
+			return err
+		}
+		accounts = approved
+	}
+	if export.Stream != "" {
+		if export.ResponseType != "" || export.ResponseThreshold != 0 {
+			return fmt.Errorf("stream export %q cannot have a response type or response threshold", export.Stream)
+		}
+		if err := acc.AddStreamExport(export.Stream, accounts); err != nil {
+			return fmt.Errorf("failed to add stream export %q: %s", export.Stream, err.Error())
+		}
+		return nil
+	}
+	respType, err := ParseResponseType(export.ResponseType)
+	if err != nil {
+		return fmt.Errorf("invalid service export %q: %s", export.Service, err.Error())
+	}
+	if err := acc.AddServiceExportWithResponse(export.Service, respType, accounts); err != nil {
+		return fmt.Errorf("failed to add service export %q: %s", export.Service, err.Error())
+	}
+	if export.ResponseThreshold != 0 {
+		if err := acc.SetServiceExportResponseThreshold(export.Service, export.ResponseThreshold); err != nil {
+			return fmt.Errorf("failed to set service export %q response threshold: %s", export.Service, err.Error())
+		}
+	}
+	return nil
+}
+
+// addImport adds a stream or service import to the given server account.
+// The exporting account must be defined and must have exported the subject.
+func addImport(opts *server.Options, acc *server.Account, imp *Import) error {
+	if imp.Stream == "" && imp.Service == "" {
+		return errors.New("either stream or service must be set")
+	}
+	if imp.Stream != "" && imp.Service != "" {
+		return errors.New("stream and service cannot be set at the same time")
+	}
+	if imp.Account == "" {
+		return errors.New("account cannot be empty")
+	}
+	if imp.Account == acc.Name {
+		return fmt.Errorf("account %q cannot import from itself", imp.Account)
+	}
+	exporter, err := lookupAccount(opts, imp.Account)
+	if err != nil {
+		return err
+	}
+	if imp.Stream != "" {
+		if imp.Prefix != "" && imp.To != "" {
+			return fmt.Errorf("stream import %q cannot have both prefix and to", imp.Stream)
+		}
+		if imp.Share {
+			return fmt.Errorf("stream import %q cannot be shared", imp.Stream)
+		}
+		claim := importClaim(jwt.Stream, exporter, imp.Stream, imp.Token)
+		if imp.Prefix != "" {
+			err = acc.AddStreamImportWithClaim(exporter, imp.Stream, imp.Prefix, claim)
+		} else {
+			err = acc.AddMappedStreamImportWithClaim(exporter, imp.Stream, imp.To, claim)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import stream %q from account %q: %s", imp.Stream, imp.Account, err.Error())
+		}
+		return nil
+	}
+	if imp.Prefix != "" {
+		return fmt.Errorf("service import %q cannot have a prefix", imp.Service)
+	}
+	to := imp.To
+	if to == "" {
+		to = imp.Service
+	}
+	claim := importClaim(jwt.Service, exporter, imp.Service, imp.Token)
+	if err := acc.AddServiceImportWithClaim(exporter, to, imp.Service, claim); err != nil {
+		return fmt.Errorf("failed to import service %q from account %q: %s", imp.Service, imp.Account, err.Error())
+	}
+	if imp.Share {
+		if err := acc.SetServiceImportSharing(exporter, imp.Service, true); err != nil {
+			return fmt.Errorf("failed to share service import %q from account %q: %s", imp.Service, imp.Account, err.Error())
+		}
+	}
+	return nil
+}
+
+// importClaim returns the import claim holding the activation token
+// or nil when no token is provided.
+func importClaim(typ jwt.ExportType, exporter *server.Account, subject string, token string) *jwt.Import {
+	if token == "" {
+		return nil
+	}
+	return &jwt.Import{
+		Account: exporter.Name,
+		Subject: jwt.Subject(subject),
+		Token:   token,
+		Type:    typ,
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
 )
 
 func (o *Options) GetServerOptions() (*server.Options, error) {
@@ -60,6 +61,10 @@ func (o *Options) GetServerOptions() (*server.Options, error) {
 	if err := o.setClusterOpts(&serverOpts); err != nil {
 		return nil, err
 	}
+	// Verify and set gateway options
+	if err := o.setGatewayOpts(&serverOpts); err != nil {
+		return nil, err
+	}
 	// Verify and set jetstream options
 	if err := o.setJetStreamOpts(&serverOpts); err != nil {
 		return nil, err
@@ -108,6 +113,7 @@ func (o *Options) setGlobalOpts(opts *server.Options) error {
 	opts.TraceVerbose = o.TraceVerbose
 	opts.NoLog = o.NoLog
 	opts.NoSublistCache = o.NoSublistCache
+	opts.AlwaysEnableNonce = o.AlwaysEnableNonce
 	opts.MaxConn = o.MaxConn
 	opts.MaxSubs = o.MaxSubs
 	opts.MaxPayload = o.MaxPayload
@@ -141,6 +147,24 @@ func (o *Options) setTLSOpts(opts *server.Options) error {
 			return err
 		}
 	}
+	if o.MQTT != nil && o.MQTT.TLS != nil {
+		// Verify and set mqtt tls options
+		if err := o.MQTT.TLS.setTLSOpts(MQTT_TLS_MAP, opts); err != nil {
+			return err
+		}
+	}
+	if o.Cluster != nil && o.Cluster.TLS != nil {
+		// Verify and set cluster tls options
+		if err := o.Cluster.TLS.setTLSOpts(CLUSTER_TLS_MAP, opts); err != nil {
+			return err
+		}
+	}
+	if o.Gateway != nil && o.Gateway.TLS != nil {
+		// Verify and set gateway tls options
+		if err := o.Gateway.TLS.setTLSOpts(GATEWAY_TLS_MAP, opts); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -248,18 +272,23 @@ func (o *Options) setSystemAccountOpt(opts *server.Options) error {
 	// Don't attempt to parse, system account may be a simple name, maybe it's empty
 	opts.SystemAccount = o.SystemAccount
 	// Check is system account must be created
+	// Options are not modified, so that the system account is created
+	// again each time server options are generated (e.g. on reload).
 	if o.SystemAccount == "" && o.systemAccount == nil && o.Accounts != nil {
 		// We have accounts, but we don't have a system account.
 		// Let's create one named "SYS"
-		o.SystemAccount = "SYS"
+		name := "SYS"
 		// If this account already exists, raise an error, because we don't know
 		// if administrator is aware that this will be the system account or not
 		for _, account := range o.Accounts {
-			if account.Name == o.SystemAccount {
+			if account.Name == name {
 				return errors.New("system account must be explicitely specified when an account named SYS is used")
 			}
 		}
-		o.addAccount(opts, &Account{Name: o.SystemAccount})
+		if err := o.addAccount(opts, &Account{Name: name}); err != nil {
+			return err
+		}
+		opts.SystemAccount = name
 	}
 	return nil
 }
@@ -370,7 +399,7 @@ func (o *Options) setUsersAuth(opts *server.Options) error {
 	return nil
 }
 
-func (o *Options) addAccountUser(opts *server.Options, account *server.Account, user *User) error {
+func (o *Options) addAccountUser(opts *server.Options, account *server.Account, user *User, defaultPermissions *server.Permissions) error {
 	if user.User == "" {
 		return errors.New("cannot add an account user without a name")
 	}
@@ -381,10 +410,15 @@ func (o *Options) addAccountUser(opts *server.Options, account *server.Account,
 	if err != nil {
 		return err
 	}
+	// Users without permissions inherit account default permissions
+	permissions := user.Permissions
+	if permissions == nil && defaultPermissions != nil {
+		permissions = defaultPermissions
+	}
 	accUser := server.User{
 		Username:               user.User,
 		Password:               user.Password,
-		Permissions:            user.Permissions,
+		Permissions:            permissions,
 		AllowedConnectionTypes: allowedConnTypes,
 		Account:                account,
 	}
@@ -396,7 +430,29 @@ func (o *Options) addAccount(opts *server.Options, account *Account) error {
 	if account.Name == "" {
 		return errors.New("authorization.accounts.name cannot be empty")
 	}
-	acc := server.NewAccount(account.Name)
+	if _, err := lookupAccount(opts, account.Name); err == nil {
+		return fmt.Errorf("account %q is defined more than once", account.Name)
+	}
+	if account.Limits != nil && account.Limits.JetStream != nil && !account.JetStream {
+		return fmt.Errorf("account %q has jetstream limits but jetstream is not enabled", account.Name)
+	}
+	if _, err := account.GetJetStreamLimits(); err != nil {
+		return err
+	}
+	if err := account.validateJetStreamResources(); err != nil {
+		return err
+	}
+	acc, err := newServerAccount(account.Name, account.Limits)
+	if err != nil {
+		return err
+	}
+	// Set account public key
+	if account.NKey != "" {
+		if !nkeys.IsValidPublicAccountKey(account.NKey) {
+			return fmt.Errorf("invalid account nkey: %q", account.NKey)
+		}
+		acc.Nkey = account.NKey
+	}
 	// Add mappings
 	for _, mapping := range account.Mappings {
 		if err := acc.AddWeightedMappings(mapping.Subject, mapping.MapDest...); err != nil {
@@ -405,14 +461,61 @@ func (o *Options) addAccount(opts *server.Options, account *Account) error {
 	}
 	// Add users
 	for _, user := range account.Users {
-		if err := o.addAccountUser(opts, acc, &user); err != nil {
+		if err := o.addAccountUser(opts, acc, &user, account.DefaultPermissions); err != nil {
 			return fmt.Errorf("invalid user: %s", err.Error())
 		}
 	}
+	// Add manager used to manage JetStream resources
+	if err := account.rotateManagerKey(); err != nil {
+		return err
+	}
+	if pk := account.managerPublicKey(); pk != "" {
+		opts.Nkeys = append(opts.Nkeys, &server.NkeyUser{
+			Nkey: pk,
+			Permissions: &server.Permissions{
+				Publish:   &server.SubjectPermission{Allow: []string{"$JS.API.>"}},
+				Subscribe: &server.SubjectPermission{Allow: []string{ManagerInboxPrefix + ".>"}},
+			},
+			AllowedConnectionTypes: map[string]struct{}{jwt.ConnectionTypeStandard: {}},
+			Account:                acc,
+		})
+	}
 	opts.Accounts = append(opts.Accounts, acc)
 	return nil
 }
 
+func (o *Options) addAccountExports(opts *server.Options, account *Account) error {
+	if len(account.Exports) == 0 {
+		return nil
+	}
+	acc, err := lookupAccount(opts, account.Name)
+	if err != nil {
+		return err
+	}
+	for _, export := range account.Exports {
+		if err := addExport(opts, acc, export); err != nil {
+			return fmt.Errorf("invalid export: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (o *Options) addAccountImports(opts *server.Options, account *Account) error {
+	if len(account.Imports) == 0 {
+		return nil
+	}
+	acc, err := lookupAccount(opts, account.Name)
+	if err != nil {
+		return err
+	}
+	for _, imp := range account.Imports {
+		if err := addImport(opts, acc, imp); err != nil {
+			return fmt.Errorf("invalid import: %s", err.Error())
+		}
+	}
+	return nil
+}
+
 func (o *Options) setAuthCallout(opts *server.Options) error {
 	if o.Authorization == nil {
 		return nil
@@ -427,10 +530,18 @@ func (o *Options) setAuthCallout(opts *server.Options) error {
 	if acc == "" {
 		acc = "$G"
 	}
+	// Managers of JetStream resources must not be sent to auth callout.
+	// They authenticate by signing the server nonce with an in-memory nkey.
+	authUsers := append([]string{}, o.Authorization.AuthCallout.AuthUsers...)
+	for _, account := range o.Accounts {
+		if pk := account.managerPublicKey(); pk != "" {
+			authUsers = append(authUsers, pk)
+		}
+	}
 	opts.AuthCallout = &server.AuthCallout{
 		Account:   acc,
 		Issuer:    o.Authorization.AuthCallout.Issuer,
-		AuthUsers: o.Authorization.AuthCallout.AuthUsers,
+		AuthUsers: authUsers,
 		XKey:      o.Authorization.AuthCallout.XKey,
 	}
 	return nil
@@ -461,6 +572,18 @@ func (o *Options) setAccountsAuth(opts *server.Options) error {
 			return fmt.Errorf("invalid account: %s", err.Error())
 		}
 	}
+	// Exports and imports are added once all accounts are defined.
+	// Exports must be added first because imports are checked against exports.
+	for _, account := range o.Accounts {
+		if err := o.addAccountExports(opts, account); err != nil {
+			return fmt.Errorf("invalid account %s: %s", account.Name, err.Error())
+		}
+	}
+	for _, account := range o.Accounts {
+		if err := o.addAccountImports(opts, account); err != nil {
+			return fmt.Errorf("invalid account %s: %s", account.Name, err.Error())
+		}
+	}
 	return nil
 }
 
@@ -609,8 +732,14 @@ func (o *Options) setClusterOpts(opts *server.Options) error {
 	if o.Cluster == nil {
 		return nil
 	}
-	if o.Cluster.Name == "" {
-		return errors.New("cluster.name cannot be empty")
+	if err := validateClusterName(o.Cluster.Name); err != nil {
+		return err
+	}
+	if o.Cluster.NoTLS && o.Cluster.TLS != nil {
+		return errors.New("cluster.no_tls and cluster.tls cannot be set at the same time")
+	}
+	if o.Cluster.TLS != nil && o.Cluster.TLS.Insecure {
+		return errors.New("cluster.tls.insecure is not allowed, routes certificates must be verified")
 	}
 	port := o.Cluster.Port
 	if port == 0 {
@@ -623,9 +752,49 @@ func (o *Options) setClusterOpts(opts *server.Options) error {
 	opts.Cluster.NoAdvertise = o.Cluster.NoAdvertise
 	opts.Cluster.ConnectRetries = o.Cluster.ConnectRetries
 	opts.Cluster.PoolSize = o.Cluster.PoolSize
+	opts.Cluster.Permissions = o.Cluster.Permissions
 	if o.Cluster.Compression != nil {
 		opts.Cluster.Compression = server.CompressionOpts{Mode: o.Cluster.Compression.Mode, RTTThresholds: o.Cluster.Compression.RTTThresholds}
 	}
+	// Credentials sent to routes
+	var routeUser *url.Userinfo
+	if auth := o.Cluster.Authorization; auth != nil {
+		if auth.Token != "" || len(auth.Users) > 0 || auth.AuthCallout != nil {
+			return errors.New("cluster.authorization only supports user and password")
+		}
+		if auth.User == "" && auth.Password != "" {
+			return errors.New("cluster.authorization.user cannot be empty when password is set")
+		}
+		opts.Cluster.Username = auth.User
+		opts.Cluster.Password = auth.Password
+		opts.Cluster.AuthTimeout = auth.Timeout.Seconds()
+		if auth.User != "" {
+			routeUser = url.UserPassword(auth.User, auth.Password)
+		}
+	}
+	if o.Cluster.PasswordSeed != "" {
+		if opts.Cluster.Username != "" {
+			return errors.New("cluster.password_seed and cluster.authorization.user cannot be set at the same time")
+		}
+		if o.Cluster.TLS == nil {
+			return errors.New("cluster.password_seed requires cluster.tls")
+		}
+		user, password, err := routeDerivedCredentials(o.Cluster.PasswordSeed, o.Cluster.Name)
+		if err != nil {
+			return err
+		}
+		auth := &routeDerivedPasswordAuth{cluster: o.Cluster.Name, allowed: map[string]struct{}{user: {}}}
+		for _, pk := range o.Cluster.AllowedPasswordKeys {
+			if !nkeys.IsValidPublicServerKey(pk) {
+				return fmt.Errorf("invalid cluster allowed password key: %s", pk)
+			}
+			auth.allowed[pk] = struct{}{}
+		}
+		opts.CustomRouterAuthentication = auth
+		routeUser = url.UserPassword(user, password)
+	} else if len(o.Cluster.AllowedPasswordKeys) > 0 {
+		return errors.New("cluster.allowed_password_keys requires cluster.password_seed")
+	}
 	if len(o.Cluster.Routes) == 0 {
 		opts.Routes = make([]*url.URL, 1)
 		routeUrl, err := url.Parse(fmt.Sprintf("nats-route://localhost:%d", port))
@@ -636,13 +805,90 @@ func (o *Options) setClusterOpts(opts *server.Options) error {
 	} else {
 		opts.Routes = make([]*url.URL, len(o.Cluster.Routes))
 		for i, route := range o.Cluster.Routes {
-			routeUrl, err := url.Parse(route)
+			routeUrl, err := parseRouteURL(route)
 			if err != nil {
-				return fmt.Errorf("invalid cluster route url: %s", err.Error())
+				return err
 			}
 			opts.Routes[i] = routeUrl
 		}
 	}
+	// Add credentials to routes which do not define any
+	for _, routeUrl := range opts.Routes {
+		if routeUrl.User == nil && routeUser != nil {
+			routeUrl.User = routeUser
+		}
+	}
+	return nil
+}
+
+func (o *Options) setGatewayOpts(opts *server.Options) error {
+	if o.Gateway == nil {
+		return nil
+	}
+	if o.Gateway.Name == "" {
+		return errors.New("gateway.name cannot be empty")
+	}
+	if o.Cluster != nil && o.Cluster.Name != o.Gateway.Name {
+		return fmt.Errorf("gateway.name must be the cluster name: %s", o.Cluster.Name)
+	}
+	port := o.Gateway.Port
+	if port == 0 {
+		port = 7222
+	}
+	opts.Gateway.Name = o.Gateway.Name
+	opts.Gateway.Host = o.Gateway.Host
+	opts.Gateway.Port = port
+	opts.Gateway.Advertise = o.Gateway.Advertise
+	opts.Gateway.ConnectRetries = o.Gateway.ConnectRetries
+	opts.Gateway.RejectUnknown = o.Gateway.RejectUnknown
+	if auth := o.Gateway.Authorization; auth != nil {
+		if auth.Token != "" || len(auth.Users) > 0 || auth.AuthCallout != nil {
+			return errors.New("gateway.authorization only supports user and password")
+		}
+		opts.Gateway.Username = auth.User
+		opts.Gateway.Password = auth.Password
+		opts.Gateway.AuthTimeout = auth.Timeout.Seconds()
+	}
+	opts.Gateway.Gateways = make([]*server.RemoteGatewayOpts, len(o.Gateway.Gateways))
+	for i, remote := range o.Gateway.Gateways {
+		if remote.Name == "" {
+			return errors.New("gateway.gateways.name cannot be empty")
+		}
+		if remote.Url == "" && len(remote.Urls) == 0 {
+			return errors.New("gateway.gateways.url or gateway.gateways.urls must be set")
+		}
+		if remote.Url != "" && len(remote.Urls) > 0 {
+			return errors.New("gateway.gateways.url and gateway.gateways.urls cannot be set at the same time")
+		}
+		urls := []*url.URL{}
+		if remote.Url != "" {
+			remote.Urls = append(remote.Urls, remote.Url)
+		}
+		for _, r := range remote.Urls {
+			remoteUrl, err := url.Parse(r)
+			if err != nil {
+				return fmt.Errorf("invalid remote gateway url: %s", err.Error())
+			}
+			urls = append(urls, remoteUrl)
+		}
+		opts.Gateway.Gateways[i] = &server.RemoteGatewayOpts{
+			Name: remote.Name,
+			URLs: urls,
+		}
+		if remote.TLS != nil {
+			if remote.TLS.IsManaged() {
+				return errors.New("gateway.gateways.tls cannot use managed certificates")
+			}
+			config, err := remote.TLS.newConfig()
+			if err != nil {
+				return fmt.Errorf("invalid remote gateway tls: %s", err.Error())
+			}
+			// Remote gateway CA is used to verify the remote server
+			config.RootCAs = config.ClientCAs
+			opts.Gateway.Gateways[i].TLSConfig = config
+			opts.Gateway.Gateways[i].TLSTimeout = remote.TLS.Timeout.Seconds()
+		}
+	}
 	return nil
 }
 
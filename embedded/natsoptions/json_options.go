@@ -12,6 +12,8 @@ import (
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func New() *Options {
@@ -38,48 +40,50 @@ func NewFromJSONFile(path string) (*Options, error) {
 // It can be used to generate a server.Options struct.
 // Default values will be used for missing fields.
 type Options struct {
-	systemAccount    *jwt.AccountClaims
-	ServerName       string                 `json:"name,omitempty"`
-	ServerTags       map[string]string      `json:"tags,omitempty"`
-	Host             string                 `json:"host,omitempty"`
-	Port             int                    `json:"port,omitempty"`
-	Advertise        string                 `json:"advertise,omitempty"`
-	Debug            bool                   `json:"debug,omitempty"`
-	Trace            bool                   `json:"trace,omitempty"`
-	TraceVerbose     bool                   `json:"trace_verbose,omitempty"`
-	HTTPHost         string                 `json:"http_host,omitempty"`
-	HTTPPort         int                    `json:"http_port,omitempty"`
-	HTTPSPort        int                    `json:"https_port,omitempty"`
-	HTTPBasePath     string                 `json:"http_base_path,omitempty"`
-	NoLog            bool                   `json:"disable_logging,omitempty"`
-	NoTLS            bool                   `json:"no_tls,omitempty"`
-	TLS              *TLSMap                `json:"tls,omitempty"`
-	NoSublistCache   bool                   `json:"disable_sublist_cache,omitempty"`
-	MaxConn          int                    `json:"max_connections,omitempty"`
-	MaxPayload       int32                  `json:"max_payload,omitempty"`
-	MaxPending       int64                  `json:"max_pending,omitempty"`
-	MaxClosedClients int                    `json:"max_closed_clients,omitempty"`
-	MaxSubs          int                    `json:"max_subscriptions,omitempty"`
-	MaxSubsTokens    uint8                  `json:"max_subscriptions_tokens,omitempty"`
-	MaxControlLine   int32                  `json:"max_control_line,omitempty"`
-	MaxTracedMsgLen  int                    `json:"max_traced_msg_len,omitempty"`
-	MaxPingsOut      int                    `json:"max_pings_out,omitempty"`
-	PingInterval     time.Duration          `json:"ping_interval,omitempty"`
-	WriteDeadline    time.Duration          `json:"write_deadline,omitempty"`
-	NoAuthUser       string                 `json:"no_auth_user,omitempty"`
-	Operators        []string               `json:"operators,omitempty"`
-	SystemAccount    string                 `json:"system_account,omitempty"`
-	Accounts         []*Account             `json:"accounts,omitempty"`
-	Authorization    *AuthorizationMap      `json:"authorization,omitempty"`
-	FullResolver     *FullAccountResolver   `json:"full_resolver,omitempty"`
-	CacheResolver    *CacheAccountResolver  `json:"cache_resolver,omitempty"`
-	MemoryResolver   *MemoryAccountResolver `json:"memory_resolver,omitempty"`
-	Cluster          *Cluster               `json:"cluster,omitempty"`
-	Websocket        *Websocket             `json:"websocket,omitempty"`
-	MQTT             *MQTT                  `json:"mqtt,omitempty"`
-	JetStream        *JetStream             `json:"jetstream,omitempty"`
-	Leafnode         *Leafnode              `json:"leafnode,omitempty"`
-	Metrics          *Metrics               `json:"metrics,omitempty"`
+	systemAccount     *jwt.AccountClaims
+	ServerName        string                 `json:"name,omitempty"`
+	ServerTags        map[string]string      `json:"tags,omitempty"`
+	Host              string                 `json:"host,omitempty"`
+	Port              int                    `json:"port,omitempty"`
+	Advertise         string                 `json:"advertise,omitempty"`
+	Debug             bool                   `json:"debug,omitempty"`
+	Trace             bool                   `json:"trace,omitempty"`
+	TraceVerbose      bool                   `json:"trace_verbose,omitempty"`
+	HTTPHost          string                 `json:"http_host,omitempty"`
+	HTTPPort          int                    `json:"http_port,omitempty"`
+	HTTPSPort         int                    `json:"https_port,omitempty"`
+	HTTPBasePath      string                 `json:"http_base_path,omitempty"`
+	NoLog             bool                   `json:"disable_logging,omitempty"`
+	NoTLS             bool                   `json:"no_tls,omitempty"`
+	TLS               *TLSMap                `json:"tls,omitempty"`
+	NoSublistCache    bool                   `json:"disable_sublist_cache,omitempty"`
+	MaxConn           int                    `json:"max_connections,omitempty"`
+	MaxPayload        int32                  `json:"max_payload,omitempty"`
+	MaxPending        int64                  `json:"max_pending,omitempty"`
+	MaxClosedClients  int                    `json:"max_closed_clients,omitempty"`
+	MaxSubs           int                    `json:"max_subscriptions,omitempty"`
+	MaxSubsTokens     uint8                  `json:"max_subscriptions_tokens,omitempty"`
+	MaxControlLine    int32                  `json:"max_control_line,omitempty"`
+	MaxTracedMsgLen   int                    `json:"max_traced_msg_len,omitempty"`
+	MaxPingsOut       int                    `json:"max_pings_out,omitempty"`
+	PingInterval      time.Duration          `json:"ping_interval,omitempty"`
+	WriteDeadline     time.Duration          `json:"write_deadline,omitempty"`
+	NoAuthUser        string                 `json:"no_auth_user,omitempty"`
+	AlwaysEnableNonce bool                   `json:"always_enable_nonce,omitempty"`
+	Operators         []string               `json:"operators,omitempty"`
+	SystemAccount     string                 `json:"system_account,omitempty"`
+	Accounts          []*Account             `json:"accounts,omitempty"`
+	Authorization     *AuthorizationMap      `json:"authorization,omitempty"`
+	FullResolver      *FullAccountResolver   `json:"full_resolver,omitempty"`
+	CacheResolver     *CacheAccountResolver  `json:"cache_resolver,omitempty"`
+	MemoryResolver    *MemoryAccountResolver `json:"memory_resolver,omitempty"`
+	Cluster           *Cluster               `json:"cluster,omitempty"`
+	Gateway           *Gateway               `json:"gateway,omitempty"`
+	Websocket         *Websocket             `json:"websocket,omitempty"`
+	MQTT              *MQTT                  `json:"mqtt,omitempty"`
+	JetStream         *JetStream             `json:"jetstream,omitempty"`
+	Leafnode          *Leafnode              `json:"leafnode,omitempty"`
+	Metrics           *Metrics               `json:"metrics,omitempty"`
 }
 
 // SubjectMapping is for mapping published subjects for clients.
@@ -106,20 +110,115 @@ type User struct {
 	AllowedConnectionTypes []string            `json:"allowed_connection_types,omitempty"`
 }
 
-type AccountLimits = jwt.AccountLimits
+// Export is the configuration for an account export.
+// Either a stream or a service subject must be provided.
+// When no accounts are listed and token is not required, the export is public.
+// Response type and response threshold are only valid for service exports.
+type Export struct {
+	Stream            string        `json:"stream,omitempty"`
+	Service           string        `json:"service,omitempty"`
+	Accounts          []string      `json:"accounts,omitempty"`
+	ResponseType      string        `json:"response_type,omitempty"`
+	ResponseThreshold time.Duration `json:"response_threshold,omitempty"`
+	TokenRequired     bool          `json:"token_required,omitempty"`
+}
+
+// Import is the configuration for an account import.
+// Either a stream or a service subject must be provided, as well as
+// the name of the account exporting the subject.
+// Prefix is only valid for stream imports. To can be used with both streams
+// and services to import the subject under a different local subject.
+// Token is an activation token, required when export requires a token.
+type Import struct {
+	Stream  string `json:"stream,omitempty"`
+	Service string `json:"service,omitempty"`
+	Account string `json:"account,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	To      string `json:"to,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Share   bool   `json:"share,omitempty"`
+}
+
+// JetStreamTierLimits is the configuration for JetStream limits of an account
+// applied to streams of a given replica count, or to all streams.
+// Zero values mean that no limit is applied.
+type JetStreamTierLimits struct {
+	MaxMemory            int64 `json:"max_memory,omitempty"`
+	MaxStore             int64 `json:"max_store,omitempty"`
+	MaxStreams           int   `json:"max_streams,omitempty"`
+	MaxConsumers         int   `json:"max_consumers,omitempty"`
+	MaxAckPending        int   `json:"max_ack_pending,omitempty"`
+	MemoryMaxStreamBytes int64 `json:"memory_max_stream_bytes,omitempty"`
+	StoreMaxStreamBytes  int64 `json:"store_max_stream_bytes,omitempty"`
+	MaxBytesRequired     bool  `json:"max_bytes_required,omitempty"`
+}
+
+// AccountJetStreamLimits is the configuration for the JetStream limits of an account.
+// Either global limits or tiered limits can be configured, but not both.
+// Keys of tiered limits are replica counts prefixed with "R" (e.g. "R1", "R3").
+type AccountJetStreamLimits struct {
+	JetStreamTierLimits
+	Tiers map[string]*JetStreamTierLimits `json:"tiers,omitempty"`
+}
+
+// AccountLimits is the configuration for the limits of an account.
+// Zero values mean that no limit is applied.
+type AccountLimits struct {
+	MaxConnections   int32                   `json:"max_connections,omitempty"`
+	MaxLeafnodes     int32                   `json:"max_leafnodes,omitempty"`
+	MaxSubscriptions int32                   `json:"max_subscriptions,omitempty"`
+	MaxPayload       int32                   `json:"max_payload,omitempty"`
+	JetStream        *AccountJetStreamLimits `json:"jetstream,omitempty"`
+}
+
+// Stream is the configuration for a JetStream stream and its consumers.
+// Stream configuration uses the same JSON schema as the JetStream API.
+// Consumers must be durable, I.E, they must have a durable name or a name.
+type Stream struct {
+	nats.StreamConfig
+	Consumers []*nats.ConsumerConfig `json:"consumers,omitempty"`
+}
+
+// KeyValueStore is the configuration for a JetStream key value bucket.
+type KeyValueStore struct {
+	Bucket       string           `json:"bucket"`
+	Description  string           `json:"description,omitempty"`
+	MaxValueSize int32            `json:"max_value_size,omitempty"`
+	History      uint8            `json:"history,omitempty"`
+	TTL          time.Duration    `json:"ttl,omitempty"`
+	MaxBytes     int64            `json:"max_bytes,omitempty"`
+	Storage      nats.StorageType `json:"storage,omitempty"`
+	Replicas     int              `json:"replicas,omitempty"`
+}
+
+// ObjectStore is the configuration for a JetStream object store bucket.
+type ObjectStore struct {
+	Bucket      string           `json:"bucket"`
+	Description string           `json:"description,omitempty"`
+	TTL         time.Duration    `json:"ttl,omitempty"`
+	MaxBytes    int64            `json:"max_bytes,omitempty"`
+	Storage     nats.StorageType `json:"storage,omitempty"`
+	Replicas    int              `json:"replicas,omitempty"`
+}
 
 // Account is the configuration for a server account.
 // It can be used when defining an authorization configuration.
+// Streams, key value stores and object stores are created or updated
+// by the runner when the server is started or reloaded.
 type Account struct {
+	manager            nkeys.KeyPair
 	Name               string              `json:"name,omitempty"`
 	NKey               string              `json:"nkey,omitempty"`
 	Users              []User              `json:"users,omitempty"`
-	Exports            []string            `json:"exports,omitempty"`
-	Imports            []string            `json:"imports,omitempty"`
+	Exports            []*Export           `json:"exports,omitempty"`
+	Imports            []*Import           `json:"imports,omitempty"`
 	JetStream          bool                `json:"jetstream,omitempty"`
 	DefaultPermissions *server.Permissions `json:"default_permissions,omitempty"`
 	Mappings           []*SubjectMapping   `json:"mappings,omitempty"`
 	Limits             *AccountLimits      `json:"limits,omitempty"`
+	Streams            []*Stream           `json:"streams,omitempty"`
+	KeyValueStores     []*KeyValueStore    `json:"key_value_stores,omitempty"`
+	ObjectStores       []*ObjectStore      `json:"object_stores,omitempty"`
 }
 
 // AuthorizationMap block provides authentication configuration
@@ -154,20 +253,60 @@ type ClusterCompression struct {
 //	Cluster{Name: "cluster-name"}
 //
 // Default values will be used for missing fields.
+// Routes authenticate either with the user and password of the authorization block,
+// or with a password derived from a server seed: PasswordSeed is the server seed of
+// this node, and AllowedPasswordKeys are the public keys of the other nodes. Credentials are added to route urls which do not
+// define any. Permissions restrict the subjects imported from and exported to routes.
 // Documentation: https://docs.nats.io/running-a-nats-service/configuration/clustering/cluster_config
 type Cluster struct {
-	Name           string              `json:"name"`
-	Host           string              `json:"host,omitempty"`
-	Port           int                 `json:"port,omitempty"`
-	Advertise      string              `json:"advertise,omitempty"`
-	Routes         []string            `json:"routes,omitempty"`
-	TLS            *TLSMap             `json:"tls,omitempty"`
-	NoTLS          bool                `json:"no_tls,omitempty"`
-	NoAdvertise    bool                `json:"no_advertise,omitempty"`
-	Authorization  *AuthorizationMap   `json:"authorization,omitempty"`
-	ConnectRetries int                 `json:"connect_retries,omitempty"`
-	PoolSize       int                 `json:"pool_size,omitempty"`
-	Compression    *ClusterCompression `json:"compression,omitempty"`
+	Name                string                   `json:"name"`
+	Host                string                   `json:"host,omitempty"`
+	Port                int                      `json:"port,omitempty"`
+	Advertise           string                   `json:"advertise,omitempty"`
+	Routes              []string                 `json:"routes,omitempty"`
+	TLS                 *TLSMap                  `json:"tls,omitempty"`
+	NoTLS               bool                     `json:"no_tls,omitempty"`
+	NoAdvertise         bool                     `json:"no_advertise,omitempty"`
+	Authorization       *AuthorizationMap        `json:"authorization,omitempty"`
+	PasswordSeed        string                   `json:"password_seed,omitempty"`
+	AllowedPasswordKeys []string                 `json:"allowed_password_keys,omitempty"`
+	Permissions         *server.RoutePermissions `json:"permissions,omitempty"`
+	ConnectRetries      int                      `json:"connect_retries,omitempty"`
+	PoolSize            int                      `json:"pool_size,omitempty"`
+	Compression         *ClusterCompression      `json:"compression,omitempty"`
+}
+
+// Gateway is the configuration for the gateway server.
+// Gateways connect clusters into a super-cluster.
+// Gateway server is disabled by default. It can be enabled
+// by providing a Gateway struct with at least a name:
+//
+//	Gateway{Name: "gateway-name"}
+//
+// When a cluster is configured, gateway name must be the cluster name.
+// Default values will be used for missing fields.
+// Documentation: https://docs.nats.io/running-a-nats-service/configuration/gateways/gateway
+type Gateway struct {
+	Name           string            `json:"name"`
+	Host           string            `json:"host,omitempty"`
+	Port           int               `json:"port,omitempty"`
+	Advertise      string            `json:"advertise,omitempty"`
+	Authorization  *AuthorizationMap `json:"authorization,omitempty"`
+	TLS            *TLSMap           `json:"tls,omitempty"`
+	ConnectRetries int               `json:"connect_retries,omitempty"`
+	RejectUnknown  bool              `json:"reject_unknown_cluster,omitempty"`
+	Gateways       []RemoteGateway   `json:"gateways,omitempty"`
+}
+
+// RemoteGateway is the configuration for a remote gateway connection.
+// It is used when defining a gateway configuration.
+// Either a single URL can be provided, or a list of URLs.
+// When TLS is not provided, gateway TLS configuration is used.
+type RemoteGateway struct {
+	Name string   `json:"name"`
+	Url  string   `json:"url,omitempty"`
+	Urls []string `json:"urls,omitempty"`
+	TLS  *TLSMap  `json:"tls,omitempty"`
 }
 
 // Websocket is the configuration for the websocket server
@@ -302,6 +441,8 @@ type Metrics struct {
 // TLSMap is a configuration block for TLSMap servers.
 // TLSMap configuration MUST NOT be provided when Let's Encrypt
 // certificates are expected to be issued.
+// ClientCA is the ID of a caddy PKI certificate authority used to verify
+// peer certificates when certificates are managed by caddy.
 type TLSMap struct {
 	config           *tls.Config
 	Subjects         []string      `json:"subjects,omitempty"`
@@ -312,6 +453,7 @@ type TLSMap struct {
 	CertMatchBy      string        `json:"cert_match_by,omitempty"`
 	KeyFile          string        `json:"key_file,omitempty"`
 	CaFile           string        `json:"ca_file,omitempty"`
+	ClientCA         string        `json:"client_ca,omitempty"`
 	Verify           bool          `json:"verify,omitempty"`
 	Insecure         bool          `json:"insecure,omitempty"`
 	Map              bool          `json:"map,omitempty"`
@@ -340,5 +482,14 @@ func (m *TLSMap) SetConfigOverride(config *tls.Config) {
 		}
 		return _cfg.GetCertificate(hello)
 	}
+	// Certificates are looked up on each handshake, so that renewed certificates
+	// are used without restarting the server. Outgoing connections (routes,
+	// leafnode remotes) present the certificate of the first subject.
+	if len(m.Subjects) > 0 {
+		serverName := m.Subjects[0]
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		}
+	}
 	m.config = cfg
 }
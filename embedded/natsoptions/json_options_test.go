@@ -3,9 +3,28 @@
 package natsoptions_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func TestDefaultOptions(t *testing.T) {
@@ -21,3 +40,629 @@ func TestDefaultOptions(t *testing.T) {
 		t.Fatal("Expected nats options to be created")
 	}
 }
+
+func TestAccountsExportsAndImports(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"port": -1,
+		"accounts": [
+			{
+				"name": "A",
+				"users": [{"user": "a", "password": "a"}],
+				"exports": [
+					{"stream": "events.>", "accounts": ["B"]},
+					{"service": "api.>", "response_type": "stream"}
+				]
+			},
+			{
+				"name": "B",
+				"users": [{"user": "b", "password": "b"}],
+				"imports": [
+					{"stream": "events.>", "account": "A", "prefix": "a"},
+					{"service": "api.>", "account": "A"}
+				]
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverOpts, err := opts.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, acc := range serverOpts.Accounts {
+		switch acc.Name {
+		case "A":
+			if !acc.IsExportService("api.>") {
+				t.Fatal("Expected api.> to be exported as a service")
+			}
+		case "B":
+			if acc.NumServiceImports() != 1 {
+				t.Fatalf("Expected 1 service import, got %d", acc.NumServiceImports())
+			}
+		}
+	}
+	srv := runServer(t, serverOpts)
+	ncA := connect(t, srv, "a", "a")
+	ncB := connect(t, srv, "b", "b")
+	// Stream import is available under the import prefix
+	sub, err := ncB.SubscribeSync("a.events.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ncB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ncA.Publish("events.test", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Expected to receive imported stream message: %s", err.Error())
+	}
+	if msg.Subject != "a.events.test" {
+		t.Fatalf("Expected subject a.events.test, got %s", msg.Subject)
+	}
+	// Service export with stream response type allows several responses
+	if _, err := ncA.Subscribe("api.>", func(msg *nats.Msg) {
+		msg.Respond([]byte("1"))
+		msg.Respond([]byte("2"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ncA.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	inbox := nats.NewInbox()
+	replies, err := ncB.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ncB.PublishRequest("api.test", inbox, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := replies.NextMsg(time.Second); err != nil {
+			t.Fatalf("Expected to receive response %d: %s", i+1, err.Error())
+		}
+	}
+}
+
+func TestAccountsImportUnknownAccount(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"accounts": [
+			{"name": "B", "imports": [{"stream": "events.>", "account": "A"}]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.GetServerOptions(); err == nil {
+		t.Fatal("Expected an error when importing from an unknown account")
+	}
+}
+
+func TestAccountsImportNotExported(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"accounts": [
+			{"name": "A", "exports": [{"stream": "events.>", "accounts": ["C"]}]},
+			{"name": "B", "imports": [{"stream": "events.>", "account": "A"}]},
+			{"name": "C"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.GetServerOptions(); err == nil {
+		t.Fatal("Expected an error when importing a subject which is not exported to the account")
+	}
+}
+
+func TestAccountsLimitsAndDefaultPermissions(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"accounts": [
+			{
+				"name": "A",
+				"limits": {"max_connections": 10},
+				"default_permissions": {"publish": {"allow": ["foo"]}},
+				"users": [{"user": "a", "password": "a"}]
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverOpts, err := opts.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := serverOpts.Accounts[0].MaxActiveConnections(); max != 10 {
+		t.Fatalf("Expected max connections to be 10, got %d", max)
+	}
+	if len(serverOpts.Users) != 1 || serverOpts.Users[0].Permissions == nil {
+		t.Fatal("Expected user to inherit default permissions")
+	}
+	pub := serverOpts.Users[0].Permissions.Publish
+	if pub == nil || len(pub.Allow) != 1 || pub.Allow[0] != "foo" {
+		t.Fatalf("Expected user to be allowed to publish on foo, got %+v", pub)
+	}
+}
+
+func TestAccountsJetStreamLimits(t *testing.T) {
+	acc := &natsoptions.Account{Name: "A", Limits: &natsoptions.AccountLimits{}}
+	if err := json.Unmarshal([]byte(`{"jetstream": {"max_store": 1024, "max_ack_pending": 100}}`), acc.Limits); err != nil {
+		t.Fatal(err)
+	}
+	limits, err := acc.GetJetStreamLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	global, ok := limits[""]
+	if !ok || len(limits) != 1 {
+		t.Fatalf("Expected global limits, got %+v", limits)
+	}
+	if global.MaxStore != 1024 || global.MaxAckPending != 100 || global.MaxMemory != -1 {
+		t.Fatalf("Unexpected global limits: %+v", global)
+	}
+	if err := json.Unmarshal([]byte(`{"jetstream": {"tiers": {"R1": {"max_streams": 10}, "R3": {"max_streams": 2}}}}`), acc.Limits); err != nil {
+		t.Fatal(err)
+	}
+	// Global limits are still set from the previous configuration
+	if _, err := acc.GetJetStreamLimits(); err == nil {
+		t.Fatal("Expected an error when both global and tiered limits are set")
+	}
+	acc.Limits.JetStream.JetStreamTierLimits = natsoptions.JetStreamTierLimits{}
+	limits, err = acc.GetJetStreamLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["R1"].MaxStreams != 10 || limits["R3"].MaxStreams != 2 {
+		t.Fatalf("Unexpected tiered limits: %+v", limits)
+	}
+	acc.Limits.JetStream.Tiers["replicas"] = nil
+	if _, err := acc.GetJetStreamLimits(); err == nil {
+		t.Fatal("Expected an error for an invalid tier")
+	}
+}
+
+func TestAccountsJetStreamResources(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"jetstream": {},
+		"accounts": [
+			{
+				"name": "A",
+				"jetstream": true,
+				"users": [{"user": "a", "password": "a"}],
+				"streams": [{"name": "EVENTS", "subjects": ["events.>"], "consumers": [{"durable_name": "worker"}]}],
+				"key_value_stores": [{"bucket": "config", "history": 5, "storage": "memory"}]
+			}
+		],
+		"authorization": {"auth_callout": {"issuer": "ABJHLOVMPA4CI6R5KLNGOB4GSLNIY7IOUPAJC4YFNDLQVIOBYQGUWVLA", "account": "A", "auth_users": ["a"]}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Accounts[0].KeyValueStores[0].Storage != nats.MemoryStorage {
+		t.Fatalf("unexpected key value store storage: %s", opts.Accounts[0].KeyValueStores[0].Storage)
+	}
+	serverOpts, err := opts.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := opts.Accounts[0].ManagerKey()
+	if manager == nil {
+		t.Fatal("expected manager nkey to be generated")
+	}
+	pk, err := manager.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, user := range serverOpts.Nkeys {
+		if user.Nkey == pk && user.Account.Name == "A" {
+			found = true
+			if len(user.Permissions.Publish.Allow) != 1 || user.Permissions.Publish.Allow[0] != "$JS.API.>" {
+				t.Fatalf("unexpected manager permissions: %+v", user.Permissions.Publish)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected manager to be added to account")
+	}
+	for _, user := range serverOpts.Users {
+		if user.Account.Name == "A" && user.Username != "a" {
+			t.Fatalf("unexpected password user: %s", user.Username)
+		}
+	}
+	if len(serverOpts.AuthCallout.AuthUsers) != 2 || serverOpts.AuthCallout.AuthUsers[1] != pk {
+		t.Fatalf("expected manager to bypass auth callout: %v", serverOpts.AuthCallout.AuthUsers)
+	}
+	// Manager nkey is rotated each time server options are built
+	if _, err := opts.GetServerOptions(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := opts.Accounts[0].ManagerKey().PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == pk {
+		t.Fatal("expected manager nkey to be rotated")
+	}
+}
+
+func TestAccountsJetStreamResourcesRequireJetStream(t *testing.T) {
+	for _, account := range []string{
+		`{"name": "A", "streams": [{"name": "EVENTS"}]}`,
+		`{"name": "A", "jetstream": true, "streams": [{"subjects": ["events.>"]}]}`,
+		`{"name": "A", "jetstream": true, "streams": [{"name": "EVENTS", "consumers": [{"filter_subject": "events.>"}]}]}`,
+		`{"name": "A", "jetstream": true, "key_value_stores": [{}]}`,
+		`{"name": "A", "jetstream": true, "object_stores": [{}]}`,
+	} {
+		opts, err := natsoptions.NewFromJSON([]byte(`{"jetstream": {}, "accounts": [` + account + `]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opts.GetServerOptions(); err == nil {
+			t.Fatalf("expected an error for account %s", account)
+		}
+	}
+}
+
+func TestTLSConfigOverride(t *testing.T) {
+	renewed := &tls.Certificate{}
+	current := &tls.Certificate{}
+	caddyConfig := &tls.Config{}
+	caddyConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "nats.example.com" {
+				t.Errorf("unexpected server name: %s", hello.ServerName)
+			}
+			return current, nil
+		}}, nil
+	}
+	opts := natsoptions.New()
+	opts.Cluster = &natsoptions.Cluster{Name: "test"}
+	opts.TLS = &natsoptions.TLSMap{Subjects: []string{"nats.example.com"}}
+	opts.TLS.SetConfigOverride(caddyConfig)
+	serverOpts, err := opts.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Certificate is looked up on each handshake, including for outgoing connections
+	current = renewed
+	cert, err := serverOpts.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "nats.example.com"})
+	if err != nil || cert != renewed {
+		t.Fatalf("expected renewed certificate, got %v (%v)", cert, err)
+	}
+	cert, err = serverOpts.TLSConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil || cert != renewed {
+		t.Fatalf("expected renewed client certificate, got %v (%v)", cert, err)
+	}
+}
+
+func TestMQTTAndClusterTLSConfigOverride(t *testing.T) {
+	pool := x509.NewCertPool()
+	caddyConfig := &tls.Config{RootCAs: pool}
+	opts := natsoptions.New()
+	opts.ServerName = "test"
+	opts.JetStream = &natsoptions.JetStream{}
+	opts.MQTT = &natsoptions.MQTT{TLS: &natsoptions.TLSMap{Subjects: []string{"mqtt.example.com"}}}
+	opts.MQTT.TLS.SetConfigOverride(caddyConfig)
+	opts.Cluster = &natsoptions.Cluster{Name: "test", TLS: &natsoptions.TLSMap{Subjects: []string{"route.example.com"}, Timeout: 2 * time.Second}}
+	opts.Cluster.TLS.SetConfigOverride(caddyConfig)
+	serverOpts, err := opts.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverOpts.MQTT.TLSConfig == nil || serverOpts.MQTT.Port != 8883 {
+		t.Fatalf("expected mqtt tls to be enabled: %+v", serverOpts.MQTT)
+	}
+	if serverOpts.Cluster.TLSConfig == nil || serverOpts.Cluster.TLSConfig.RootCAs != pool {
+		t.Fatalf("expected cluster tls to use caddy config: %+v", serverOpts.Cluster.TLSConfig)
+	}
+	if serverOpts.Cluster.TLSTimeout != 2 {
+		t.Fatalf("unexpected cluster tls timeout: %f", serverOpts.Cluster.TLSTimeout)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	newOptions := func(name string, remotes string) *natsoptions.Options {
+		opts, err := natsoptions.NewFromJSON([]byte(fmt.Sprintf(`{
+			"port": -1,
+			"disable_logging": true,
+			"gateway": {
+				"name": %q,
+				"host": "127.0.0.1",
+				"port": -1,
+				"authorization": {"user": "gw", "password": "secret"},
+				"gateways": %s
+			}
+		}`, name, remotes)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+	optsA := newOptions("A", "[]")
+	serverOptsA, err := optsA.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverOptsA.Gateway.Username != "gw" || serverOptsA.Gateway.Password != "secret" {
+		t.Fatalf("unexpected gateway authorization: %+v", serverOptsA.Gateway)
+	}
+	srvA := runServer(t, serverOptsA)
+	optsB := newOptions("B", fmt.Sprintf(`[{"name": "A", "url": "nats://gw:secret@%s"}]`, srvA.GatewayAddr()))
+	serverOptsB, err := optsB.GetServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverOptsB.Gateway.Gateways) != 1 || serverOptsB.Gateway.Gateways[0].Name != "A" || len(serverOptsB.Gateway.Gateways[0].URLs) != 1 {
+		t.Fatalf("unexpected remote gateways: %+v", serverOptsB.Gateway.Gateways)
+	}
+	srvB := runServer(t, serverOptsB)
+	deadline := time.Now().Add(5 * time.Second)
+	for srvA.NumOutboundGateways() != 1 || srvB.NumOutboundGateways() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("gateways did not connect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGatewayInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"gateway": {}}`,
+		`{"cluster": {"name": "A"}, "gateway": {"name": "B"}}`,
+		`{"gateway": {"name": "A", "authorization": {"token": "secret"}}}`,
+		`{"gateway": {"name": "A", "gateways": [{"name": "B"}]}}`,
+		`{"gateway": {"name": "A", "gateways": [{"name": "B", "url": "nats://b:7222", "urls": ["nats://b:7222"]}]}}`,
+	} {
+		opts, err := natsoptions.NewFromJSON([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opts.GetServerOptions(); err == nil {
+			t.Fatalf("expected an error for config %s", config)
+		}
+	}
+}
+
+func TestClusterRouteAuthorization(t *testing.T) {
+	ports := []int{freePort(t), freePort(t), freePort(t)}
+	routes := fmt.Sprintf(`["nats-route://127.0.0.1:%d", "nats-route://127.0.0.1:%d"]`, ports[0], ports[1])
+	newServer := func(port int, password string) *server.Server {
+		opts, err := natsoptions.NewFromJSON([]byte(fmt.Sprintf(`{
+			"port": -1,
+			"disable_logging": true,
+			"cluster": {
+				"name": "C",
+				"host": "127.0.0.1",
+				"port": %d,
+				"routes": %s,
+				"authorization": {"user": "route", "password": %q},
+				"permissions": {"import": {"allow": ["foo.>"]}, "export": {"deny": ["secret.>"]}}
+			}
+		}`, port, routes, password)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverOpts, err := opts.GetServerOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serverOpts.Cluster.Permissions == nil || serverOpts.Cluster.Permissions.Import.Allow[0] != "foo.>" {
+			t.Fatalf("unexpected route permissions: %+v", serverOpts.Cluster.Permissions)
+		}
+		if serverOpts.Routes[0].User.Username() != "route" {
+			t.Fatalf("expected credentials to be added to route url: %s", serverOpts.Routes[0].Redacted())
+		}
+		return runServer(t, serverOpts)
+	}
+	srvA := newServer(ports[0], "secret")
+	srvB := newServer(ports[1], "secret")
+	waitForRoutes(t, 1, srvA, srvB)
+	// Server with invalid credentials is rejected
+	srvC := newServer(ports[2], "invalid")
+	time.Sleep(500 * time.Millisecond)
+	if srvC.NumRoutes() != 0 {
+		t.Fatalf("expected route with invalid credentials to be rejected")
+	}
+}
+
+func TestClusterRouteDerivedPasswords(t *testing.T) {
+	caFile, certFile, keyFile, fingerprint := newTestCertificates(t)
+	ports := []int{freePort(t), freePort(t), freePort(t)}
+	routes := fmt.Sprintf(`["nats-route://127.0.0.1:%d", "nats-route://127.0.0.1:%d"]`, ports[0], ports[1])
+	seeds := []string{newServerSeed(t), newServerSeed(t), newServerSeed(t)}
+	allowed := []string{publicKey(t, seeds[0]), publicKey(t, seeds[1])}
+	newServer := func(i int) *server.Server {
+		opts, err := natsoptions.NewFromJSON([]byte(fmt.Sprintf(`{
+			"port": -1,
+			"disable_logging": true,
+			"cluster": {
+				"name": "C",
+				"host": "127.0.0.1",
+				"port": %d,
+				"routes": %s,
+				"password_seed": %q,
+				"allowed_password_keys": [%q, %q],
+				"tls": {"cert_file": %q, "key_file": %q, "ca_file": %q, "pinned_certs": [%q]}
+			}
+		}`, ports[i], routes, seeds[i], allowed[0], allowed[1], certFile, keyFile, caFile, fingerprint)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverOpts, err := opts.GetServerOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serverOpts.Cluster.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert || len(serverOpts.Cluster.TLSPinnedCerts) != 1 {
+			t.Fatalf("expected routes tls to be verified: %+v", serverOpts.Cluster)
+		}
+		return runServer(t, serverOpts)
+	}
+	srvA := newServer(0)
+	srvB := newServer(1)
+	waitForRoutes(t, 1, srvA, srvB)
+	// Server with an unknown public key is rejected
+	srvC := newServer(2)
+	time.Sleep(500 * time.Millisecond)
+	if srvC.NumRoutes() != 0 {
+		t.Fatalf("expected route with unknown public key to be rejected")
+	}
+}
+
+func TestClusterInvalid(t *testing.T) {
+	seed := newServerSeed(t)
+	for _, config := range []string{
+		`{"cluster": {"name": "my cluster"}}`,
+		`{"cluster": {"name": "C", "routes": ["http://127.0.0.1:6222"]}}`,
+		`{"cluster": {"name": "C", "routes": ["nats-route://127.0.0.1"]}}`,
+		`{"cluster": {"name": "C", "authorization": {"token": "secret"}}}`,
+		`{"cluster": {"name": "C", "no_tls": true, "tls": {"subjects": ["route.example.com"]}}}`,
+		`{"cluster": {"name": "C", "tls": {"subjects": ["route.example.com"], "insecure": true}}}`,
+		fmt.Sprintf(`{"cluster": {"name": "C", "password_seed": %q}}`, seed),
+		fmt.Sprintf(`{"cluster": {"name": "C", "password_seed": %q, "authorization": {"user": "route"}, "tls": {"subjects": ["route.example.com"]}}}`, seed),
+		`{"cluster": {"name": "C", "allowed_password_keys": ["NA"]}}`,
+	} {
+		opts, err := natsoptions.NewFromJSON([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opts.GetServerOptions(); err == nil {
+			t.Fatalf("expected an error for config %s", config)
+		}
+	}
+}
+
+func waitForRoutes(t *testing.T, expected int, servers ...*server.Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, srv := range servers {
+		for srv.NumRoutes() < expected {
+			if time.Now().After(deadline) {
+				t.Fatal("routes did not connect")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func newServerSeed(t *testing.T) string {
+	t.Helper()
+	kp, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(seed)
+}
+
+func publicKey(t *testing.T, seed string) string {
+	t.Helper()
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// newTestCertificates writes a CA and a certificate valid for 127.0.0.1
+// signed by the CA. It returns the files and the pinned certificate fingerprint.
+func newTestCertificates(t *testing.T) (string, string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "route"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	write := func(name string, blockType string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write("ca.pem", "CERTIFICATE", caDER), write("cert.pem", "CERTIFICATE", der), write("key.pem", "EC PRIVATE KEY", keyDER), hex.EncodeToString(sum[:])
+}
+
+func runServer(t *testing.T, opts *server.Options) *server.Server {
+	t.Helper()
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Server not ready for connections")
+	}
+	return srv
+}
+
+func connect(t *testing.T, srv *server.Server, user string, password string) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(srv.ClientURL(), nats.UserInfo(user, password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
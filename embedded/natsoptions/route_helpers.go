@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsoptions
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+// routeDerivedPasswordAuth authenticates routes using passwords derived from server seeds.
+// Routes present the public key of their seed as username, and the signature of the
+// cluster name as password. nats-server does not sign the nonce when connecting
+// routes, so this is a static password: it can be replayed by anyone able to read
+// it, and routes using derived passwords must use TLS. It only avoids sharing a
+// single password between all nodes of the cluster.
+type routeDerivedPasswordAuth struct {
+	cluster string
+	allowed map[string]struct{}
+}
+
+// Check verifies that the route presents an allowed public key and a valid
+// derived password.
+// It implements the server.Authentication interface.
+func (a *routeDerivedPasswordAuth) Check(c server.ClientAuthentication) bool {
+	opts := c.GetOpts()
+	if _, ok := a.allowed[opts.Username]; !ok {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(opts.Password)
+	if err != nil {
+		return false
+	}
+	kp, err := nkeys.FromPublicKey(opts.Username)
+	if err != nil {
+		return false
+	}
+	return kp.Verify([]byte(a.cluster), sig) == nil
+}
+
+// routeDerivedCredentials returns the username and derived password
+// sent by this server when connecting to routes.
+func routeDerivedCredentials(seed string, cluster string) (string, string, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid cluster password seed: %s", err.Error())
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		return "", "", fmt.Errorf("invalid cluster password seed: %s", err.Error())
+	}
+	if !nkeys.IsValidPublicServerKey(pk) {
+		return "", "", errors.New("invalid cluster password seed: expected a server seed")
+	}
+	sig, err := kp.Sign([]byte(cluster))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid cluster password seed: %s", err.Error())
+	}
+	return pk, base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseRouteURL parses and validates a route url.
+// Route urls must use the nats-route, nats or tls scheme and provide a port.
+func parseRouteURL(route string) (*url.URL, error) {
+	routeUrl, err := url.Parse(route)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster route url: %s", err.Error())
+	}
+	switch routeUrl.Scheme {
+	case "nats-route", "nats", "tls":
+	default:
+		return nil, fmt.Errorf("invalid cluster route url: unsupported scheme: %s", route)
+	}
+	if routeUrl.Hostname() == "" || routeUrl.Port() == "" {
+		return nil, fmt.Errorf("invalid cluster route url: host and port are required: %s", route)
+	}
+	return routeUrl, nil
+}
+
+// validateClusterName verifies that the cluster name can be
+// exchanged with routes. All routes must use the same name,
+// routes announcing a different name are rejected by the server.
+func validateClusterName(name string) error {
+	if name == "" {
+		return errors.New("cluster.name cannot be empty")
+	}
+	if strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("cluster.name cannot contain spaces: %q", name)
+	}
+	return nil
+}
+
+var _ server.Authentication = (*routeDerivedPasswordAuth)(nil)
@@ -83,6 +83,9 @@ var (
 	STANDARD_TLS_MAP  TLSMapType = 0
 	WEBSOCKET_TLS_MAP TLSMapType = 1
 	LEAFNODE_TLS_MAP  TLSMapType = 2
+	MQTT_TLS_MAP      TLSMapType = 3
+	CLUSTER_TLS_MAP   TLSMapType = 4
+	GATEWAY_TLS_MAP   TLSMapType = 5
 )
 
 func (o *TLSMap) setTLSOpts(tlsMap TLSMapType, opts *server.Options) error {
@@ -150,10 +153,91 @@ func (o *TLSMap) setTLSOpts(tlsMap TLSMapType, opts *server.Options) error {
 		setConfig = func(cfg *tls.Config) {
 			opts.LeafNode.TLSConfig = cfg
 		}
+	case MQTT_TLS_MAP:
+		// Set tls global options (not sure this is useful)
+		opts.MQTT.TLSMap = o.Map
+		if len(o.PinnedCerts) > 0 {
+			certs := map[string]struct{}{}
+			for _, cert := range o.PinnedCerts {
+				certs[cert] = struct{}{}
+			}
+			opts.MQTT.TLSPinnedCerts = certs
+		}
+		opts.MQTT.TLSTimeout = o.Timeout.Seconds()
+		// If TLS is managed, use the provided tls.Config
+		if o.IsManaged() {
+			opts.MQTT.TLSConfig = o.config.Clone()
+			return nil
+		}
+		setConfig = func(cfg *tls.Config) {
+			opts.MQTT.TLSConfig = cfg
+		}
+	case CLUSTER_TLS_MAP:
+		// Set tls global options (not sure this is useful)
+		opts.Cluster.TLSMap = o.Map
+		opts.Cluster.TLSCheckKnownURLs = o.CheckKnownURLs
+		if len(o.PinnedCerts) > 0 {
+			certs := map[string]struct{}{}
+			for _, cert := range o.PinnedCerts {
+				certs[cert] = struct{}{}
+			}
+			opts.Cluster.TLSPinnedCerts = certs
+		}
+		opts.Cluster.TLSTimeout = o.Timeout.Seconds()
+		// If TLS is managed, use the provided tls.Config.
+		// Client authentication is configured by the connection policies
+		// which generated the config.
+		if o.IsManaged() {
+			opts.Cluster.TLSConfig = o.config.Clone()
+			return nil
+		}
+		// Like nats-server, force strict verification for routes. Server acts
+		// as both client and server, so root CAs mirror the client CAs.
+		setConfig = func(cfg *tls.Config) {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			cfg.RootCAs = cfg.ClientCAs
+			opts.Cluster.TLSConfig = cfg
+		}
+	case GATEWAY_TLS_MAP:
+		// Set tls global options (not sure this is useful)
+		opts.Gateway.TLSMap = o.Map
+		opts.Gateway.TLSCheckKnownURLs = o.CheckKnownURLs
+		if len(o.PinnedCerts) > 0 {
+			certs := map[string]struct{}{}
+			for _, cert := range o.PinnedCerts {
+				certs[cert] = struct{}{}
+			}
+			opts.Gateway.TLSPinnedCerts = certs
+		}
+		opts.Gateway.TLSTimeout = o.Timeout.Seconds()
+		// If TLS is managed, use the provided tls.Config.
+		// Client authentication is configured by the connection policies
+		// which generated the config.
+		if o.IsManaged() {
+			opts.Gateway.TLSConfig = o.config.Clone()
+			return nil
+		}
+		// Like nats-server, force strict verification for gateways. Server acts
+		// as both client and server, so root CAs mirror the client CAs.
+		setConfig = func(cfg *tls.Config) {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			cfg.RootCAs = cfg.ClientCAs
+			opts.Gateway.TLSConfig = cfg
+		}
 	default:
 		return fmt.Errorf("invalid TLSMapType: %d", tlsMap)
 	}
+	config, err := o.newConfig()
+	if err != nil {
+		return err
+	}
+	// Set the config
+	setConfig(config)
+	return nil
+}
 
+// newConfig creates a tls.Config from files or certificate store.
+func (o *TLSMap) newConfig() (*tls.Config, error) {
 	// Parse ciphers
 	var ciphers = []uint16{}
 	for _, cipher := range o.Ciphers {
@@ -162,11 +246,11 @@ func (o *TLSMap) setTLSOpts(tlsMap TLSMapType, opts *server.Options) error {
 		}
 		cipherInt, err := strconv.Atoi(cipher)
 		if err != nil {
-			return fmt.Errorf("invalid tls cipher: %s", err.Error())
+			return nil, fmt.Errorf("invalid tls cipher: %s", err.Error())
 		}
 		cipherUInt16, err := ParseCipherFromUInt16(uint16(cipherInt))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		ciphers = append(ciphers, cipherUInt16)
 	}
@@ -182,7 +266,7 @@ func (o *TLSMap) setTLSOpts(tlsMap TLSMapType, opts *server.Options) error {
 		}
 		curveID, ok := curvePreferenceMap[curve]
 		if !ok {
-			return fmt.Errorf("invalid tls curve preference: %s", curve)
+			return nil, fmt.Errorf("invalid tls curve preference: %s", curve)
 		}
 		curves = append(curves, curveID)
 	}
@@ -199,34 +283,34 @@ func (o *TLSMap) setTLSOpts(tlsMap TLSMapType, opts *server.Options) error {
 	}
 	switch {
 	case o.CertFile != "" && o.CertStore != "":
-		return certstore.ErrConflictCertFileAndStore
+		return nil, certstore.ErrConflictCertFileAndStore
 	case o.CertFile != "" && o.KeyFile == "":
-		return fmt.Errorf("missing 'key_file' in TLS configuration")
+		return nil, fmt.Errorf("missing 'key_file' in TLS configuration")
 	case o.CertFile == "" && o.KeyFile != "":
-		return fmt.Errorf("missing 'cert_file' in TLS configuration")
+		return nil, fmt.Errorf("missing 'cert_file' in TLS configuration")
 	case o.CertFile != "" && o.KeyFile != "":
 		// Now load in cert and private key
 		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
 		if err != nil {
-			return fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+			return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
 		}
 		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
 		if err != nil {
-			return fmt.Errorf("error parsing certificate: %v", err)
+			return nil, fmt.Errorf("error parsing certificate: %v", err)
 		}
 		config.Certificates = []tls.Certificate{cert}
 	case o.CertStore != "":
 		store, err := certstore.ParseCertStore(o.CertStore)
 		if err != nil {
-			return fmt.Errorf("invalid tls.cert_store option: %s", err.Error())
+			return nil, fmt.Errorf("invalid tls.cert_store option: %s", err.Error())
 		}
 		matchBy, err := certstore.ParseCertMatchBy(o.CertMatchBy)
 		if err != nil {
-			return fmt.Errorf("invalid tls.cert_match_by option: %s", err.Error())
+			return nil, fmt.Errorf("invalid tls.cert_match_by option: %s", err.Error())
 		}
 		err = certstore.TLSConfig(store, matchBy, o.CertMatch, &config)
 		if err != nil {
-			return fmt.Errorf("error generating tls config using cert_store: %s", err.Error())
+			return nil, fmt.Errorf("error generating tls config using cert_store: %s", err.Error())
 		}
 	}
 	// Require client certificates as needed
@@ -237,18 +321,16 @@ func (o *TLSMap) setTLSOpts(tlsMap TLSMapType, opts *server.Options) error {
 	if o.CaFile != "" {
 		rootPEM, err := os.ReadFile(o.CaFile)
 		if err != nil || rootPEM == nil {
-			return fmt.Errorf("error reading tls root ca certificate: %s", err.Error())
+			return nil, fmt.Errorf("error reading tls root ca certificate: %s", err.Error())
 		}
 		pool := x509.NewCertPool()
 		ok := pool.AppendCertsFromPEM(rootPEM)
 		if !ok {
-			return fmt.Errorf("error parsing tls root ca certificate")
+			return nil, fmt.Errorf("error parsing tls root ca certificate")
 		}
 		config.ClientCAs = pool
 	}
-	// Set the config
-	setConfig(&config)
-	return nil
+	return &config, nil
 }
 
 // ParseCipherFromInt parses a cipher as uint16 from an integer
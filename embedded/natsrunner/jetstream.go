@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsrunner
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/nats-io/nats.go"
+)
+
+// applyJetStreamResources creates or updates the streams, consumers,
+// key value stores and object stores of all accounts.
+// When the live configuration of an existing resource differs from
+// the expected configuration, a warning is logged and the resource is updated.
+func (r *Runner) applyJetStreamResources() error {
+	for _, acc := range r.Options.Accounts {
+		if !acc.HasJetStreamResources() {
+			continue
+		}
+		if err := r.applyAccountJetStreamResources(acc); err != nil {
+			return fmt.Errorf("failed to apply jetstream resources for account %s: %s", acc.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// applyAccountJetStreamResources creates or updates the JetStream resources of a single account.
+// It connects to the server using the account manager nkey, and closes the
+// connection once resources are applied.
+func (r *Runner) applyAccountJetStreamResources(acc *natsoptions.Account) error {
+	kp := acc.ManagerKey()
+	if kp == nil {
+		return errors.New("account manager is not configured")
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(r.server), nats.Nkey(pk, kp.Sign), nats.CustomInboxPrefix(natsoptions.ManagerInboxPrefix))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	for _, stream := range acc.Streams {
+		if err := r.applyStream(js, acc.Name, stream); err != nil {
+			return err
+		}
+	}
+	for _, kv := range acc.KeyValueStores {
+		if err := r.applyKeyValueStore(js, acc.Name, kv); err != nil {
+			return err
+		}
+	}
+	for _, obj := range acc.ObjectStores {
+		if err := r.applyObjectStore(js, acc.Name, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStream creates the stream or updates it when it already exists,
+// then creates or updates its consumers.
+func (r *Runner) applyStream(js nats.JetStreamContext, account string, stream *natsoptions.Stream) error {
+	config := stream.StreamConfig
+	if err := r.updateStream(js, account, &config); err != nil {
+		return err
+	}
+	for _, consumer := range stream.Consumers {
+		if err := r.applyConsumer(js, account, stream.Name, consumer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateStream creates the stream or updates it when it already exists.
+// Live configuration is compared with the configuration returned by the
+// server after update, so that server defaults are not reported as drift.
+func (r *Runner) updateStream(js nats.JetStreamContext, account string, config *nats.StreamConfig) error {
+	info, err := js.StreamInfo(config.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		if _, err := js.AddStream(config); err != nil {
+			return fmt.Errorf("failed to create stream %s: %s", config.Name, err.Error())
+		}
+		r.server.Noticef("created stream %s in account %s", config.Name, account)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get stream %s: %s", config.Name, err.Error())
+	}
+	updated, err := js.UpdateStream(config)
+	if err != nil {
+		return fmt.Errorf("failed to update stream %s: %s", config.Name, err.Error())
+	}
+	if !reflect.DeepEqual(info.Config, updated.Config) {
+		r.server.Warnf("configuration drift detected for stream %s in account %s, stream was updated", config.Name, account)
+	}
+	return nil
+}
+
+// applyConsumer creates the durable consumer or updates it when it already exists.
+func (r *Runner) applyConsumer(js nats.JetStreamContext, account string, stream string, config *nats.ConsumerConfig) error {
+	name := config.Durable
+	if name == "" {
+		name = config.Name
+	}
+	info, err := js.ConsumerInfo(stream, name)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		if _, err := js.AddConsumer(stream, config); err != nil {
+			return fmt.Errorf("failed to create consumer %s of stream %s: %s", name, stream, err.Error())
+		}
+		r.server.Noticef("created consumer %s of stream %s in account %s", name, stream, account)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get consumer %s of stream %s: %s", name, stream, err.Error())
+	}
+	updated, err := js.UpdateConsumer(stream, config)
+	if err != nil {
+		return fmt.Errorf("failed to update consumer %s of stream %s: %s", name, stream, err.Error())
+	}
+	if !reflect.DeepEqual(info.Config, updated.Config) {
+		r.server.Warnf("configuration drift detected for consumer %s of stream %s in account %s, consumer was updated", name, stream, account)
+	}
+	return nil
+}
+
+// applyKeyValueStore creates the key value store or updates its underlying
+// stream when it already exists. Storage type cannot be updated.
+func (r *Runner) applyKeyValueStore(js nats.JetStreamContext, account string, kv *natsoptions.KeyValueStore) error {
+	info, err := js.StreamInfo("KV_" + kv.Bucket)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err := js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:       kv.Bucket,
+			Description:  kv.Description,
+			MaxValueSize: kv.MaxValueSize,
+			History:      kv.History,
+			TTL:          kv.TTL,
+			MaxBytes:     kv.MaxBytes,
+			Storage:      kv.Storage,
+			Replicas:     kv.Replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create key value store %s: %s", kv.Bucket, err.Error())
+		}
+		r.server.Noticef("created key value store %s in account %s", kv.Bucket, account)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get key value store %s: %s", kv.Bucket, err.Error())
+	}
+	if info.Config.Storage != kv.Storage {
+		return fmt.Errorf("storage of key value store %s cannot be updated", kv.Bucket)
+	}
+	config := info.Config
+	config.Description = kv.Description
+	config.MaxMsgSize = -1
+	if kv.MaxValueSize != 0 {
+		config.MaxMsgSize = kv.MaxValueSize
+	}
+	config.MaxMsgsPerSubject = 1
+	if kv.History != 0 {
+		config.MaxMsgsPerSubject = int64(kv.History)
+	}
+	config.MaxAge = kv.TTL
+	config.MaxBytes = -1
+	if kv.MaxBytes != 0 {
+		config.MaxBytes = kv.MaxBytes
+	}
+	config.Replicas = 1
+	if kv.Replicas != 0 {
+		config.Replicas = kv.Replicas
+	}
+	return r.updateBucketStream(js, account, "key value store", kv.Bucket, info.Config, config)
+}
+
+// applyObjectStore creates the object store or updates its underlying
+// stream when it already exists. Storage type cannot be updated.
+func (r *Runner) applyObjectStore(js nats.JetStreamContext, account string, obj *natsoptions.ObjectStore) error {
+	info, err := js.StreamInfo("OBJ_" + obj.Bucket)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err := js.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:      obj.Bucket,
+			Description: obj.Description,
+			TTL:         obj.TTL,
+			MaxBytes:    obj.MaxBytes,
+			Storage:     obj.Storage,
+			Replicas:    obj.Replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create object store %s: %s", obj.Bucket, err.Error())
+		}
+		r.server.Noticef("created object store %s in account %s", obj.Bucket, account)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get object store %s: %s", obj.Bucket, err.Error())
+	}
+	if info.Config.Storage != obj.Storage {
+		return fmt.Errorf("storage of object store %s cannot be updated", obj.Bucket)
+	}
+	config := info.Config
+	config.Description = obj.Description
+	config.MaxAge = obj.TTL
+	config.MaxBytes = -1
+	if obj.MaxBytes != 0 {
+		config.MaxBytes = obj.MaxBytes
+	}
+	config.Replicas = 1
+	if obj.Replicas != 0 {
+		config.Replicas = obj.Replicas
+	}
+	return r.updateBucketStream(js, account, "object store", obj.Bucket, info.Config, config)
+}
+
+// updateBucketStream updates the stream backing a key value or object store
+// when its live configuration differs from the expected configuration.
+func (r *Runner) updateBucketStream(js nats.JetStreamContext, account string, kind string, bucket string, live nats.StreamConfig, expected nats.StreamConfig) error {
+	if reflect.DeepEqual(live, expected) {
+		return nil
+	}
+	r.server.Warnf("configuration drift detected for %s %s in account %s, updating", kind, bucket, account)
+	if _, err := js.UpdateStream(&expected); err != nil {
+		return fmt.Errorf("failed to update %s %s: %s", kind, bucket, err.Error())
+	}
+	return nil
+}
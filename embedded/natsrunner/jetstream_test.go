@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsrunner_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/charbonnierg/caddy-nats/embedded/natsrunner"
+	"github.com/nats-io/nats.go"
+)
+
+func TestJetStreamResources(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"port": -1,
+		"disable_logging": true,
+		"jetstream": {},
+		"accounts": [
+			{
+				"name": "A",
+				"jetstream": true,
+				"users": [{"user": "a", "password": "a"}],
+				"streams": [
+					{
+						"name": "EVENTS",
+						"subjects": ["events.>"],
+						"storage": "memory",
+						"consumers": [{"durable_name": "worker", "ack_policy": "explicit"}]
+					}
+				],
+				"key_value_stores": [{"bucket": "config", "history": 5, "storage": "memory"}],
+				"object_stores": [{"bucket": "files", "storage": "memory"}]
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.JetStream.StoreDir = t.TempDir()
+	runner, err := natsrunner.New().WithOptions(opts).WithReadyTimeout(5 * time.Second).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { runner.Stop() })
+	nc, err := nats.Connect(runner.Server().ClientURL(), nats.UserInfo("a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.ConsumerInfo("EVENTS", "worker"); err != nil {
+		t.Fatalf("expected consumer to be created: %s", err.Error())
+	}
+	kv, err := js.KeyValue("config")
+	if err != nil {
+		t.Fatalf("expected key value store to be created: %s", err.Error())
+	}
+	status, err := kv.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.History() != 5 {
+		t.Fatalf("unexpected key value store history: %d", status.History())
+	}
+	if _, err := js.ObjectStore("files"); err != nil {
+		t.Fatalf("expected object store to be created: %s", err.Error())
+	}
+	// Update configuration and reload
+	opts.Accounts[0].Streams[0].MaxMsgs = 10
+	opts.Accounts[0].Streams[0].Consumers[0].MaxAckPending = 5
+	opts.Accounts[0].KeyValueStores[0].History = 10
+	if err := runner.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.StreamInfo("EVENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Config.MaxMsgs != 10 {
+		t.Fatalf("expected stream to be updated, got max msgs %d", info.Config.MaxMsgs)
+	}
+	consumer, err := js.ConsumerInfo("EVENTS", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumer.Config.MaxAckPending != 5 {
+		t.Fatalf("expected consumer to be updated, got max ack pending %d", consumer.Config.MaxAckPending)
+	}
+	status, err = kv.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.History() != 10 {
+		t.Fatalf("expected key value store to be updated, got history %d", status.History())
+	}
+}
+
+func TestJetStreamLimitsReload(t *testing.T) {
+	opts, err := natsoptions.NewFromJSON([]byte(`{
+		"port": -1,
+		"disable_logging": true,
+		"jetstream": {},
+		"accounts": [
+			{
+				"name": "A",
+				"jetstream": true,
+				"users": [{"user": "a", "password": "a"}],
+				"limits": {"jetstream": {"max_streams": 1, "max_ack_pending": 10}}
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.JetStream.StoreDir = t.TempDir()
+	runner, err := natsrunner.New().WithOptions(opts).WithReadyTimeout(5 * time.Second).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { runner.Stop() })
+	nc, err := nats.Connect(runner.Server().ClientURL(), nats.UserInfo("a", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.AccountInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Limits.MaxStreams != 1 || info.Limits.MaxAckPending != 10 {
+		t.Fatalf("unexpected account limits: %+v", info.Limits)
+	}
+	// Update limits and reload
+	opts.Accounts[0].Limits.JetStream.MaxStreams = 5
+	if err := runner.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	info, err = js.AccountInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Limits.MaxStreams != 5 {
+		t.Fatalf("expected limits to be re-applied on reload, got %+v", info.Limits)
+	}
+}
@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsrunner
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// routeCheckTimeout is the timeout used to read the INFO announced by a route.
+const routeCheckTimeout = 2 * time.Second
+
+// routeInfo holds the fields of the INFO protocol message announced by routes
+// which are used to check the cluster name.
+type routeInfo struct {
+	Cluster string `json:"cluster,omitempty"`
+	Dynamic bool   `json:"cluster_dynamic,omitempty"`
+}
+
+// checkRouteClusterNames verifies, before the server starts, that routes which
+// can already be reached announce the cluster name of this server. nats-server
+// only rejects a route announcing another cluster name once connected, and keeps
+// retrying it. Routes which cannot be reached (nodes which are not started yet,
+// or this node itself) and routes using a dynamic cluster name are skipped.
+func (r *Runner) checkRouteClusterNames() error {
+	cluster := r.Options.Cluster
+	if cluster == nil {
+		return nil
+	}
+	for _, route := range cluster.Routes {
+		routeUrl, err := url.Parse(route)
+		if err != nil {
+			return fmt.Errorf("invalid cluster route url: %s", err.Error())
+		}
+		info, err := readRouteInfo(routeUrl.Host, routeCheckTimeout)
+		if err != nil || info.Dynamic || info.Cluster == "" {
+			continue
+		}
+		if info.Cluster != cluster.Name {
+			return fmt.Errorf("route %s announces cluster name %q, expected %q", routeUrl.Host, info.Cluster, cluster.Name)
+		}
+	}
+	return nil
+}
+
+// readRouteInfo connects to a route and reads the INFO protocol message it announces.
+// Routes announce INFO before any TLS handshake, so no credentials are sent.
+func readRouteInfo(address string, timeout time.Duration) (*routeInfo, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	if !ok {
+		return nil, errors.New("route did not announce INFO")
+	}
+	info := &routeInfo{}
+	if err := json.Unmarshal([]byte(payload), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package natsrunner_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/charbonnierg/caddy-nats/embedded/natsrunner"
+)
+
+func newClusterRunner(t *testing.T, name string, port int, routes ...string) *natsrunner.Runner {
+	t.Helper()
+	opts, err := natsoptions.NewFromJSON([]byte(fmt.Sprintf(`{
+		"port": -1,
+		"disable_logging": true,
+		"cluster": {"name": %q, "host": "127.0.0.1", "port": %d, "routes": [%s]}
+	}`, name, port, strings.Join(routes, ","))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner, err := natsrunner.New().WithOptions(opts).WithReadyTimeout(5 * time.Second).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner
+}
+
+func TestRouteClusterNames(t *testing.T) {
+	ports := []int{freePort(t), freePort(t), freePort(t)}
+	route := fmt.Sprintf(`"nats-route://127.0.0.1:%d"`, ports[0])
+	// First node routes to itself, which is not reachable before start
+	first := newClusterRunner(t, "C", ports[0], route)
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Stop() })
+	second := newClusterRunner(t, "C", ports[1], route)
+	if err := second.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { second.Stop() })
+	other := newClusterRunner(t, "OTHER", ports[2], route)
+	err := other.Start()
+	if err == nil {
+		other.Stop()
+		t.Fatal("expected route announcing another cluster name to be rejected")
+	}
+	if !strings.Contains(err.Error(), `announces cluster name "C"`) {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -118,23 +118,18 @@ func (r *Runner) Running() bool {
 
 // Start will start the NATS server and wait for it to be ready for connections.
 // If the server is not ready for connections before the deadline, an error is
-// returned.
+// returned. An error is also returned when a reachable route announces another
+// cluster name.
 func (r *Runner) Start() error {
+	// Make sure reachable routes use the same cluster name
+	if err := r.checkRouteClusterNames(); err != nil {
+		return err
+	}
 	// Start the server
 	r.server.Start()
 	// Lookup and enable jetstream for accounts
-	for _, acc := range r.Options.Accounts {
-		if acc.JetStream {
-			account, err := r.server.LookupAccount(acc.Name)
-			if err != nil {
-				return fmt.Errorf("account was not initialized: %s", err.Error())
-			}
-			// Enable jetstream
-			err = account.EnableJetStream(nil)
-			if err != nil {
-				return fmt.Errorf("failed to enabled jetstream for account: %s", err.Error())
-			}
-		}
+	if err := r.enableJetStream(); err != nil {
+		return err
 	}
 	// Wait for server to be ready for connections
 	if r.ReadyDeadline != 0 {
@@ -144,6 +139,11 @@ func (r *Runner) Start() error {
 		}
 		r.server.Noticef("server is waiting for connections")
 	}
+	// Create or update jetstream resources
+	if err := r.applyJetStreamResources(); err != nil {
+		r.server.Shutdown()
+		return err
+	}
 	// Kick-off a goroutine to track when we're done with this server
 	r.done = make(chan bool, 1)
 	go func() {
@@ -183,11 +183,49 @@ func (r *Runner) Reload() error {
 		return err
 	}
 	// Only reload the server if it is running
-	if r.server.Running() {
-		r.server.ReloadOptions(opts)
-	} else {
+	if !r.server.Running() {
 		return errors.New("server is not running")
 	}
+	if err := r.server.ReloadOptions(opts); err != nil {
+		return err
+	}
+	// Accounts are replaced on reload, so jetstream must be enabled again
+	// and account jetstream limits must be re-applied
+	if err := r.enableJetStream(); err != nil {
+		return err
+	}
+	// Create or update jetstream resources
+	return r.applyJetStreamResources()
+}
+
+// enableJetStream looks up accounts with jetstream enabled in options and enables
+// jetstream with account limits (if any). When jetstream is already enabled,
+// account limits are updated instead, so that limits are re-applied on reload.
+func (r *Runner) enableJetStream() error {
+	for _, acc := range r.Options.Accounts {
+		if !acc.JetStream {
+			continue
+		}
+		account, err := r.server.LookupAccount(acc.Name)
+		if err != nil {
+			return fmt.Errorf("account was not initialized: %s", err.Error())
+		}
+		limits, err := acc.GetJetStreamLimits()
+		if err != nil {
+			return err
+		}
+		if account.JetStreamEnabled() {
+			if err := account.UpdateJetStreamLimits(limits); err != nil {
+				return fmt.Errorf("failed to update jetstream limits for account: %s", err.Error())
+			}
+			continue
+		}
+		// Enable jetstream with account limits (if any)
+		err = account.EnableJetStream(limits)
+		if err != nil {
+			return fmt.Errorf("failed to enabled jetstream for account: %s", err.Error())
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that serves NATS endpoints on the caddy admin API:
+//
+//   - POST /nats/auth_cache/purge removes all decisions from the auth callout decision cache.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+// It implements the caddy.Module interface.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.nats",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes of the nats app.
+// It implements the caddy.AdminRouter interface.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/nats/auth_cache/purge",
+			Handler: caddy.AdminHandlerFunc(a.handlePurgeCache),
+		},
+	}
+}
+
+// handlePurgeCache purges the decision cache of the auth service of the running nats app.
+func (a *adminAPI) handlePurgeCache(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+	// The app is looked up on each request, because the admin API
+	// is not reloaded with every config
+	app, ok := caddy.ActiveContext().AppIfConfigured("nats").(*App)
+	if !ok || app.AuthService == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        errors.New("nats auth service is not configured"),
+		}
+	}
+	purged := app.AuthService.PurgeCache()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 )
 
@@ -18,6 +19,12 @@ func (a *App) Context() caddy.Context {
 	return a.ctx
 }
 
+// Server returns the running NATS server.
+// It returns nil when the server is not started yet.
+func (a *App) Server() *server.Server {
+	return a.runner.Server()
+}
+
 // CreateClient will create a NATS client connected to the NATS server.
 func (a *App) CreateClient(options ...nats.Option) (*nats.Conn, error) {
 	srv := a.runner.Server()
@@ -3,8 +3,13 @@
 package modules
 
 import (
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
@@ -12,6 +17,7 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
 	"github.com/caddyserver/caddy/v2/modules/caddytls"
 	"go.uber.org/zap"
 )
@@ -31,6 +37,8 @@ type App struct {
 	runner             *natsrunner.Runner
 	connectionPolicies []caddytls.ConnectionPolicies
 	subjects           []string
+	sessions           *sessionTracker
+	sessionSources     []SessionSource
 	AuthService        *AuthService         `json:"auth_service,omitempty"`
 	Options            *natsoptions.Options `json:"server,omitempty"`
 	ReadyTimeout       time.Duration        `json:"ready_timeout,omitempty"`
@@ -69,6 +77,11 @@ func (a *App) Provision(ctx caddy.Context) error {
 		return errors.New("tls app invalid type")
 	}
 	a.tlsApp = tlsApp
+	// Track connections authorized from sessions, using the tracker shared across config reloads
+	a.sessions, err = loadSessionTracker()
+	if err != nil {
+		return err
+	}
 	// Provision auth service
 	if a.AuthService != nil {
 		if err := a.AuthService.Provision(a); err != nil {
@@ -81,6 +94,10 @@ func (a *App) Provision(ctx caddy.Context) error {
 	if err := a.setTLSConfigOverride(); err != nil {
 		return err
 	}
+	// Rotate listeners certificates when caddy obtains or renews certificates
+	if err := a.subscribeCertificateEvents(); err != nil {
+		return err
+	}
 	// Create runner
 	a.runner, err = natsrunner.New().
 		WithOptions(a.Options).
@@ -113,7 +130,8 @@ func (a *App) Start() error {
 			return err
 		}
 	}
-	return nil
+	// Disconnect clients when their session is deleted
+	return a.startSessionWatchers()
 }
 
 // Stop stops the app. It implements the caddy.App interface.
@@ -125,10 +143,22 @@ func (a *App) Stop() error {
 			a.logger.Error("Failed to stop auth service", zap.Error(err))
 		}
 	}
+	// Forget connections of the server authorized from sessions
+	if srv := a.runner.Server(); srv != nil {
+		a.sessions.forgetServer(srv.ID())
+	}
 	// Stop nats runner
 	return a.runner.Stop()
 }
 
+// Cleanup releases the session tracker. It implements the caddy.CleanerUpper interface.
+func (a *App) Cleanup() error {
+	if a.sessions != nil {
+		releaseSessionTracker()
+	}
+	return nil
+}
+
 func (a *App) setStandardTLSConnectionPolicies() caddytls.ConnectionPolicies {
 	if a.Options.TLS == nil || a.Options.TLS.Subjects == nil {
 		return nil
@@ -177,14 +207,124 @@ func (a *App) setLeafnodeTLSConnectionPolicies() caddytls.ConnectionPolicies {
 	return policies
 }
 
-func (a *App) setTLSConfigOverride() error {
-	if a.Options.TLS == nil {
+func (a *App) setMQTTTLSConnectionPolicies() caddytls.ConnectionPolicies {
+	if a.Options.MQTT == nil || a.Options.MQTT.TLS == nil || a.Options.MQTT.TLS.Subjects == nil {
 		return nil
 	}
-	// Set standard TLS connection policies
+	subjects := a.Options.MQTT.TLS.Subjects
+	matcher := caddyconfig.JSON(subjects, nil)
+	policy := caddytls.ConnectionPolicy{
+		MatchersRaw: map[string]json.RawMessage{
+			"sni": matcher,
+		},
+	}
+	policies := caddytls.ConnectionPolicies{&policy}
+	a.connectionPolicies = append(a.connectionPolicies, policies)
+	return policies
+}
+
+func (a *App) setClusterTLSConnectionPolicies() (caddytls.ConnectionPolicies, *x509.CertPool, error) {
+	if a.Options.Cluster == nil || a.Options.Cluster.TLS == nil || a.Options.Cluster.TLS.Subjects == nil {
+		return nil, nil, nil
+	}
+	return a.setPeerTLSConnectionPolicies("cluster", a.Options.Cluster.TLS)
+}
+
+func (a *App) setGatewayTLSConnectionPolicies() (caddytls.ConnectionPolicies, *x509.CertPool, error) {
+	if a.Options.Gateway == nil || a.Options.Gateway.TLS == nil || a.Options.Gateway.TLS.Subjects == nil {
+		return nil, nil, nil
+	}
+	return a.setPeerTLSConnectionPolicies("gateway", a.Options.Gateway.TLS)
+}
+
+// setPeerTLSConnectionPolicies sets the connection policies for routes or gateways.
+// When a client CA is configured, peers use mutual TLS: they must present
+// a certificate signed by the CA, and the returned pool is used to verify
+// the certificates of the peers this server connects to.
+func (a *App) setPeerTLSConnectionPolicies(listener string, tlsMap *natsoptions.TLSMap) (caddytls.ConnectionPolicies, *x509.CertPool, error) {
+	matcher := caddyconfig.JSON(tlsMap.Subjects, nil)
+	policy := caddytls.ConnectionPolicy{
+		MatchersRaw: map[string]json.RawMessage{
+			"sni": matcher,
+		},
+	}
+	certs, err := a.clientCACertificates(listener, tlsMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pool *x509.CertPool
+	if len(certs) > 0 {
+		pool = x509.NewCertPool()
+		policy.ClientAuthentication = &caddytls.ClientAuthentication{Mode: "require_and_verify"}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+			policy.ClientAuthentication.TrustedCACerts = append(policy.ClientAuthentication.TrustedCACerts, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+	}
+	policies := caddytls.ConnectionPolicies{&policy}
+	a.connectionPolicies = append(a.connectionPolicies, policies)
+	return policies, pool, nil
+}
+
+// clientCACertificates returns the CA certificates used to verify peers
+// when certificates are managed by caddy. Certificates are either the root
+// certificate of a caddy PKI certificate authority, or loaded from the CA file.
+func (a *App) clientCACertificates(listener string, tlsMap *natsoptions.TLSMap) ([]*x509.Certificate, error) {
+	switch {
+	case tlsMap.ClientCA != "" && tlsMap.CaFile != "":
+		return nil, fmt.Errorf("%s tls client_ca and ca_file cannot be set at the same time", listener)
+	case tlsMap.ClientCA != "":
+		unm, err := a.ctx.App("pki")
+		if err != nil {
+			return nil, errors.New("failed to get pki app")
+		}
+		pki, ok := unm.(*caddypki.PKI)
+		if !ok {
+			return nil, errors.New("pki app invalid type")
+		}
+		ca, err := pki.GetCA(a.ctx, tlsMap.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{ca.RootCertificate()}, nil
+	case tlsMap.CaFile != "":
+		rootPEM, err := os.ReadFile(tlsMap.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s tls ca file: %s", listener, err.Error())
+		}
+		certs := []*x509.Certificate{}
+		for block, rest := pem.Decode(rootPEM); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s tls ca file: %s", listener, err.Error())
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no certificate found in %s tls ca file", listener)
+		}
+		return certs, nil
+	}
+	return nil, nil
+}
+
+func (a *App) setTLSConfigOverride() error {
+	// Set TLS connection policies
 	standardPolicies := a.setStandardTLSConnectionPolicies()
 	wsPolicies := a.setWebsocketTLSConnectionPolicies()
 	leafPolicies := a.setLeafnodeTLSConnectionPolicies()
+	mqttPolicies := a.setMQTTTLSConnectionPolicies()
+	clusterPolicies, clusterPool, err := a.setClusterTLSConnectionPolicies()
+	if err != nil {
+		return err
+	}
+	gatewayPolicies, gatewayPool, err := a.setGatewayTLSConnectionPolicies()
+	if err != nil {
+		return err
+	}
 	// Gather all subjects
 	subjects, err := a.findAllSubjects()
 	if err != nil {
@@ -211,6 +351,28 @@ func (a *App) setTLSConfigOverride() error {
 		a.logger.Debug("Setting Leafnode TLS config override", zap.Any("policies", leafPolicies))
 		a.Options.Leafnode.TLS.SetConfigOverride(leafPolicies.TLSConfig(a.ctx))
 	}
+	if mqttPolicies != nil {
+		a.logger.Debug("Setting MQTT TLS config override", zap.Any("policies", mqttPolicies))
+		a.Options.MQTT.TLS.SetConfigOverride(mqttPolicies.TLSConfig(a.ctx))
+	}
+	if clusterPolicies != nil {
+		a.logger.Debug("Setting Cluster TLS config override", zap.Any("policies", clusterPolicies))
+		tlsConfig := clusterPolicies.TLSConfig(a.ctx)
+		// Verify peer certificates when connecting to routes
+		if clusterPool != nil {
+			tlsConfig.RootCAs = clusterPool
+		}
+		a.Options.Cluster.TLS.SetConfigOverride(tlsConfig)
+	}
+	if gatewayPolicies != nil {
+		a.logger.Debug("Setting Gateway TLS config override", zap.Any("policies", gatewayPolicies))
+		tlsConfig := gatewayPolicies.TLSConfig(a.ctx)
+		// Verify peer certificates when connecting to remote gateways
+		if gatewayPool != nil {
+			tlsConfig.RootCAs = gatewayPool
+		}
+		a.Options.Gateway.TLS.SetConfigOverride(tlsConfig)
+	}
 	return nil
 }
 
@@ -248,6 +410,7 @@ func (a *App) findAllSubjects() ([]string, error) {
 }
 
 var (
-	_ caddy.App         = (*App)(nil)
-	_ caddy.Provisioner = (*App)(nil)
+	_ caddy.App          = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
 )
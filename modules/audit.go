@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_AUDIT_SUBJECT = "nats.auth.audit"
+	DEFAULT_AUDIT_STREAM  = "AUTH_AUDIT"
+	// AUDIT_INVALID_ACCOUNT is the subject token used instead of account names
+	// which are not a single subject token.
+	AUDIT_INVALID_ACCOUNT = "_invalid"
+)
+
+// Audit is the configuration of the auth callout audit trail.
+// An audit event is published for each authorization decision, on the subject
+// "<subject>.allowed.<account>" when the user is authorized, or "<subject>.denied".
+// Account names which are not a single subject token (e.g. containing dots or wildcards)
+// are replaced by AUDIT_INVALID_ACCOUNT in the subject, and kept in the event.
+// Events are published by the auth service in the auth account.
+type Audit struct {
+	Subject string       `json:"subject,omitempty"`
+	Stream  *AuditStream `json:"stream,omitempty"`
+}
+
+// AuditStream is the configuration of the JetStream stream storing audit events.
+// The stream is created, or updated, when the auth service starts. It requires
+// JetStream to be enabled in the auth account, which is done automatically for
+// the internal auth account.
+type AuditStream struct {
+	Name     string           `json:"name,omitempty"`
+	MaxAge   time.Duration    `json:"max_age,omitempty"`
+	MaxBytes int64            `json:"max_bytes,omitempty"`
+	MaxMsgs  int64            `json:"max_msgs,omitempty"`
+	Storage  nats.StorageType `json:"storage,omitempty"`
+	Replicas int              `json:"replicas,omitempty"`
+}
+
+// AuditEvent is the audit event published for an authorization decision.
+// Secrets found in connect options (password, token, JWT and signed nonce) are never included.
+type AuditEvent struct {
+	Time           time.Time             `json:"time"`
+	Decision       string                `json:"decision"`
+	Server         jwt.ServerID          `json:"server"`
+	ClientInfo     jwt.ClientInformation `json:"client_info"`
+	ConnectOptions AuditConnectOptions   `json:"connect_opts"`
+	TLS            *jwt.ClientTLS        `json:"client_tls,omitempty"`
+	Policy         int                   `json:"policy"`
+	Handler        string                `json:"handler,omitempty"`
+	Cached         bool                  `json:"cached,omitempty"`
+	Account        string                `json:"account,omitempty"`
+	Name           string                `json:"name,omitempty"`
+	Permissions    *jwt.Permissions      `json:"permissions,omitempty"`
+	Expires        int64                 `json:"expires,omitempty"`
+	Error          string                `json:"error,omitempty"`
+	Latency        time.Duration         `json:"latency"`
+}
+
+// AuditConnectOptions are the connect options of the client, without secrets.
+type AuditConnectOptions struct {
+	Username string `json:"user,omitempty"`
+	Nkey     string `json:"nkey,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Lang     string `json:"lang,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Protocol int    `json:"protocol"`
+}
+
+// provision validates the audit configuration.
+func (a *Audit) provision() error {
+	if a.Subject == "" {
+		a.Subject = DEFAULT_AUDIT_SUBJECT
+	}
+	if a.Stream != nil {
+		if a.Stream.Name == "" {
+			a.Stream.Name = DEFAULT_AUDIT_STREAM
+		}
+		if a.Stream.MaxAge < 0 || a.Stream.Replicas < 0 {
+			return errors.New("audit stream max_age and replicas must not be negative")
+		}
+	}
+	return nil
+}
+
+// setupStream creates or updates the audit stream, if any.
+func (a *Audit) setupStream(conn *nats.Conn) error {
+	if a.Stream == nil {
+		return nil
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return err
+	}
+	config := &nats.StreamConfig{
+		Name:        a.Stream.Name,
+		Description: "auth callout audit trail",
+		Subjects:    []string{a.Subject + ".>"},
+		Retention:   nats.LimitsPolicy,
+		MaxAge:      a.Stream.MaxAge,
+		MaxBytes:    a.Stream.MaxBytes,
+		MaxMsgs:     a.Stream.MaxMsgs,
+		Storage:     a.Stream.Storage,
+		Replicas:    a.Stream.Replicas,
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = -1
+	}
+	if config.MaxMsgs == 0 {
+		config.MaxMsgs = -1
+	}
+	if _, err := js.StreamInfo(config.Name); err != nil {
+		if !errors.Is(err, nats.ErrStreamNotFound) {
+			return fmt.Errorf("failed to get audit stream: %s", err.Error())
+		}
+		if _, err := js.AddStream(config); err != nil {
+			return fmt.Errorf("failed to create audit stream: %s", err.Error())
+		}
+		return nil
+	}
+	if _, err := js.UpdateStream(config); err != nil {
+		return fmt.Errorf("failed to update audit stream: %s", err.Error())
+	}
+	return nil
+}
+
+// newAuditEvent creates the audit event of a decision.
+func newAuditEvent(request *jwt.AuthorizationRequestClaims, d decision, cached bool, latency time.Duration) *AuditEvent {
+	opts := request.ConnectOptions
+	event := &AuditEvent{
+		Time:       time.Now().UTC(),
+		Server:     request.Server,
+		ClientInfo: request.ClientInformation,
+		ConnectOptions: AuditConnectOptions{
+			Username: opts.Username,
+			Nkey:     opts.Nkey,
+			Name:     opts.Name,
+			Lang:     opts.Lang,
+			Version:  opts.Version,
+			Protocol: opts.Protocol,
+		},
+		TLS:     request.TLS,
+		Policy:  d.policy,
+		Handler: d.handler,
+		Cached:  cached,
+		Latency: latency,
+	}
+	// The nonce is not part of the audit trail
+	event.ClientInfo.Nonce = ""
+	if d.err != nil {
+		event.Decision = "denied"
+		event.Error = d.err.Error()
+		return event
+	}
+	event.Decision = "allowed"
+	event.Account = d.claims.Audience
+	event.Name = d.claims.Name
+	event.Permissions = &d.claims.Permissions
+	event.Expires = d.claims.Expires
+	return event
+}
+
+// subject returns the subject on which an audit event is published.
+func (a *Audit) subject(event *AuditEvent) string {
+	if event.Decision == "allowed" {
+		if !isSubjectToken(event.Account) {
+			return a.Subject + ".allowed." + AUDIT_INVALID_ACCOUNT
+		}
+		return a.Subject + ".allowed." + event.Account
+	}
+	return a.Subject + ".denied"
+}
+
+// isSubjectToken returns true when value can be used as a single subject token.
+func isSubjectToken(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r == '.' || r == '*' || r == '>' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// publish publishes an audit event. Errors are logged, and never change the decision.
+func (a *Audit) publish(conn *nats.Conn, logger *zap.Logger, event *AuditEvent) {
+	if conn == nil {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("failed to encode audit event", zap.Error(err))
+		return
+	}
+	if err := conn.Publish(a.subject(event), payload); err != nil {
+		logger.Error("failed to publish audit event", zap.Error(err))
+	}
+}
+
+// handlerModuleID returns the module ID of a handler, or an empty string.
+func handlerModuleID(handler AuthCallout) string {
+	if module, ok := handler.(caddy.Module); ok {
+		return string(module.CaddyModule().ID)
+	}
+	return ""
+}
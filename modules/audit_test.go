@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNewAuditEvent(t *testing.T) {
+	audit := &Audit{}
+	if err := audit.provision(); err != nil {
+		t.Fatal(err)
+	}
+	request := newCacheTestRequest("UALICE", "alice")
+	request.ConnectOptions.Token = "token"
+	request.ClientInformation.Nonce = "nonce"
+	claims := jwt.NewUserClaims("UALICE")
+	claims.Audience = "APP"
+	claims.Pub.Allow.Add("foo")
+	event := newAuditEvent(request, decision{claims: claims, policy: 1, handler: "nats.auth_callout.allow"}, true, time.Millisecond)
+	if event.Decision != "allowed" || event.Account != "APP" || event.Policy != 1 || event.Handler != "nats.auth_callout.allow" || !event.Cached {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if audit.subject(event) != "nats.auth.audit.allowed.APP" {
+		t.Fatalf("unexpected subject: %s", audit.subject(event))
+	}
+	// Accounts are never used as several subject tokens
+	for _, account := range []string{"", "APP.admin", "*", ">", "APP admin", "APP\n"} {
+		invalid := &AuditEvent{Decision: "allowed", Account: account}
+		if audit.subject(invalid) != "nats.auth.audit.allowed._invalid" {
+			t.Errorf("unexpected subject for account %q: %s", account, audit.subject(invalid))
+		}
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "token", "nonce"} {
+		if strings.Contains(string(payload), secret) {
+			t.Fatalf("audit event contains %s: %s", secret, string(payload))
+		}
+	}
+	denied := newAuditEvent(request, decision{policy: -1, err: errors.New("no matching policy")}, false, time.Millisecond)
+	if denied.Decision != "denied" || denied.Error != "no matching policy" || denied.Permissions != nil {
+		t.Fatalf("unexpected event: %+v", denied)
+	}
+	if audit.subject(denied) != "nats.auth.audit.denied" {
+		t.Fatalf("unexpected subject: %s", audit.subject(denied))
+	}
+}
+
+func TestAuditStream(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{
+		DontListen: true,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		NoLog:      true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server not ready for connections")
+	}
+	conn, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	audit := &Audit{Stream: &AuditStream{MaxAge: time.Hour, Storage: nats.MemoryStorage}}
+	if err := audit.provision(); err != nil {
+		t.Fatal(err)
+	}
+	// Stream is updated when it already exists
+	for i := 0; i < 2; i++ {
+		if err := audit.setupStream(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := &AuthService{conn: conn, Audit: audit, defaultHandler: &sessionAuthCallout{}}
+	if _, err := service.Handle(newCacheTestRequest("UALICE", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.StreamInfo(DEFAULT_AUDIT_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Config.MaxAge != time.Hour || info.Config.Subjects[0] != "nats.auth.audit.>" {
+		t.Fatalf("unexpected stream config: %+v", info.Config)
+	}
+	msg, err := js.GetLastMsg(DEFAULT_AUDIT_STREAM, "nats.auth.audit.allowed.APP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &AuditEvent{}
+	if err := json.Unmarshal(msg.Data, event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Decision != "allowed" || event.Policy != -1 || event.ConnectOptions.Username != "alice" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
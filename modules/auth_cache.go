@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/jwt/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DEFAULT_CACHE_TTL          = time.Minute
+	DEFAULT_CACHE_NEGATIVE_TTL = 5 * time.Second
+	DEFAULT_CACHE_MAX_ENTRIES  = 10000
+)
+
+var (
+	cacheMetricsOnce sync.Once
+	cacheHits        = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "nats_auth_cache",
+		Name:      "hits_total",
+		Help:      "Number of auth callout requests answered from the decision cache.",
+	}, []string{"decision"})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "nats_auth_cache",
+		Name:      "misses_total",
+		Help:      "Number of auth callout requests not found in the decision cache.",
+	})
+)
+
+// registerCacheMetrics registers decision cache metrics in the default prometheus registry.
+// Metrics are registered once, and are shared by caches of successive configs.
+func registerCacheMetrics() {
+	cacheMetricsOnce.Do(func() {
+		for _, collector := range []prometheus.Collector{cacheHits, cacheMisses} {
+			if err := prometheus.Register(collector); err != nil {
+				if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+					caddy.Log().Named("nats.auth_cache").Warn("failed to register cache metric")
+				}
+			}
+		}
+	})
+}
+
+// DecisionCache is the configuration of the auth callout decision cache.
+// Decisions (user claims or errors) are cached using a fingerprint of the credentials
+// and client attributes found in authorization requests. Allowed decisions are cached
+// for TTL (or until user claims expire), and denied decisions are cached for NegativeTTL.
+// When MaxEntries is reached, least recently used entries are evicted.
+type DecisionCache struct {
+	TTL         time.Duration `json:"ttl,omitempty"`
+	NegativeTTL time.Duration `json:"negative_ttl,omitempty"`
+	MaxEntries  int           `json:"max_entries,omitempty"`
+}
+
+// decisionCache is an LRU cache of auth callout decisions.
+type decisionCache struct {
+	mutex       sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	entries     map[string]*list.Element
+	lru         *list.List
+	now         func() time.Time
+}
+
+// decision is the result of handling an authorization request.
+type decision struct {
+	claims     *jwt.UserClaims
+	sessionKey string
+	policy     int
+	handler    string
+	err        error
+}
+
+type cacheEntry struct {
+	decision
+	key     string
+	expires time.Time
+}
+
+// newDecisionCache creates a decision cache from its configuration.
+func newDecisionCache(config *DecisionCache) (*decisionCache, error) {
+	if config.TTL < 0 || config.NegativeTTL < 0 || config.MaxEntries < 0 {
+		return nil, errors.New("cache ttl, negative_ttl and max_entries must not be negative")
+	}
+	cache := &decisionCache{
+		ttl:         config.TTL,
+		negativeTTL: config.NegativeTTL,
+		maxEntries:  config.MaxEntries,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		now:         time.Now,
+	}
+	if cache.ttl == 0 {
+		cache.ttl = DEFAULT_CACHE_TTL
+	}
+	if cache.negativeTTL == 0 {
+		cache.negativeTTL = DEFAULT_CACHE_NEGATIVE_TTL
+	}
+	if cache.maxEntries == 0 {
+		cache.maxEntries = DEFAULT_CACHE_MAX_ENTRIES
+	}
+	registerCacheMetrics()
+	return cache, nil
+}
+
+// cacheKey returns the fingerprint of the credentials and client attributes of a request.
+// Attributes which change on every connection (user nkey, client ID, nonce) are not used,
+// with the exception of the nonce signature, so requests authenticated with a signed
+// nonce are never answered from the cache.
+func cacheKey(request *jwt.AuthorizationRequestClaims) string {
+	info := request.ClientInformation
+	raw, _ := json.Marshal(struct {
+		ConnectOptions jwt.ConnectOptions `json:"connect_opts"`
+		Host           string             `json:"host"`
+		User           string             `json:"user"`
+		Name           string             `json:"name"`
+		Tags           jwt.TagList        `json:"tags"`
+		NameTag        string             `json:"name_tag"`
+		Kind           string             `json:"kind"`
+		Type           string             `json:"type"`
+		MQTT           string             `json:"mqtt"`
+		TLS            *jwt.ClientTLS     `json:"tls"`
+	}{request.ConnectOptions, info.Host, info.User, info.Name, info.Tags, info.NameTag, info.Kind, info.Type, info.MQTT, request.TLS})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the decision cached for a request. The returned claims are a copy of the
+// cached claims, issued for the user nkey of the request.
+func (c *decisionCache) get(request *jwt.AuthorizationRequestClaims) (decision, bool) {
+	key := cacheKey(request)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		cacheMisses.Inc()
+		return decision{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		cacheMisses.Inc()
+		return decision{}, false
+	}
+	c.lru.MoveToFront(element)
+	if entry.err != nil {
+		cacheHits.WithLabelValues("denied").Inc()
+		return entry.decision, true
+	}
+	cacheHits.WithLabelValues("allowed").Inc()
+	// Permissions and limits are not modified when claims are signed,
+	// so a shallow copy is enough.
+	claims := *entry.claims
+	claims.Subject = request.UserNkey
+	return decision{claims: &claims, sessionKey: entry.sessionKey, policy: entry.policy, handler: entry.handler}, true
+}
+
+// set caches the decision for a request.
+func (c *decisionCache) set(request *jwt.AuthorizationRequestClaims, d decision) {
+	now := c.now()
+	entry := &cacheEntry{decision: d, key: cacheKey(request)}
+	if d.err != nil {
+		entry.expires = now.Add(c.negativeTTL)
+	} else {
+		// Copy claims before they are signed
+		copied := *d.claims
+		entry.claims = &copied
+		entry.expires = now.Add(c.ttl)
+		if copied.Expires > 0 && time.Unix(copied.Expires, 0).Before(entry.expires) {
+			entry.expires = time.Unix(copied.Expires, 0)
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// removeSession removes the decisions of a session from the cache.
+func (c *decisionCache) removeSession(sessionKey string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, element := range c.entries {
+		if element.Value.(*cacheEntry).sessionKey == sessionKey {
+			c.remove(element)
+		}
+	}
+}
+
+// remove removes an element from the cache. Lock must be held.
+func (c *decisionCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// purge removes all entries from the cache and returns the number of removed entries.
+func (c *decisionCache) purge() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := c.lru.Len()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	return count
+}
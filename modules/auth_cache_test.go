@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func newCacheTestRequest(userNkey string, username string) *jwt.AuthorizationRequestClaims {
+	request := jwt.NewAuthorizationRequestClaims("SERVER")
+	request.UserNkey = userNkey
+	request.ConnectOptions.Username = username
+	request.ConnectOptions.Password = "secret"
+	request.ClientInformation.Host = "127.0.0.1"
+	request.ClientInformation.ID = 1
+	return request
+}
+
+func TestDecisionCache(t *testing.T) {
+	cache, err := newDecisionCache(&DecisionCache{TTL: time.Minute, NegativeTTL: time.Second, MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	alice := newCacheTestRequest("UALICE1", "alice")
+	if _, ok := cache.get(alice); ok {
+		t.Fatal("expected cache miss")
+	}
+	claims := jwt.NewUserClaims("UALICE1")
+	claims.Audience = "APP"
+	claims.Pub.Allow.Add("foo")
+	cache.set(alice, decision{claims: claims, sessionKey: "session-alice"})
+	// Client ID and user nkey change on every connection
+	next := newCacheTestRequest("UALICE2", "alice")
+	next.ClientInformation.ID = 2
+	d, ok := cache.get(next)
+	if !ok || d.err != nil || d.sessionKey != "session-alice" {
+		t.Fatal("expected cached claims")
+	}
+	cached := d.claims
+	if cached.Subject != "UALICE2" || cached.Audience != "APP" || !cached.Pub.Allow.Contains("foo") {
+		t.Fatalf("unexpected cached claims: %+v", cached)
+	}
+	if claims.Subject != "UALICE1" {
+		t.Fatal("cached claims must be copied")
+	}
+	// Credentials are part of the key
+	other := newCacheTestRequest("UALICE3", "alice")
+	other.ConnectOptions.Password = "other"
+	if _, ok := cache.get(other); ok {
+		t.Fatal("expected cache miss with other credentials")
+	}
+	// Denials are cached for the negative TTL
+	bob := newCacheTestRequest("UBOB", "bob")
+	cache.set(bob, decision{err: errors.New("denied")})
+	if d, ok := cache.get(bob); !ok || d.err == nil {
+		t.Fatal("expected cached denial")
+	}
+	now = now.Add(2 * time.Second)
+	if _, ok := cache.get(bob); ok {
+		t.Fatal("expected expired denial")
+	}
+	if _, ok := cache.get(alice); !ok {
+		t.Fatal("expected cached claims")
+	}
+	// Least recently used entries are evicted
+	carol := newCacheTestRequest("UCAROL", "carol")
+	dave := newCacheTestRequest("UDAVE", "dave")
+	cache.set(carol, decision{claims: jwt.NewUserClaims("UCAROL")})
+	cache.set(dave, decision{claims: jwt.NewUserClaims("UDAVE"), sessionKey: "session-dave"})
+	if _, ok := cache.get(alice); ok {
+		t.Fatal("expected evicted entry")
+	}
+	cache.removeSession("session-dave")
+	if _, ok := cache.get(dave); ok {
+		t.Fatal("expected removed session")
+	}
+	if count := cache.purge(); count != 1 {
+		t.Fatalf("unexpected number of purged entries: %d", count)
+	}
+	if _, ok := cache.get(carol); ok {
+		t.Fatal("expected purged entry")
+	}
+}
+
+func TestDecisionCacheExpiringClaims(t *testing.T) {
+	cache, err := newDecisionCache(&DecisionCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	request := newCacheTestRequest("UALICE", "alice")
+	claims := jwt.NewUserClaims("UALICE")
+	claims.Expires = now.Add(10 * time.Second).Unix()
+	cache.set(request, decision{claims: claims})
+	now = now.Add(20 * time.Second)
+	if _, ok := cache.get(request); ok {
+		t.Fatal("expected cache entry to expire with claims")
+	}
+	if _, err := newDecisionCache(&DecisionCache{TTL: -time.Second}); err == nil {
+		t.Fatal("expected error with negative ttl")
+	}
+}
+
+func TestAuthServiceCache(t *testing.T) {
+	calls := 0
+	service := &AuthService{defaultHandler: &countingAuthCallout{calls: &calls}}
+	cache, err := newDecisionCache(&DecisionCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.cache = cache
+	for i := 0; i < 3; i++ {
+		if _, err := service.Handle(newCacheTestRequest("UALICE", "alice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("unexpected number of handler calls: %d", calls)
+	}
+	if service.PurgeCache() != 1 {
+		t.Fatal("expected one purged entry")
+	}
+	if _, err := service.Handle(newCacheTestRequest("UALICE", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("unexpected number of handler calls: %d", calls)
+	}
+}
+
+type countingAuthCallout struct {
+	calls *int
+}
+
+func (c *countingAuthCallout) Handle(request *AuthorizationRequest) (*jwt.UserClaims, error) {
+	*c.calls++
+	claims := jwt.NewUserClaims(request.Claims.UserNkey)
+	claims.Audience = "APP"
+	return claims, nil
+}
+
+func (c *countingAuthCallout) Provision(app *App) error {
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/charbonnierg/caddy-nats/modules"
 	"github.com/nats-io/jwt/v2"
 )
@@ -53,6 +54,48 @@ func (a *AllowAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.U
 	return userClaims, nil
 }
 
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	allow [<account>] {
+//		account <account>
+//		user <user>
+//		template {
+//			...
+//		}
+//	}
+func (a *AllowAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			a.Account = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "account":
+				if !d.AllArgs(&a.Account) {
+					return d.ArgErr()
+				}
+			case "user":
+				if !d.AllArgs(&a.User) {
+					return d.ArgErr()
+				}
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				a.Template = template
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
 var (
-	_ modules.AuthCallout = (*AllowAuthCallout)(nil)
+	_ modules.AuthCallout   = (*AllowAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*AllowAuthCallout)(nil)
 )
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package auth_callout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(ChainAuthCallout{})
+}
+
+const (
+	// ChainModeFirst accepts the claims of the first handler which succeeds.
+	ChainModeFirst = "first"
+	// ChainModeAll requires all handlers to succeed and merges their claims.
+	ChainModeAll = "all"
+)
+
+// errDenied is returned to clients when composite handlers fail.
+// Errors returned by sub handlers are only logged.
+var errDenied = errors.New("access denied")
+
+// ChainAuthCallout is a caddy module that implements the auth callout interface.
+// It is configured in the "nats.auth_callout.chain" namespace.
+// Handlers are tried in order. In "first" mode (the default), the claims of the first
+// handler which succeeds are returned. In "all" mode, all handlers must succeed and
+// authenticate the user for the same account. Their claims are merged so that each handler
+// can only restrict access: allow lists are intersected, deny lists are combined, source
+// networks, connection types and times are intersected, the earliest expiry and the lowest
+// limits are kept (see modules.MergeUserClaims).
+type ChainAuthCallout struct {
+	logger      *zap.Logger
+	handlers    []modules.AuthCallout
+	Mode        string            `json:"mode,omitempty"`
+	HandlersRaw []json.RawMessage `json:"handlers" caddy:"namespace=nats.auth_callout inline_key=module"`
+}
+
+func (ChainAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.chain",
+		New: func() caddy.Module { return new(ChainAuthCallout) },
+	}
+}
+
+// Provision loads and provisions all handlers of the chain.
+func (c *ChainAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("chain")
+	switch c.Mode {
+	case "":
+		c.Mode = ChainModeFirst
+	case ChainModeFirst, ChainModeAll:
+	default:
+		return fmt.Errorf("invalid chain mode: %s", c.Mode)
+	}
+	if len(c.HandlersRaw) == 0 {
+		return errors.New("chain handlers are required")
+	}
+	unm, err := app.Context().LoadModule(c, "HandlersRaw")
+	if err != nil {
+		return fmt.Errorf("failed to load chain handlers: %s", err.Error())
+	}
+	handlers, err := provisionHandlers(app, unm.([]interface{}))
+	if err != nil {
+		return err
+	}
+	c.handlers = handlers
+	return nil
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+func (c *ChainAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	if c.Mode == ChainModeAll {
+		return c.handleAll(request)
+	}
+	return handleFirst(c.logger, c.handlers, request)
+}
+
+// handleAll requires all handlers to succeed and merges their claims.
+func (c *ChainAuthCallout) handleAll(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	var merged *jwt.UserClaims
+	for idx, handler := range c.handlers {
+		claims, err := handler.Handle(request)
+		if err != nil {
+			c.logger.Debug("chain handler failed", zap.Int("handler", idx), zap.String("module", moduleID(handler)), zap.Error(err))
+			return nil, errDenied
+		}
+		if merged == nil {
+			merged = claims
+			continue
+		}
+		if err := mergeClaims(merged, claims); err != nil {
+			c.logger.Debug("chain handler failed", zap.Int("handler", idx), zap.String("module", moduleID(handler)), zap.Error(err))
+			return nil, errDenied
+		}
+	}
+	return merged, nil
+}
+
+// handleFirst returns the claims of the first handler which succeeds.
+// Errors of all handlers are logged at debug level when all handlers fail.
+func handleFirst(logger *zap.Logger, handlers []modules.AuthCallout, request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	fields := []zap.Field{}
+	for idx, handler := range handlers {
+		claims, err := handler.Handle(request)
+		if err == nil {
+			return claims, nil
+		}
+		fields = append(fields, zap.NamedError(fmt.Sprintf("%d_%s", idx, moduleID(handler)), err))
+	}
+	logger.Debug("all handlers failed", fields...)
+	return nil, errDenied
+}
+
+// provisionHandlers provisions loaded handler modules.
+func provisionHandlers(app *modules.App, loaded []interface{}) ([]modules.AuthCallout, error) {
+	handlers := make([]modules.AuthCallout, len(loaded))
+	for idx, unm := range loaded {
+		handler, ok := unm.(modules.AuthCallout)
+		if !ok {
+			return nil, errors.New("auth callout handler invalid type")
+		}
+		if err := handler.Provision(app); err != nil {
+			return nil, fmt.Errorf("failed to provision auth callout handler: %s", err.Error())
+		}
+		handlers[idx] = handler
+	}
+	return handlers, nil
+}
+
+// moduleID returns the caddy module ID of a handler.
+func moduleID(handler modules.AuthCallout) string {
+	if module, ok := handler.(caddy.Module); ok {
+		return string(module.CaddyModule().ID)
+	}
+	return fmt.Sprintf("%T", handler)
+}
+
+// mergeClaims merges src claims into dest claims.
+// Both claims must target the same account, and only subjects allowed by both claims are allowed.
+func mergeClaims(dest *jwt.UserClaims, src *jwt.UserClaims) error {
+	if dest.Audience != src.Audience {
+		return fmt.Errorf("handlers target different accounts: %s and %s", dest.Audience, src.Audience)
+	}
+	return modules.MergeUserClaims(dest, src, modules.MergeRestrict)
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	chain [first|all] {
+//		handler <module> {
+//			...
+//		}
+//	}
+func (c *ChainAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			c.Mode = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "handler":
+				raw, err := modules.ParseHandler(d)
+				if err != nil {
+					return err
+				}
+				c.HandlersRaw = append(c.HandlersRaw, raw)
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*ChainAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*ChainAuthCallout)(nil)
+)
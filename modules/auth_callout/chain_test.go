@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package auth_callout
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+// stubAuthCallout returns its claims, or its error when not nil.
+type stubAuthCallout struct {
+	calls  int
+	claims func() *jwt.UserClaims
+	err    error
+}
+
+func (s *stubAuthCallout) Provision(app *modules.App) error { return nil }
+
+func (s *stubAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.claims(), nil
+}
+
+func newStubClaims(account string, configure func(claims *jwt.UserClaims)) func() *jwt.UserClaims {
+	return func() *jwt.UserClaims {
+		claims := jwt.NewUserClaims("UABC")
+		claims.Audience = account
+		if configure != nil {
+			configure(claims)
+		}
+		return claims
+	}
+}
+
+func newTestRequest() *modules.AuthorizationRequest {
+	return authtest.NewRequest("")
+}
+
+func TestChainAuthCalloutFirst(t *testing.T) {
+	failing := &stubAuthCallout{err: errors.New("secret failure")}
+	first := &stubAuthCallout{claims: newStubClaims("APP", nil)}
+	second := &stubAuthCallout{claims: newStubClaims("OTHER", nil)}
+	handler := &ChainAuthCallout{logger: zap.NewNop(), Mode: ChainModeFirst, handlers: []modules.AuthCallout{failing, first, second}}
+	claims, err := handler.Handle(newTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+	if failing.calls != 1 || first.calls != 1 || second.calls != 0 {
+		t.Fatalf("unexpected calls: %d %d %d", failing.calls, first.calls, second.calls)
+	}
+	handler.handlers = []modules.AuthCallout{failing, failing}
+	_, err = handler.Handle(newTestRequest())
+	if err != errDenied {
+		t.Fatalf("expected access denied error, got: %v", err)
+	}
+}
+
+func TestChainAuthCalloutAll(t *testing.T) {
+	first := &stubAuthCallout{claims: newStubClaims("APP", func(claims *jwt.UserClaims) {
+		claims.Pub.Allow.Add("a.>")
+		claims.Expires = 200
+		claims.Subs = 10
+		claims.Tags.Add("first")
+	})}
+	second := &stubAuthCallout{claims: newStubClaims("APP", func(claims *jwt.UserClaims) {
+		claims.Name = "user"
+		claims.Pub.Allow.Add("a.b", "b.>")
+		claims.Sub.Deny.Add("secret.>")
+		claims.Expires = 100
+		claims.Data = 1024
+		claims.Tags.Add("second")
+	})}
+	handler := &ChainAuthCallout{logger: zap.NewNop(), Mode: ChainModeAll, handlers: []modules.AuthCallout{first, second}}
+	claims, err := handler.Handle(newTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" || claims.Name != "user" || claims.Expires != 100 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	// Only subjects allowed by all handlers are allowed
+	if len(claims.Pub.Allow) != 1 || claims.Pub.Allow[0] != "a.b" || len(claims.Sub.Deny) != 1 || len(claims.Tags) != 2 {
+		t.Fatalf("unexpected permissions: %+v", claims.Permissions)
+	}
+	if claims.Subs != 10 || claims.Data != 1024 || claims.NatsLimits.Payload != jwt.NoLimit {
+		t.Fatalf("unexpected limits: %+v", claims.Limits)
+	}
+	// All handlers must succeed
+	failing := &stubAuthCallout{err: errors.New("secret failure")}
+	handler.handlers = []modules.AuthCallout{first, failing}
+	if _, err := handler.Handle(newTestRequest()); err != errDenied {
+		t.Fatalf("expected access denied error, got: %v", err)
+	}
+	// All handlers must target the same account
+	other := &stubAuthCallout{claims: newStubClaims("OTHER", nil)}
+	handler.handlers = []modules.AuthCallout{first, other}
+	if _, err := handler.Handle(newTestRequest()); err != errDenied {
+		t.Fatalf("expected access denied error, got: %v", err)
+	}
+}
+
+func TestFallbackAuthCallout(t *testing.T) {
+	failing := &stubAuthCallout{err: errors.New("identity provider unreachable")}
+	fallback := &stubAuthCallout{claims: newStubClaims("APP", nil)}
+	handler := &FallbackAuthCallout{logger: zap.NewNop(), handlers: []modules.AuthCallout{failing, fallback}}
+	claims, err := handler.Handle(newTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" || fallback.calls != 1 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	primary := &stubAuthCallout{claims: newStubClaims("PRIMARY", nil)}
+	handler.handlers = []modules.AuthCallout{primary, fallback}
+	claims, err = handler.Handle(newTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "PRIMARY" || fallback.calls != 1 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestChainAuthCalloutCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`chain all {
+		handler allow
+		handler deny
+	}`)
+	handler := &ChainAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Mode != ChainModeAll || len(handler.HandlersRaw) != 2 {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	if string(handler.HandlersRaw[1]) != `{"module":"deny"}` {
+		t.Fatalf("unexpected handler: %s", handler.HandlersRaw[1])
+	}
+}
+
+func TestFallbackAuthCalloutCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`fallback {
+		handler deny
+		fallback allow
+	}`)
+	handler := &FallbackAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if string(handler.HandlerRaw) != `{"module":"deny"}` || string(handler.FallbackRaw) != `{"module":"allow"}` {
+		t.Fatalf("unexpected handler: %s %s", handler.HandlerRaw, handler.FallbackRaw)
+	}
+}
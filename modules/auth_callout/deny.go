@@ -6,6 +6,7 @@ import (
 	"errors"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/charbonnierg/caddy-nats/modules"
 	"github.com/nats-io/jwt/v2"
 )
@@ -32,6 +33,22 @@ func (a *DenyAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.Us
 	return nil, errors.New("access denied")
 }
 
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	deny
+func (a *DenyAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
 var (
-	_ modules.AuthCallout = (*DenyAuthCallout)(nil)
+	_ modules.AuthCallout   = (*DenyAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*DenyAuthCallout)(nil)
 )
@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package exprauth
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/google/cel-go/cel"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(ExpressionAuthCallout{})
+}
+
+// Permission holds CEL expressions returning lists of allowed and denied subjects.
+type Permission struct {
+	allow *modules.Expression
+	deny  *modules.Expression
+	Allow string `json:"allow,omitempty"`
+	Deny  string `json:"deny,omitempty"`
+}
+
+// ExpressionAuthCallout is a caddy module that implements the auth callout interface.
+// It is configured in the "nats.auth_callout.expression" namespace.
+// It evaluates CEL expressions over the authorization request to decide whether access
+// is granted (condition), the target account (account), the user name (name) and
+// the publish and subscribe subjects. Permission expressions return lists of subjects,
+// which are added to the permissions of the template.
+// Identity claims stored by a previous handler of a chain (e.g. OIDC claims stored by
+// the oauth2 handler) are available as the "claims" variable.
+// Expressions are compiled and type-checked when the handler is provisioned.
+type ExpressionAuthCallout struct {
+	logger    *zap.Logger
+	condition *modules.Expression
+	account   *modules.Expression
+	name      *modules.Expression
+	Condition string            `json:"condition,omitempty"`
+	Account   string            `json:"account"`
+	Name      string            `json:"name,omitempty"`
+	Publish   *Permission       `json:"publish,omitempty"`
+	Subscribe *Permission       `json:"subscribe,omitempty"`
+	Template  *modules.Template `json:"template,omitempty"`
+}
+
+func (ExpressionAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.expression",
+		New: func() caddy.Module { return new(ExpressionAuthCallout) },
+	}
+}
+
+// Provision sets up the auth callout handler.
+// It is called by the auth callout caddy module when the handler is loaded from config.
+// It should not be called directly by other modules.
+func (c *ExpressionAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("expression")
+	return c.provision()
+}
+
+// provision compiles and type-checks all expressions.
+func (c *ExpressionAuthCallout) provision() error {
+	if c.Account == "" {
+		return errors.New("expression account is required")
+	}
+	var err error
+	if c.account, err = compile(c.Account, cel.StringType); err != nil {
+		return err
+	}
+	if c.condition, err = compile(c.Condition, cel.BoolType); err != nil {
+		return err
+	}
+	if c.name, err = compile(c.Name, cel.StringType); err != nil {
+		return err
+	}
+	for _, perm := range []*Permission{c.Publish, c.Subscribe} {
+		if perm == nil {
+			continue
+		}
+		if perm.allow, err = compile(perm.Allow, cel.ListType(cel.StringType)); err != nil {
+			return err
+		}
+		if perm.deny, err = compile(perm.Deny, cel.ListType(cel.StringType)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compile compiles an optional expression. It returns nil when source is empty.
+func compile(source string, output *cel.Type) (*modules.Expression, error) {
+	if source == "" {
+		return nil, nil
+	}
+	return modules.CompileExpression(source, output)
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+func (c *ExpressionAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	claims := request.GetIdentityClaims()
+	if c.condition != nil {
+		var granted bool
+		if err := c.condition.Eval(request.Claims, claims, &granted); err != nil {
+			return nil, err
+		}
+		if !granted {
+			return nil, errors.New("expression condition not satisfied")
+		}
+	}
+	// Initialize user claims
+	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
+	if c.Template != nil {
+		// Apply the template
+		c.Template.Render(request, userClaims)
+	}
+	if c.name != nil {
+		if err := c.name.Eval(request.Claims, claims, &userClaims.Name); err != nil {
+			return nil, err
+		}
+	}
+	if err := evalPermission(c.Publish, request, claims, &userClaims.Pub); err != nil {
+		return nil, err
+	}
+	if err := evalPermission(c.Subscribe, request, claims, &userClaims.Sub); err != nil {
+		return nil, err
+	}
+	// The target account must be specified as JWT audience
+	if err := c.account.Eval(request.Claims, claims, &userClaims.Audience); err != nil {
+		return nil, err
+	}
+	if userClaims.Audience == "" {
+		// If the target account is still empty, deny access
+		return nil, errors.New("no target account specified")
+	}
+	c.logger.Info("authenticated user", zap.String("name", userClaims.Name), zap.String("account", userClaims.Audience))
+	return userClaims, nil
+}
+
+// evalPermission adds the subjects returned by permission expressions to the permission.
+func evalPermission(perm *Permission, request *modules.AuthorizationRequest, claims map[string]any, dest *jwt.Permission) error {
+	if perm == nil {
+		return nil
+	}
+	for _, item := range []struct {
+		expression *modules.Expression
+		dest       *jwt.StringList
+	}{{perm.allow, &dest.Allow}, {perm.deny, &dest.Deny}} {
+		if item.expression == nil {
+			continue
+		}
+		var subjects []string
+		if err := item.expression.Eval(request.Claims, claims, &subjects); err != nil {
+			return err
+		}
+		item.dest.Add(subjects...)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	expression [<account>] {
+//		condition <expression>
+//		account <expression>
+//		name <expression>
+//		publish allow|deny <expression>
+//		subscribe allow|deny <expression>
+//		template {
+//			...
+//		}
+//	}
+func (c *ExpressionAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			c.Account = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "condition":
+				if !d.AllArgs(&c.Condition) {
+					return d.ArgErr()
+				}
+			case "account":
+				if !d.AllArgs(&c.Account) {
+					return d.ArgErr()
+				}
+			case "name":
+				if !d.AllArgs(&c.Name) {
+					return d.ArgErr()
+				}
+			case "publish", "subscribe":
+				perm := &c.Publish
+				if d.Val() == "subscribe" {
+					perm = &c.Subscribe
+				}
+				if *perm == nil {
+					*perm = &Permission{}
+				}
+				var kind, expression string
+				if !d.AllArgs(&kind, &expression) {
+					return d.ArgErr()
+				}
+				switch kind {
+				case "allow":
+					(*perm).Allow = expression
+				case "deny":
+					(*perm).Deny = expression
+				default:
+					return d.Errf("expected allow or deny, got: %s", kind)
+				}
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				c.Template = template
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*ExpressionAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*ExpressionAuthCallout)(nil)
+)
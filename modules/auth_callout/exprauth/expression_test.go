@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package exprauth
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func newTestRequest(username string, claims map[string]any) *modules.AuthorizationRequest {
+	request := authtest.NewRequest(username)
+	if claims != nil {
+		request.SetIdentityClaims(claims)
+	}
+	return request
+}
+
+func TestExpressionAuthCallout(t *testing.T) {
+	handler := &ExpressionAuthCallout{
+		logger:    zap.NewNop(),
+		Condition: `"nats" in claims.groups`,
+		Account:   `claims.tenant.upperAscii()`,
+		Name:      `claims.email`,
+		Publish:   &Permission{Allow: `claims.groups.map(g, "groups." + g + ".>")`},
+		Subscribe: &Permission{Allow: `["_INBOX.>"]`, Deny: `["secret.>"]`},
+		Template:  &modules.Template{},
+	}
+	handler.Template.Permissions.Pub.Allow = jwt.StringList{"users.{connect_opts.username}.>"}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest("alice", map[string]any{
+		"email":  "alice@example.com",
+		"tenant": "app",
+		"groups": []any{"nats", "dev"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" || claims.Name != "alice@example.com" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	expected := jwt.StringList{"users.alice.>", "groups.nats.>", "groups.dev.>"}
+	if len(claims.Pub.Allow) != len(expected) {
+		t.Fatalf("unexpected publish permissions: %v", claims.Pub.Allow)
+	}
+	for _, subject := range expected {
+		if !claims.Pub.Allow.Contains(subject) {
+			t.Fatalf("unexpected publish permissions: %v", claims.Pub.Allow)
+		}
+	}
+	if len(claims.Sub.Allow) != 1 || len(claims.Sub.Deny) != 1 {
+		t.Fatalf("unexpected subscribe permissions: %+v", claims.Sub)
+	}
+	denied := map[string]*modules.AuthorizationRequest{
+		"condition not satisfied": newTestRequest("bob", map[string]any{"tenant": "app", "email": "bob", "groups": []any{"dev"}}),
+		"missing claims":          newTestRequest("bob", nil),
+		"empty account":           newTestRequest("bob", map[string]any{"tenant": "", "email": "bob", "groups": []any{"nats"}}),
+	}
+	for name, request := range denied {
+		if _, err := handler.Handle(request); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestExpressionAuthCalloutInvalid(t *testing.T) {
+	invalid := map[string]*ExpressionAuthCallout{
+		"no account":         {},
+		"invalid account":    {Account: `1 + 1`},
+		"invalid condition":  {Account: `"APP"`, Condition: `user_nkey`},
+		"invalid permission": {Account: `"APP"`, Publish: &Permission{Allow: `"foo"`}},
+		"syntax error":       {Account: `"APP`},
+	}
+	for name, handler := range invalid {
+		if err := handler.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestExpressionAuthCalloutCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`expression 'APP' {
+		condition "connect_opts.user.startsWith('svc-')"
+		name connect_opts.user
+		publish allow "['services.' + connect_opts.user + '.>']"
+		subscribe deny "['secret.>']"
+		template {
+			subscribe allow _INBOX.>
+		}
+	}`)
+	handler := &ExpressionAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Account != "'APP'" || handler.Condition != "connect_opts.user.startsWith('svc-')" || handler.Name != "connect_opts.user" {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	if handler.Publish == nil || handler.Publish.Allow != "['services.' + connect_opts.user + '.>']" {
+		t.Fatalf("unexpected publish permission: %+v", handler.Publish)
+	}
+	if handler.Subscribe == nil || handler.Subscribe.Deny != "['secret.>']" || handler.Template == nil {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package auth_callout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(FallbackAuthCallout{})
+}
+
+// FallbackAuthCallout is a caddy module that implements the auth callout interface.
+// It is configured in the "nats.auth_callout.fallback" namespace.
+// The fallback handler is used only when the handler fails, e.g. to authenticate
+// users from a static list when an identity provider cannot be reached.
+type FallbackAuthCallout struct {
+	logger      *zap.Logger
+	handlers    []modules.AuthCallout
+	HandlerRaw  json.RawMessage `json:"handler" caddy:"namespace=nats.auth_callout inline_key=module"`
+	FallbackRaw json.RawMessage `json:"fallback" caddy:"namespace=nats.auth_callout inline_key=module"`
+}
+
+func (FallbackAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.fallback",
+		New: func() caddy.Module { return new(FallbackAuthCallout) },
+	}
+}
+
+// Provision loads and provisions the handler and the fallback handler.
+func (c *FallbackAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("fallback")
+	if c.HandlerRaw == nil || c.FallbackRaw == nil {
+		return errors.New("fallback requires a handler and a fallback handler")
+	}
+	handler, err := app.Context().LoadModule(c, "HandlerRaw")
+	if err != nil {
+		return fmt.Errorf("failed to load handler: %s", err.Error())
+	}
+	fallback, err := app.Context().LoadModule(c, "FallbackRaw")
+	if err != nil {
+		return fmt.Errorf("failed to load fallback handler: %s", err.Error())
+	}
+	handlers, err := provisionHandlers(app, []interface{}{handler, fallback})
+	if err != nil {
+		return err
+	}
+	c.handlers = handlers
+	return nil
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+func (c *FallbackAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	return handleFirst(c.logger, c.handlers, request)
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	fallback {
+//		handler <module> {
+//			...
+//		}
+//		fallback <module> {
+//			...
+//		}
+//	}
+func (c *FallbackAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "handler":
+				raw, err := modules.ParseHandler(d)
+				if err != nil {
+					return err
+				}
+				c.HandlerRaw = raw
+			case "fallback":
+				raw, err := modules.ParseHandler(d)
+				if err != nil {
+					return err
+				}
+				c.FallbackRaw = raw
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*FallbackAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*FallbackAuthCallout)(nil)
+)
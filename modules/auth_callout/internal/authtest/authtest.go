@@ -0,0 +1,23 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package authtest provides helpers to test auth callout handlers.
+package authtest
+
+import (
+	"context"
+
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+)
+
+// UserNkey is the user nkey of the authorization requests created by NewRequest.
+const UserNkey = "UABC"
+
+// NewRequest creates an authorization request for the test user nkey,
+// with the given username in connect options.
+func NewRequest(username string) *modules.AuthorizationRequest {
+	claims := jwt.NewAuthorizationRequestClaims(UserNkey)
+	claims.UserNkey = UserNkey
+	claims.ConnectOptions.Username = username
+	return &modules.AuthorizationRequest{Claims: claims, Context: context.Background()}
+}
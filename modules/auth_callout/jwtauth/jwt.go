@@ -0,0 +1,367 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(JWTAuthCallout{})
+}
+
+// defaultAlgorithms are the signing algorithms accepted when none are configured.
+var defaultAlgorithms = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	oidc.EdDSA,
+}
+
+// JWTAuthCallout is a caddy module that implements the auth callout interface.
+// It is used to authenticate users presenting a bearer JWT, such as an OIDC ID token
+// or an access token issued by an identity provider.
+// It is configured in the "nats.auth_callout.jwt" namespace.
+// The token is read from the connect options token, or from the password when no token is provided.
+// Token signature is verified against a JWKS fetched from an URL or read from a local file.
+// Issuer, expiry, audiences and required claims are verified.
+// Token claims are available to templates as {jwt.claims.<name>} placeholders,
+// nested claims are accessed using dots (e.g. {jwt.claims.realm_access.roles}).
+type JWTAuthCallout struct {
+	logger   *zap.Logger
+	verifier *oidc.IDTokenVerifier
+	// Issuer is the expected token issuer. It is required.
+	Issuer string `json:"issuer"`
+	// JWKSURL is the URL of the JWKS used to verify token signatures.
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// JWKSFile is the path to a local JWKS used to verify token signatures.
+	JWKSFile string `json:"jwks_file,omitempty"`
+	// Audiences are the accepted audiences. When set, token must be issued for at least one of them.
+	Audiences []string `json:"audiences,omitempty"`
+	// Algorithms are the accepted signing algorithms. All asymmetric algorithms are accepted by default.
+	Algorithms []string `json:"algorithms,omitempty"`
+	// RequiredClaims maps claim names to expected values. An empty value only
+	// requires the claim to be present. When the claim is a list, it must contain the value.
+	RequiredClaims map[string]string `json:"required_claims,omitempty"`
+	// Account is the target account of users. It is required, and may use
+	// token claims placeholders (e.g. {jwt.claims.tenant}).
+	Account  string            `json:"account"`
+	Template *modules.Template `json:"template,omitempty"`
+}
+
+func (JWTAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.jwt",
+		New: func() caddy.Module { return new(JWTAuthCallout) },
+	}
+}
+
+// Provision sets up the auth callout handler.
+// It is called by the auth callout caddy module when the handler is loaded from config.
+// It should not be called directly by other modules.
+func (c *JWTAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("jwt")
+	return c.provision(app.Context())
+}
+
+// provision creates the token verifier. Remote key set is fetched using the given context.
+func (c *JWTAuthCallout) provision(ctx context.Context) error {
+	if c.Issuer == "" {
+		return errors.New("jwt issuer is required")
+	}
+	// Clients must not be able to select their account using their username
+	if c.Account == "" {
+		return errors.New("jwt account is required")
+	}
+	var keySet oidc.KeySet
+	switch {
+	case c.JWKSURL != "" && c.JWKSFile != "":
+		return errors.New("jwt jwks_url and jwks_file cannot be set at the same time")
+	case c.JWKSURL != "":
+		keySet = oidc.NewRemoteKeySet(ctx, c.JWKSURL)
+	case c.JWKSFile != "":
+		staticKeySet, err := loadKeySet(c.JWKSFile)
+		if err != nil {
+			return err
+		}
+		keySet = staticKeySet
+	default:
+		return errors.New("jwt jwks_url or jwks_file is required")
+	}
+	algorithms := c.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultAlgorithms
+	}
+	c.verifier = oidc.NewVerifier(c.Issuer, keySet, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: algorithms,
+	})
+	return nil
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+// The account for which the user is authenticated is the configured account.
+func (c *JWTAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	token := request.Claims.ConnectOptions.Token
+	if token == "" {
+		token = request.Claims.ConnectOptions.Password
+	}
+	if token == "" {
+		return nil, errors.New("no token presented")
+	}
+	idToken, err := c.verifier.Verify(request.Context, token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err.Error())
+	}
+	if !c.verifyAudience(idToken.Audience) {
+		return nil, errors.New("invalid token audience")
+	}
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, errors.New("unable to decode token claims")
+	}
+	if err := c.verifyRequiredClaims(claims); err != nil {
+		return nil, err
+	}
+	// Add replacers for token claims
+	request.AddReplacerMapper(claimsReplacer(claims))
+	// Initialize user claims
+	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
+	userClaims.Name = idToken.Subject
+	if c.Template != nil {
+		// Apply the template
+		c.Template.Render(request, userClaims)
+	}
+	// The target account must be specified as JWT audience
+	userClaims.Audience = request.ReplaceAll(c.Account, "")
+	if userClaims.Audience == "" {
+		// If the target account is empty (e.g. missing claim), deny access
+		return nil, errors.New("no target account specified")
+	}
+	c.logger.Info("authenticated user", zap.String("subject", idToken.Subject), zap.String("account", userClaims.Audience))
+	return userClaims, nil
+}
+
+// verifyAudience returns true when no audience is configured,
+// or when the token is issued for one of the configured audiences.
+func (c *JWTAuthCallout) verifyAudience(audiences []string) bool {
+	if len(c.Audiences) == 0 {
+		return true
+	}
+	for _, expected := range c.Audiences {
+		for _, aud := range audiences {
+			if aud == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyRequiredClaims verifies that all required claims are present
+// and have the expected value.
+func (c *JWTAuthCallout) verifyRequiredClaims(claims map[string]interface{}) error {
+	for name, expected := range c.RequiredClaims {
+		value, ok := lookupClaim(claims, name)
+		if !ok {
+			return fmt.Errorf("missing required claim: %s", name)
+		}
+		if expected == "" {
+			continue
+		}
+		if !claimMatches(value, expected) {
+			return fmt.Errorf("invalid value for claim: %s", name)
+		}
+	}
+	return nil
+}
+
+// claimMatches returns true when the claim is equal to the expected value,
+// or when the claim is a list containing the expected value.
+func claimMatches(value interface{}, expected string) bool {
+	if values, ok := value.([]interface{}); ok {
+		for _, v := range values {
+			if formatClaim(v) == expected {
+				return true
+			}
+		}
+		return false
+	}
+	return formatClaim(value) == expected
+}
+
+// lookupClaim returns a claim by name. Nested claims are accessed using dots.
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+	var current interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// formatClaim formats a claim value as a string. Lists are joined with commas,
+// and objects are encoded as JSON.
+func formatClaim(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = formatClaim(item)
+		}
+		return strings.Join(values, ",")
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
+
+// claimsReplacer returns a replacer mapper for token claims.
+func claimsReplacer(claims map[string]interface{}) func(key string) (any, bool) {
+	return func(key string) (any, bool) {
+		claimsPrefix := "jwt.claims."
+		if !strings.HasPrefix(key, claimsPrefix) {
+			return nil, false
+		}
+		value, ok := lookupClaim(claims, strings.TrimPrefix(key, claimsPrefix))
+		if !ok {
+			return nil, false
+		}
+		return formatClaim(value), true
+	}
+}
+
+// loadKeySet reads a JWKS from a local file.
+func loadKeySet(filename string) (*oidc.StaticKeySet, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks file: %s", err.Error())
+	}
+	jwks := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid jwks file: %s", err.Error())
+	}
+	keySet := &oidc.StaticKeySet{}
+	for _, key := range jwks.Keys {
+		if !key.Valid() || !key.IsPublic() {
+			return nil, fmt.Errorf("invalid jwks file: key %s is not a valid public key", key.KeyID)
+		}
+		keySet.PublicKeys = append(keySet.PublicKeys, crypto.PublicKey(key.Key))
+	}
+	if len(keySet.PublicKeys) == 0 {
+		return nil, errors.New("invalid jwks file: no key found")
+	}
+	return keySet, nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	jwt <issuer> {
+//		jwks_url <url>
+//		jwks_file <path>
+//		audiences <audiences...>
+//		algorithms <algorithms...>
+//		require <claim> [<value>]
+//		account <account>
+//		template {
+//			...
+//		}
+//	}
+func (c *JWTAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.Args(&c.Issuer) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "jwks_url":
+				if !d.AllArgs(&c.JWKSURL) {
+					return d.ArgErr()
+				}
+			case "jwks_file":
+				if !d.AllArgs(&c.JWKSFile) {
+					return d.ArgErr()
+				}
+			case "audiences":
+				audiences := d.RemainingArgs()
+				if len(audiences) == 0 {
+					return d.ArgErr()
+				}
+				c.Audiences = append(c.Audiences, audiences...)
+			case "algorithms":
+				algorithms := d.RemainingArgs()
+				if len(algorithms) == 0 {
+					return d.ArgErr()
+				}
+				c.Algorithms = append(c.Algorithms, algorithms...)
+			case "require":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				if c.RequiredClaims == nil {
+					c.RequiredClaims = map[string]string{}
+				}
+				c.RequiredClaims[args[0]] = ""
+				if len(args) == 2 {
+					c.RequiredClaims[args[0]] = args[1]
+				}
+			case "account":
+				if !d.AllArgs(&c.Account) {
+					return d.ArgErr()
+				}
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				c.Template = template
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*JWTAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*JWTAuthCallout)(nil)
+)
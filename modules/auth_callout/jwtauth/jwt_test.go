@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package jwtauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+// newTestIssuer writes a JWKS file and returns it with a function signing tokens.
+func newTestIssuer(t *testing.T) (string, func(claims map[string]interface{}) string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	content, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	return filename, sign
+}
+
+func newTestRequest(token string, password string) *modules.AuthorizationRequest {
+	request := authtest.NewRequest("APP")
+	request.Claims.ConnectOptions.Token = token
+	request.Claims.ConnectOptions.Password = password
+	return request
+}
+
+func TestJWTAuthCallout(t *testing.T) {
+	jwksFile, sign := newTestIssuer(t)
+	handler := &JWTAuthCallout{
+		logger:         zap.NewNop(),
+		Issuer:         "https://idp.example.com",
+		JWKSFile:       jwksFile,
+		Audiences:      []string{"nats"},
+		RequiredClaims: map[string]string{"realm_access.roles": "nats-user", "email": ""},
+		Account:        "{jwt.claims.tenant}",
+		Template:       &modules.Template{},
+	}
+	handler.Template.Permissions.Pub.Allow = jwt.StringList{"users.{jwt.claims.sub}.>"}
+	if err := handler.provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{
+		"iss":          "https://idp.example.com",
+		"aud":          []string{"nats", "other"},
+		"sub":          "alice",
+		"email":        "alice@example.com",
+		"tenant":       "APP",
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"realm_access": map[string]interface{}{"roles": []string{"nats-user", "admin"}},
+	}
+	// Token presented as connect opts token
+	user, err := handler.Handle(newTestRequest(sign(claims), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Audience != "APP" || user.Name != "alice" {
+		t.Fatalf("unexpected user claims: %+v", user)
+	}
+	if len(user.Permissions.Pub.Allow) != 1 || user.Permissions.Pub.Allow[0] != "users.alice.>" {
+		t.Fatalf("unexpected user permissions: %+v", user.Permissions)
+	}
+	// Token presented as password
+	if _, err := handler.Handle(newTestRequest("", sign(claims))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTAuthCalloutRejectsInvalidTokens(t *testing.T) {
+	jwksFile, sign := newTestIssuer(t)
+	_, signOther := newTestIssuer(t)
+	handler := &JWTAuthCallout{
+		logger:         zap.NewNop(),
+		Issuer:         "https://idp.example.com",
+		JWKSFile:       jwksFile,
+		Audiences:      []string{"nats"},
+		RequiredClaims: map[string]string{"groups": "nats"},
+		Account:        "APP",
+	}
+	if err := handler.provision(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    "nats",
+			"sub":    "alice",
+			"groups": []string{"nats"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	if _, err := handler.Handle(newTestRequest(sign(valid()), "")); err != nil {
+		t.Fatalf("expected valid token to be accepted: %s", err.Error())
+	}
+	// Username does not select the account
+	request := newTestRequest(sign(valid()), "")
+	request.Claims.ConnectOptions.Username = "SYS"
+	if user, err := handler.Handle(request); err != nil || user.Audience != "APP" {
+		t.Fatalf("expected configured account to be used: %+v, %v", user, err)
+	}
+	for name, token := range map[string]string{
+		"signature": signOther(valid()),
+		"issuer": func() string {
+			claims := valid()
+			claims["iss"] = "https://other.example.com"
+			return sign(claims)
+		}(),
+		"audience": func() string {
+			claims := valid()
+			claims["aud"] = "other"
+			return sign(claims)
+		}(),
+		"expiry": func() string {
+			claims := valid()
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return sign(claims)
+		}(),
+		"required claim": func() string {
+			claims := valid()
+			claims["groups"] = []string{"other"}
+			return sign(claims)
+		}(),
+		"missing token": "",
+	} {
+		if _, err := handler.Handle(newTestRequest(token, "")); err == nil {
+			t.Errorf("expected token to be rejected: %s", name)
+		}
+	}
+}
+
+func TestJWTAuthCalloutProvision(t *testing.T) {
+	jwksFile, _ := newTestIssuer(t)
+	for _, handler := range []*JWTAuthCallout{
+		{JWKSFile: jwksFile, Account: "APP"},
+		{Issuer: "https://idp.example.com", JWKSFile: jwksFile},
+		{Issuer: "https://idp.example.com", Account: "APP"},
+		{Issuer: "https://idp.example.com", JWKSFile: jwksFile, JWKSURL: "https://idp.example.com/jwks", Account: "APP"},
+		{Issuer: "https://idp.example.com", JWKSFile: filepath.Join(t.TempDir(), "missing.json"), Account: "APP"},
+	} {
+		if err := handler.provision(context.Background()); err == nil {
+			t.Errorf("expected an error for handler %+v", handler)
+		}
+	}
+}
+
+func TestJWTAuthCalloutUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`jwt https://idp.example.com {
+		jwks_url https://idp.example.com/jwks
+		audiences nats other
+		require email_verified true
+		require groups
+		account {jwt.claims.tenant}
+	}`)
+	handler := &JWTAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Issuer != "https://idp.example.com" || handler.JWKSURL != "https://idp.example.com/jwks" || len(handler.Audiences) != 2 {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	if handler.RequiredClaims["email_verified"] != "true" || handler.RequiredClaims["groups"] != "" || len(handler.RequiredClaims) != 2 {
+		t.Fatalf("unexpected required claims: %+v", handler.RequiredClaims)
+	}
+	if handler.Account != "{jwt.claims.tenant}" {
+		t.Fatalf("unexpected account: %s", handler.Account)
+	}
+}
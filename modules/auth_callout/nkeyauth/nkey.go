@@ -0,0 +1,306 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package nkeyauth
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(NkeyAuthCallout{})
+}
+
+// Key is an allowed user public key.
+// Account and template default to the handler account and template.
+type Key struct {
+	Account  string            `json:"account,omitempty"`
+	Template *modules.Template `json:"template,omitempty"`
+}
+
+// NkeyAuthCallout is a caddy module that implements the auth callout interface.
+// It is used to authenticate users connecting with an nkey.
+// It is configured in the "nats.auth_callout.nkey" namespace.
+// The signature of the server nonce found in connect options is verified against
+// the user public key, which must be one of the allowed keys. Allowed keys are
+// defined in config, or in files of a directory, where each line is "<public key> [<account>]".
+// Empty lines and lines starting with '#' are ignored. Files are read when the handler is provisioned.
+// The server is configured to always send a nonce to clients when this handler is used.
+// The user public key is available to templates as the {nats.nkey} placeholder.
+type NkeyAuthCallout struct {
+	logger    *zap.Logger
+	keys      map[string]*Key
+	Keys      map[string]*Key   `json:"keys,omitempty"`
+	Directory string            `json:"directory,omitempty"`
+	Account   string            `json:"account,omitempty"`
+	Template  *modules.Template `json:"template,omitempty"`
+}
+
+func (NkeyAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.nkey",
+		New: func() caddy.Module { return new(NkeyAuthCallout) },
+	}
+}
+
+// Provision sets up the auth callout handler.
+// It is called by the auth callout caddy module when the handler is loaded from config.
+// It should not be called directly by other modules.
+func (c *NkeyAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("nkey")
+	// Clients can only sign a nonce when the server sends one
+	app.Options.AlwaysEnableNonce = true
+	return c.provision()
+}
+
+// provision validates configured keys and loads keys from the directory.
+func (c *NkeyAuthCallout) provision() error {
+	c.keys = map[string]*Key{}
+	for publicKey, key := range c.Keys {
+		if !nkeys.IsValidPublicUserKey(publicKey) {
+			return fmt.Errorf("invalid user public key: %s", publicKey)
+		}
+		if key == nil {
+			key = &Key{}
+		}
+		c.keys[publicKey] = key
+	}
+	if c.Directory != "" {
+		if err := c.loadDirectory(); err != nil {
+			return err
+		}
+	}
+	if len(c.keys) == 0 {
+		return errors.New("nkey keys or directory is required")
+	}
+	return nil
+}
+
+// loadDirectory reads allowed keys from all regular files of the directory.
+func (c *NkeyAuthCallout) loadDirectory() error {
+	entries, err := os.ReadDir(c.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to read nkey directory: %s", err.Error())
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		filename := filepath.Join(c.Directory, entry.Name())
+		if err := c.loadFile(filename); err != nil {
+			return fmt.Errorf("invalid nkey file %s: %s", filename, err.Error())
+		}
+	}
+	return nil
+}
+
+// loadFile reads allowed keys from a file. Each line is "<public key> [<account>]".
+func (c *NkeyAuthCallout) loadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return fmt.Errorf("line %d: expected <public key> [<account>]", number)
+		}
+		if !nkeys.IsValidPublicUserKey(fields[0]) {
+			return fmt.Errorf("line %d: invalid user public key", number)
+		}
+		if _, ok := c.keys[fields[0]]; ok {
+			return fmt.Errorf("line %d: duplicate user public key %s", number, fields[0])
+		}
+		key := &Key{}
+		if len(fields) == 2 {
+			key.Account = fields[1]
+		}
+		c.keys[fields[0]] = key
+	}
+	return scanner.Err()
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+// The account for which the user is authenticated is the key account,
+// or the handler account when the key has no account.
+func (c *NkeyAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	publicKey := request.Claims.ConnectOptions.Nkey
+	if publicKey == "" {
+		return nil, errors.New("no nkey presented")
+	}
+	if err := verifySignature(publicKey, request.Claims.ClientInformation.Nonce, request.Claims.ConnectOptions.SignedNonce); err != nil {
+		return nil, err
+	}
+	key, ok := c.keys[publicKey]
+	if !ok {
+		return nil, errors.New("nkey not allowed")
+	}
+	// Add replacer for user public key
+	request.AddReplacerMapper(func(name string) (any, bool) {
+		if name == "nats.nkey" {
+			return publicKey, true
+		}
+		return nil, false
+	})
+	// Initialize user claims
+	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
+	userClaims.Name = publicKey
+	template := key.Template
+	if template == nil {
+		template = c.Template
+	}
+	if template != nil {
+		// Apply the template
+		template.Render(request, userClaims)
+	}
+	account := key.Account
+	if account == "" {
+		account = c.Account
+	}
+	// The target account must be specified as JWT audience
+	userClaims.Audience = request.ReplaceAll(account, "")
+	if userClaims.Audience == "" {
+		// If the target account is still empty, deny access
+		return nil, errors.New("no target account specified")
+	}
+	c.logger.Info("authenticated user", zap.String("nkey", publicKey), zap.String("account", userClaims.Audience))
+	return userClaims, nil
+}
+
+// verifySignature verifies the signature of the nonce by the user public key.
+// Signature is base64 url encoded, standard base64 encoding is accepted as fallback.
+func verifySignature(publicKey string, nonce string, signature string) error {
+	if nonce == "" {
+		return errors.New("no nonce issued by server")
+	}
+	if signature == "" {
+		return errors.New("nonce signature missing")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		sig, err = base64.StdEncoding.DecodeString(signature)
+		if err != nil {
+			return errors.New("nonce signature is not valid base64")
+		}
+	}
+	pub, err := nkeys.FromPublicKey(publicKey)
+	if err != nil || !nkeys.IsValidPublicUserKey(publicKey) {
+		return errors.New("invalid user public key")
+	}
+	if err := pub.Verify([]byte(nonce), sig); err != nil {
+		return errors.New("invalid nonce signature")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	nkey [<account>] {
+//		account <account>
+//		directory <path>
+//		template {
+//			...
+//		}
+//		key <public key> [<account>] {
+//			template {
+//				...
+//			}
+//		}
+//	}
+func (c *NkeyAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			c.Account = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "account":
+				if !d.AllArgs(&c.Account) {
+					return d.ArgErr()
+				}
+			case "directory":
+				if !d.AllArgs(&c.Directory) {
+					return d.ArgErr()
+				}
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				c.Template = template
+			case "key":
+				if err := c.parseKey(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseKey parses an allowed key block. Syntax:
+//
+//	key <public key> [<account>] {
+//		template {
+//			...
+//		}
+//	}
+func (c *NkeyAuthCallout) parseKey(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return d.ArgErr()
+	}
+	if _, ok := c.Keys[args[0]]; ok {
+		return d.Errf("duplicate key: %s", args[0])
+	}
+	key := &Key{}
+	if len(args) == 2 {
+		key.Account = args[1]
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "template":
+			template, err := modules.ParseTemplate(d)
+			if err != nil {
+				return err
+			}
+			key.Template = template
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	if c.Keys == nil {
+		c.Keys = map[string]*Key{}
+	}
+	c.Keys[args[0]] = key
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*NkeyAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*NkeyAuthCallout)(nil)
+)
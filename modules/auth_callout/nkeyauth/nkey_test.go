@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package nkeyauth
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"go.uber.org/zap"
+)
+
+func newTestUser(t *testing.T) (string, func(nonce string) string) {
+	t.Helper()
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := kp.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(nonce string) string {
+		sig, err := kp.Sign([]byte(nonce))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(sig)
+	}
+	return publicKey, sign
+}
+
+func newTestRequest(publicKey string, nonce string, signature string) *modules.AuthorizationRequest {
+	request := authtest.NewRequest("")
+	request.Claims.ConnectOptions.Nkey = publicKey
+	request.Claims.ConnectOptions.SignedNonce = signature
+	request.Claims.ClientInformation.Nonce = nonce
+	return request
+}
+
+func TestNkeyAuthCallout(t *testing.T) {
+	service, signService := newTestUser(t)
+	admin, signAdmin := newTestUser(t)
+	unknown, signUnknown := newTestUser(t)
+	handler := &NkeyAuthCallout{
+		logger:   zap.NewNop(),
+		Account:  "APP",
+		Template: &modules.Template{},
+		Keys: map[string]*Key{
+			service: nil,
+			admin:   {Account: "ADMIN"},
+		},
+	}
+	handler.Template.Permissions.Pub.Allow = jwt.StringList{"services.{nats.nkey}.>"}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest(service, "nonce", signService("nonce")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" || claims.Name != service {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if len(claims.Pub.Allow) != 1 || claims.Pub.Allow[0] != "services."+service+".>" {
+		t.Fatalf("unexpected publish permissions: %v", claims.Pub.Allow)
+	}
+	claims, err = handler.Handle(newTestRequest(admin, "nonce", signAdmin("nonce")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "ADMIN" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+	denied := map[string]*modules.AuthorizationRequest{
+		"unknown key":       newTestRequest(unknown, "nonce", signUnknown("nonce")),
+		"other nonce":       newTestRequest(service, "nonce", signService("other")),
+		"other key":         newTestRequest(service, "nonce", signAdmin("nonce")),
+		"missing signature": newTestRequest(service, "nonce", ""),
+		"missing nonce":     newTestRequest(service, "", signService("")),
+		"missing key":       newTestRequest("", "nonce", signService("nonce")),
+	}
+	for name, request := range denied {
+		if _, err := handler.Handle(request); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNkeyAuthCalloutDirectory(t *testing.T) {
+	service, signService := newTestUser(t)
+	admin, signAdmin := newTestUser(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "services"), []byte("# services\n"+service+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "admins"), []byte(admin+" ADMIN\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := &NkeyAuthCallout{logger: zap.NewNop(), Account: "APP", Directory: dir}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest(service, "nonce", signService("nonce")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+	claims, err = handler.Handle(newTestRequest(admin, "nonce", signAdmin("nonce")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "ADMIN" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+}
+
+func TestNkeyAuthCalloutInvalid(t *testing.T) {
+	service, _ := newTestUser(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "keys"), []byte(service+"\n"+service+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]*NkeyAuthCallout{
+		"no keys":           {},
+		"invalid key":       {Keys: map[string]*Key{"UABC": nil}},
+		"missing directory": {Directory: filepath.Join(t.TempDir(), "missing")},
+		"duplicate key":     {Directory: dir},
+	}
+	for name, handler := range invalid {
+		if err := handler.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNkeyAuthCalloutCaddyfile(t *testing.T) {
+	service, _ := newTestUser(t)
+	d := caddyfile.NewTestDispenser(`nkey APP {
+		directory /etc/nats/nkeys
+		key ` + service + ` SERVICES {
+			template {
+				publish allow >
+			}
+		}
+	}`)
+	handler := &NkeyAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Account != "APP" || handler.Directory != "/etc/nats/nkeys" {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	key := handler.Keys[service]
+	if key == nil || key.Account != "SERVICES" || key.Template == nil {
+		t.Fatalf("unexpected key: %+v", key)
+	}
+}
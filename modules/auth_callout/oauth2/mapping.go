@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package oauth2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+)
+
+const (
+	// MappingModeMerge merges the permissions of all mappings matching the user for the target account.
+	MappingModeMerge = "merge"
+	// MappingModeFirst uses the first mapping matching the user for the target account.
+	MappingModeFirst = "first"
+)
+
+// Mapping maps the members of OIDC groups or roles onto an account and permissions.
+// A mapping matches a user when the session claim (e.g. "groups" or "realm_access.roles")
+// contains one of the values of the mapping. Nested claims are accessed using dots.
+type Mapping struct {
+	Claim    string            `json:"claim,omitempty"`
+	Values   []string          `json:"values"`
+	Account  string            `json:"account"`
+	Template *modules.Template `json:"template,omitempty"`
+}
+
+// matches returns true when the session claims contain one of the values of the mapping.
+func (m *Mapping) matches(claims map[string]any) bool {
+	value, ok := lookupClaim(claims, m.Claim)
+	if !ok {
+		return false
+	}
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		for _, expected := range m.Values {
+			if s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provisionMappings validates the mappings of the handler.
+func (c *OAuth2ProxyAuthCallout) provisionMappings() error {
+	if len(c.Mappings) == 0 {
+		return nil
+	}
+	if c.Account != "" {
+		return errors.New("account and mappings are mutually exclusive")
+	}
+	switch c.MappingMode {
+	case "":
+		c.MappingMode = MappingModeMerge
+	case MappingModeMerge, MappingModeFirst:
+	default:
+		return fmt.Errorf("invalid mapping mode: %s", c.MappingMode)
+	}
+	for _, mapping := range c.Mappings {
+		if mapping.Claim == "" {
+			mapping.Claim = "groups"
+		}
+		if len(mapping.Values) == 0 {
+			return fmt.Errorf("mapping for claim %s has no values", mapping.Claim)
+		}
+		if mapping.Account == "" {
+			return fmt.Errorf("mapping for claim %s has no account", mapping.Claim)
+		}
+	}
+	return nil
+}
+
+// selectMappings selects the target account of the user and the mappings which apply,
+// among the mappings matching the session claims.
+// When the client requests an account (username in connect opts), only mappings for this
+// account are selected, and access is denied when no mapping allows the account.
+// Otherwise, the account of the first matching mapping is selected.
+func (c *OAuth2ProxyAuthCallout) selectMappings(request *modules.AuthorizationRequest, claims map[string]any) (string, []*Mapping, error) {
+	requested := request.Claims.ConnectOptions.Username
+	var selected []*Mapping
+	for _, mapping := range c.Mappings {
+		if !mapping.matches(claims) {
+			continue
+		}
+		account := request.ReplaceAll(mapping.Account, "")
+		if requested == "" {
+			requested = account
+		}
+		if account != requested {
+			continue
+		}
+		selected = append(selected, mapping)
+		if c.MappingMode == MappingModeFirst {
+			break
+		}
+	}
+	if len(selected) == 0 {
+		if requested == "" {
+			return "", nil, errors.New("no mapping matches user")
+		}
+		return "", nil, fmt.Errorf("account %s is not allowed for user", requested)
+	}
+	return requested, selected, nil
+}
+
+// applyMappings merges the claims rendered by the templates of the selected mappings into
+// user claims. Allow lists of mappings are combined, while restrictions accumulate: deny lists
+// are combined, source networks, connection types and times are intersected, and the lowest
+// limits are kept (see modules.MergeUserClaims).
+func applyMappings(request *modules.AuthorizationRequest, mappings []*Mapping, user *jwt.UserClaims) error {
+	for _, mapping := range mappings {
+		if mapping.Template == nil {
+			continue
+		}
+		rendered := jwt.NewUserClaims(user.Subject)
+		mapping.Template.Render(request, rendered)
+		if err := modules.MergeUserClaims(user, rendered, modules.MergeGrant); err != nil {
+			return fmt.Errorf("invalid mapping for claim %s: %s", mapping.Claim, err.Error())
+		}
+	}
+	return nil
+}
+
+// lookupClaim returns a claim by name. Nested claims are accessed using dots.
+func lookupClaim(claims map[string]any, name string) (any, bool) {
+	if value, ok := claims[name]; ok {
+		return value, true
+	}
+	var current any = claims
+	for _, key := range strings.Split(name, ".") {
+		object, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// parseMapping parses a mapping block. Syntax:
+//
+//	map <claim> <values...> {
+//		account <account>
+//		template {
+//			...
+//		}
+//	}
+//
+// The dispenser is expected to be positioned on the map token.
+func parseMapping(d *caddyfile.Dispenser) (*Mapping, error) {
+	mapping := &Mapping{}
+	if !d.Args(&mapping.Claim) {
+		return nil, d.ArgErr()
+	}
+	mapping.Values = d.RemainingArgs()
+	if len(mapping.Values) == 0 {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "account":
+			if !d.AllArgs(&mapping.Account) {
+				return nil, d.ArgErr()
+			}
+		case "template":
+			template, err := modules.ParseTemplate(d)
+			if err != nil {
+				return nil, err
+			}
+			mapping.Template = template
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return mapping, nil
+}
@@ -5,10 +5,13 @@ package oauth2
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/charbonnierg/caddy-nats/modules"
 	"github.com/charbonnierg/caddy-nats/oauthproxy"
+	"github.com/google/cel-go/cel"
 	"github.com/nats-io/jwt/v2"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"go.uber.org/zap"
@@ -22,14 +25,33 @@ func init() {
 // It is used to authenticate users using an oauth2 proxy.
 // It is configured in the "nats.auth_callout.oauth2" namespace.
 // It must be configured with an endpoint name, which must be defined in the oauth2 app.
-// This auth callout always expects the username to be the target account, and the password
-// to be the oauth2 session state (encrypted cookie string).
+// This auth callout always expects the password to be the oauth2 session state (encrypted cookie string).
+// The target account is either the configured Account, or the account of the Mappings matching
+// the user, and one of them is required.
+// User claims expire with the oauth2 session, minus ClockSkew, and never later than
+// MaxExpiry after they are issued, so that the NATS server disconnects clients whose
+// session expired. Sessions are not refreshed by the handler: refresh tokens may be rotated by
+// the identity provider, so sessions are only refreshed by the oauth2 middleware, and clients must
+// reconnect with their refreshed session.
+// When the endpoint session store persists sessions (e.g. jetstream or redis stores), clients are
+// disconnected when their session is deleted from the store (e.g. on sign-out).
+// When Mappings are configured, the target account and permissions are granted by the mappings
+// matching the groups or roles of the user, and users cannot select other accounts.
+// When a Condition is configured, the CEL expression is evaluated with the session claims
+// as the "claims" variable, and access is denied unless it evaluates to true.
 type OAuth2ProxyAuthCallout struct {
-	logger   *zap.Logger
-	endpoint *oauthproxy.Endpoint
-	Endpoint string            `json:"endpoint"`
-	Account  string            `json:"account,omitempty"`
-	Template *modules.Template `json:"template,omitempty"`
+	logger      *zap.Logger
+	endpoint    *oauthproxy.Endpoint
+	now         func() time.Time
+	condition   *modules.Expression
+	Endpoint    string            `json:"endpoint"`
+	Account     string            `json:"account,omitempty"`
+	Condition   string            `json:"condition,omitempty"`
+	Template    *modules.Template `json:"template,omitempty"`
+	MaxExpiry   time.Duration     `json:"max_expiry,omitempty"`
+	ClockSkew   time.Duration     `json:"clock_skew,omitempty"`
+	Mappings    []*Mapping        `json:"mappings,omitempty"`
+	MappingMode string            `json:"mapping_mode,omitempty"`
 }
 
 func (OAuth2ProxyAuthCallout) CaddyModule() caddy.ModuleInfo {
@@ -44,6 +66,9 @@ func (OAuth2ProxyAuthCallout) CaddyModule() caddy.ModuleInfo {
 // It should not be called directly by other modules.
 func (c *OAuth2ProxyAuthCallout) Provision(app *modules.App) error {
 	c.logger = app.Context().Logger().Named("oauth2")
+	if err := c.provision(); err != nil {
+		return err
+	}
 	// Load oauth2 app
 	oauthApp, err := oauthproxy.LoadApp(app.Context())
 	if err != nil {
@@ -55,13 +80,38 @@ func (c *OAuth2ProxyAuthCallout) Provision(app *modules.App) error {
 		return err
 	}
 	c.endpoint = endpoint
+	// Disconnect clients when their session is deleted from the session store
+	if endpoint.WatchesSessions() {
+		app.AddSessionSource(endpoint)
+	}
 	return nil
 }
 
+// provision validates the expiry options of the handler and compiles the condition.
+func (c *OAuth2ProxyAuthCallout) provision() error {
+	if c.MaxExpiry < 0 || c.ClockSkew < 0 {
+		return errors.New("max_expiry and clock_skew must not be negative")
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.Condition != "" {
+		condition, err := modules.CompileExpression(c.Condition, cel.BoolType)
+		if err != nil {
+			return err
+		}
+		c.condition = condition
+	}
+	if c.Account == "" && len(c.Mappings) == 0 {
+		return errors.New("oauth2 account or mappings are required")
+	}
+	return c.provisionMappings()
+}
+
 // Handle is called by auth callout caddy module to authenticate a user.
 // It returns either user claims or an error.
-// The account for which the user is authenticated is the username in connect opts.
-// This target account is set as Audience in the user claims as required auth_callout caddy module.
+// The account for which the user is authenticated is the configured account,
+// or the account selected by mappings. This target account is set as Audience in the user claims as required auth_callout caddy module.
 func (c *OAuth2ProxyAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
 	// Initialize user claims
 	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
@@ -70,15 +120,38 @@ func (c *OAuth2ProxyAuthCallout) Handle(request *modules.AuthorizationRequest) (
 	if err != nil {
 		return nil, errors.New("unable to decode session state")
 	}
+	// Remember the session of the client, if the session is persisted server side
+	if key, ok := c.endpoint.SessionKey(request.Claims.ConnectOptions.Password); ok {
+		request.SetSessionKey(key)
+	}
+	// User claims expire with the session
+	expires, err := c.expiresAt(sessionState.ExpiresOn)
+	if err != nil {
+		return nil, err
+	}
+	userClaims.Expires = expires
 	// Add replacers for session state
 	c.addSessionReplacerVars(request, sessionState)
+	// Make session claims available to expressions
+	identityClaims := c.sessionClaims(sessionState)
+	request.SetIdentityClaims(identityClaims)
+	// Check the condition against session claims
+	if err := c.checkCondition(request, identityClaims); err != nil {
+		c.logger.Warn("denied user", zap.String("email", sessionState.Email), zap.Error(err))
+		return nil, err
+	}
 	// Set target account
-	if c.Account != "" {
+	var mappings []*Mapping
+	if len(c.Mappings) > 0 {
+		// The target account must be allowed by mappings
+		userClaims.Audience, mappings, err = c.selectMappings(request, identityClaims)
+		if err != nil {
+			c.logger.Warn("denied user", zap.String("email", sessionState.Email), zap.Error(err))
+			return nil, err
+		}
+	} else {
 		// The target account must be specified as JWT audience
 		userClaims.Audience = request.ReplaceAll(c.Account, "")
-	} else {
-		// If not specified, the target account is the username
-		userClaims.Audience = request.Claims.ConnectOptions.Username
 	}
 	if userClaims.Audience == "" {
 		// If the target account is still empty, deny access
@@ -91,16 +164,64 @@ func (c *OAuth2ProxyAuthCallout) Handle(request *modules.AuthorizationRequest) (
 		// If no template is specified, set the email as user name
 		userClaims.Name = sessionState.Email
 	}
+	// Add permissions of mappings
+	if err := applyMappings(request, mappings, userClaims); err != nil {
+		c.logger.Warn("denied user", zap.String("email", sessionState.Email), zap.Error(err))
+		return nil, err
+	}
 	c.logger.Info("authenticated user", zap.String("email", sessionState.Email), zap.String("account", userClaims.Audience))
 	// And that's it, return user claims
 	return userClaims, nil
 }
 
+// checkCondition returns an error unless the condition evaluates to true for the session claims.
+func (c *OAuth2ProxyAuthCallout) checkCondition(request *modules.AuthorizationRequest, claims map[string]any) error {
+	if c.condition == nil {
+		return nil
+	}
+	var granted bool
+	if err := c.condition.Eval(request.Claims, claims, &granted); err != nil {
+		return err
+	}
+	if !granted {
+		return errors.New("oauth2 condition not satisfied")
+	}
+	return nil
+}
+
+// expiresAt returns the expiry of user claims (unix seconds) for a session expiring on
+// expiresOn, or an error if the session is expired. Zero means that claims do not expire.
+func (c *OAuth2ProxyAuthCallout) expiresAt(expiresOn *time.Time) (int64, error) {
+	now := c.now()
+	var expires time.Time
+	if expiresOn != nil && !expiresOn.IsZero() {
+		expires = expiresOn.Add(-c.ClockSkew)
+		if !expires.After(now) {
+			return 0, errors.New("session expired")
+		}
+	}
+	if c.MaxExpiry > 0 && (expires.IsZero() || expires.After(now.Add(c.MaxExpiry))) {
+		expires = now.Add(c.MaxExpiry)
+	}
+	if expires.IsZero() {
+		return 0, nil
+	}
+	return expires.Unix(), nil
+}
+
+// addSessionReplacerVars adds the {oidc.session.*} placeholders of the session to the request replacer.
+// The {oidc.session.provider} placeholder is the ID of the provider which issued the session,
+// and other placeholders are claims extracted from the session ID token or the provider profile URL.
 func (c *OAuth2ProxyAuthCallout) addSessionReplacerVars(request *modules.AuthorizationRequest, session *sessions.SessionState) {
+	providerID := ""
+	if provider, err := c.endpoint.SessionProvider(session); err != nil {
+		c.logger.Warn("unable to find session provider", zap.Error(err))
+	} else {
+		providerID = provider.ID
+	}
 	extractor, err := c.endpoint.GetOidcSessionClaimExtractor(session)
 	if err != nil {
 		c.logger.Error("unable to get oidc session claim extractor", zap.Error(err))
-		return
 	}
 	request.AddReplacerMapper(func(key string) (any, bool) {
 		oidcPrefix := "oidc.session."
@@ -108,6 +229,12 @@ func (c *OAuth2ProxyAuthCallout) addSessionReplacerVars(request *modules.Authori
 			return nil, false
 		}
 		claim := strings.TrimPrefix(key, oidcPrefix)
+		if claim == "provider" {
+			return providerID, providerID != ""
+		}
+		if extractor == nil {
+			return nil, false
+		}
 		value, ok, err := extractor.GetClaim(claim)
 		if err != nil {
 			c.logger.Warn("unable to extract oidc session claim", zap.String("claim", claim), zap.Error(err))
@@ -126,6 +253,106 @@ func (c *OAuth2ProxyAuthCallout) addSessionReplacerVars(request *modules.Authori
 	})
 }
 
+// sessionClaims returns the claims of the session ID token, along with the
+// email, user, groups and preferred_username of the session state.
+func (c *OAuth2ProxyAuthCallout) sessionClaims(session *sessions.SessionState) map[string]any {
+	claims := map[string]any{}
+	if session.IDToken != "" {
+		decoded, err := oauthproxy.DecodeIDTokenClaims(session.IDToken)
+		if err != nil {
+			c.logger.Warn("unable to decode id token claims", zap.Error(err))
+		} else {
+			claims = decoded
+		}
+	}
+	for name, value := range map[string]any{
+		"email":              session.Email,
+		"user":               session.User,
+		"preferred_username": session.PreferredUsername,
+	} {
+		if _, ok := claims[name]; !ok && value != "" {
+			claims[name] = value
+		}
+	}
+	if _, ok := claims["groups"]; !ok && session.Groups != nil {
+		groups := make([]any, len(session.Groups))
+		for idx, group := range session.Groups {
+			groups[idx] = group
+		}
+		claims["groups"] = groups
+	}
+	return claims
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	oauth2 <endpoint> {
+//		account <account>
+//		condition <expression>
+//		max_expiry <duration>
+//		clock_skew <duration>
+//		mapping_mode <merge|first>
+//		map <claim> <values...> {
+//			account <account>
+//			template {
+//				...
+//			}
+//		}
+//		template {
+//			...
+//		}
+//	}
+func (c *OAuth2ProxyAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.Args(&c.Endpoint) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "account":
+				if !d.AllArgs(&c.Account) {
+					return d.ArgErr()
+				}
+			case "condition":
+				if !d.AllArgs(&c.Condition) {
+					return d.ArgErr()
+				}
+			case "max_expiry":
+				if err := modules.ParseDuration(d, &c.MaxExpiry); err != nil {
+					return err
+				}
+			case "clock_skew":
+				if err := modules.ParseDuration(d, &c.ClockSkew); err != nil {
+					return err
+				}
+			case "mapping_mode":
+				if !d.AllArgs(&c.MappingMode) {
+					return d.ArgErr()
+				}
+			case "map":
+				mapping, err := parseMapping(d)
+				if err != nil {
+					return err
+				}
+				c.Mappings = append(c.Mappings, mapping)
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				c.Template = template
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
 var (
-	_ modules.AuthCallout = (*OAuth2ProxyAuthCallout)(nil)
+	_ modules.AuthCallout   = (*OAuth2ProxyAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*OAuth2ProxyAuthCallout)(nil)
 )
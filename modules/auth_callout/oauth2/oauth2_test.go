@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package oauth2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	inOneHour := now.Add(time.Hour)
+	inOneMinute := now.Add(time.Minute)
+	for name, test := range map[string]struct {
+		handler   *OAuth2ProxyAuthCallout
+		expiresOn *time.Time
+		expected  int64
+		err       bool
+	}{
+		"no expiry":               {&OAuth2ProxyAuthCallout{Account: "APP"}, nil, 0, false},
+		"session expiry":          {&OAuth2ProxyAuthCallout{Account: "APP"}, &inOneHour, inOneHour.Unix(), false},
+		"clock skew":              {&OAuth2ProxyAuthCallout{Account: "APP", ClockSkew: 30 * time.Second}, &inOneMinute, now.Add(30 * time.Second).Unix(), false},
+		"max expiry":              {&OAuth2ProxyAuthCallout{Account: "APP", MaxExpiry: 10 * time.Minute}, &inOneHour, now.Add(10 * time.Minute).Unix(), false},
+		"max expiry no session":   {&OAuth2ProxyAuthCallout{Account: "APP", MaxExpiry: 10 * time.Minute}, nil, now.Add(10 * time.Minute).Unix(), false},
+		"max expiry after expiry": {&OAuth2ProxyAuthCallout{Account: "APP", MaxExpiry: 10 * time.Minute}, &inOneMinute, inOneMinute.Unix(), false},
+		"expired with clock skew": {&OAuth2ProxyAuthCallout{Account: "APP", ClockSkew: 2 * time.Minute}, &inOneMinute, 0, true},
+	} {
+		if err := test.handler.provision(); err != nil {
+			t.Fatal(err)
+		}
+		test.handler.now = func() time.Time { return now }
+		expires, err := test.handler.expiresAt(test.expiresOn)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+		}
+		if expires != test.expected {
+			t.Errorf("%s: expected %d, got %d", name, test.expected, expires)
+		}
+	}
+	if err := (&OAuth2ProxyAuthCallout{Account: "APP", ClockSkew: -time.Second}).provision(); err == nil {
+		t.Error("expected error with negative clock skew")
+	}
+}
+
+func TestOAuth2ProxyAuthCalloutCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`oauth2 my-endpoint {
+		account APP
+		condition "claims.email_verified == true"
+		max_expiry 1h
+		clock_skew 30s
+	}`)
+	handler := &OAuth2ProxyAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Endpoint != "my-endpoint" || handler.Account != "APP" || handler.Condition != "claims.email_verified == true" {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	if handler.MaxExpiry != time.Hour || handler.ClockSkew != 30*time.Second {
+		t.Fatalf("unexpected expiry options: %+v", handler)
+	}
+}
+
+func TestCondition(t *testing.T) {
+	handler := &OAuth2ProxyAuthCallout{Account: "APP", Condition: "'nats-users' in claims.groups"}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	request := newMappingTestRequest("")
+	if err := handler.checkCondition(request, map[string]any{"groups": []any{"nats-users"}}); err != nil {
+		t.Fatalf("expected condition to be satisfied: %s", err.Error())
+	}
+	for name, claims := range map[string]map[string]any{
+		"other group":  {"groups": []any{"sales"}},
+		"no groups":    {},
+		"invalid type": {"groups": "nats-users"},
+	} {
+		if err := handler.checkCondition(request, claims); err == nil {
+			t.Errorf("%s: expected condition not to be satisfied", name)
+		}
+	}
+	if err := (&OAuth2ProxyAuthCallout{Account: "APP", Condition: "size(claims)"}).provision(); err == nil {
+		t.Error("expected error for non boolean condition")
+	}
+}
+
+func newMappingTestHandler(mode string) *OAuth2ProxyAuthCallout {
+	ops := &modules.Template{}
+	ops.Pub.Allow = jwt.StringList{"$JS.API.>"}
+	opsLimits := &modules.Template{}
+	opsLimits.Sub.Allow = jwt.StringList{"ops.>"}
+	opsLimits.Subs = 10
+	return &OAuth2ProxyAuthCallout{
+		MappingMode: mode,
+		Mappings: []*Mapping{
+			{Values: []string{"ops"}, Account: "OPS", Template: ops},
+			{Claim: "realm_access.roles", Values: []string{"admin", "oncall"}, Account: "OPS", Template: opsLimits},
+			{Values: []string{"dev"}, Account: "APP"},
+		},
+	}
+}
+
+func newMappingTestRequest(username string) *modules.AuthorizationRequest {
+	return authtest.NewRequest(username)
+}
+
+func TestMappings(t *testing.T) {
+	identity := map[string]any{
+		"groups":       []any{"dev", "ops"},
+		"realm_access": map[string]any{"roles": []any{"oncall"}},
+	}
+	for name, test := range map[string]struct {
+		mode      string
+		requested string
+		account   string
+		pubAllow  int
+		subAllow  int
+		subs      int64
+	}{
+		"merge":              {MappingModeMerge, "OPS", "OPS", 1, 1, 10},
+		"first":              {MappingModeFirst, "OPS", "OPS", 1, 0, jwt.NoLimit},
+		"first matching":     {MappingModeMerge, "", "OPS", 1, 1, 10},
+		"other account":      {MappingModeMerge, "APP", "APP", 0, 0, jwt.NoLimit},
+		"default merge mode": {"", "OPS", "OPS", 1, 1, 10},
+	} {
+		handler := newMappingTestHandler(test.mode)
+		if err := handler.provision(); err != nil {
+			t.Fatal(err)
+		}
+		request := newMappingTestRequest(test.requested)
+		account, mappings, err := handler.selectMappings(request, identity)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err.Error())
+		}
+		user := jwt.NewUserClaims("UABC")
+		if err := applyMappings(request, mappings, user); err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err.Error())
+		}
+		if account != test.account || len(user.Pub.Allow) != test.pubAllow || len(user.Sub.Allow) != test.subAllow || user.Subs != test.subs {
+			t.Errorf("%s: unexpected account %s and claims: %+v", name, account, user.Permissions)
+		}
+	}
+	handler := newMappingTestHandler("")
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := handler.selectMappings(newMappingTestRequest("SYS"), identity); err == nil {
+		t.Error("expected error for account not allowed")
+	}
+	if _, _, err := handler.selectMappings(newMappingTestRequest(""), map[string]any{"groups": []any{"sales"}}); err == nil {
+		t.Error("expected error when no mapping matches")
+	}
+	invalid := []*OAuth2ProxyAuthCallout{
+		{},
+		{Account: "APP", Mappings: []*Mapping{{Values: []string{"dev"}, Account: "APP"}}},
+		{MappingMode: "last", Mappings: []*Mapping{{Values: []string{"dev"}, Account: "APP"}}},
+		{Mappings: []*Mapping{{Values: []string{"dev"}}}},
+		{Mappings: []*Mapping{{Account: "APP"}}},
+	}
+	for idx, handler := range invalid {
+		if err := handler.provision(); err == nil {
+			t.Errorf("expected error for invalid handler %d", idx)
+		}
+	}
+}
+
+func TestApplyMappingsRestrictions(t *testing.T) {
+	office := &modules.Template{}
+	office.Pub.Allow = jwt.StringList{"office.>"}
+	office.Src = jwt.CIDRList{"10.0.0.0/8", "192.168.0.0/16"}
+	office.Locale = "Europe/Paris"
+	office.BearerToken = true
+	lan := &modules.Template{}
+	lan.Sub.Allow = jwt.StringList{"lan.>"}
+	lan.Src = jwt.CIDRList{"192.168.0.0/16"}
+	lan.AllowedConnectionTypes = jwt.StringList{jwt.ConnectionTypeWebsocket}
+	lan.Times = []jwt.TimeRange{{Start: "08:00:00", End: "18:00:00"}}
+	request := newMappingTestRequest("")
+	user := jwt.NewUserClaims("UABC")
+	mappings := []*Mapping{{Claim: "groups", Template: office}, {Claim: "groups", Template: lan}}
+	if err := applyMappings(request, mappings, user); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Pub.Allow) != 1 || len(user.Sub.Allow) != 1 {
+		t.Fatalf("unexpected permissions: %+v", user.Permissions)
+	}
+	if len(user.Src) != 1 || user.Src[0] != "192.168.0.0/16" || len(user.AllowedConnectionTypes) != 1 || len(user.Times) != 1 {
+		t.Fatalf("unexpected restrictions: %+v", user.UserPermissionLimits)
+	}
+	if user.Locale != "Europe/Paris" || user.BearerToken {
+		t.Fatalf("unexpected restrictions: %+v", user.UserPermissionLimits)
+	}
+	// Mappings restricting sources to different networks deny access
+	remote := &modules.Template{}
+	remote.Src = jwt.CIDRList{"172.16.0.0/12"}
+	mappings = append(mappings, &Mapping{Claim: "groups", Template: remote})
+	if err := applyMappings(request, mappings, jwt.NewUserClaims("UABC")); err == nil {
+		t.Error("expected error for mappings without common source network")
+	}
+}
+
+func TestMappingsCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`oauth2 my-endpoint {
+		mapping_mode first
+		map groups ops sre {
+			account OPS
+			template {
+				publish allow $JS.API.>
+			}
+		}
+		map realm_access.roles admin {
+			account SYS
+		}
+	}`)
+	handler := &OAuth2ProxyAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.MappingMode != MappingModeFirst || len(handler.Mappings) != 2 {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	ops := handler.Mappings[0]
+	if ops.Claim != "groups" || len(ops.Values) != 2 || ops.Account != "OPS" || ops.Template == nil || !ops.Template.Pub.Allow.Contains("$JS.API.>") {
+		t.Fatalf("unexpected mapping: %+v", ops)
+	}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+}
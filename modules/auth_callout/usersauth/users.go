@@ -0,0 +1,330 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package usersauth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	caddy.RegisterModule(UsersAuthCallout{})
+}
+
+// dummyHash is compared against passwords of unknown users,
+// so that unknown and known users take the same time to be rejected.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("caddy-nats"), bcrypt.DefaultCost)
+
+// User is a static user. Password is a bcrypt hash.
+// Account and template default to the handler account and template.
+type User struct {
+	Password string            `json:"password"`
+	Account  string            `json:"account,omitempty"`
+	Template *modules.Template `json:"template,omitempty"`
+}
+
+// UsersAuthCallout is a caddy module that implements the auth callout interface.
+// It is used to authenticate users against a static list of users with bcrypt passwords.
+// It is configured in the "nats.auth_callout.users" namespace.
+// Users are defined in config, or in an htpasswd-style file where each line is
+// "<user>:<bcrypt hash>[:<account>]". Empty lines and lines starting with '#' are ignored.
+// The file is reloaded when it changes on disk. When it cannot be reloaded,
+// users loaded previously are kept and the error is logged.
+type UsersAuthCallout struct {
+	logger   *zap.Logger
+	file     *usersFile
+	Users    map[string]*User  `json:"users,omitempty"`
+	File     string            `json:"file,omitempty"`
+	Account  string            `json:"account,omitempty"`
+	Template *modules.Template `json:"template,omitempty"`
+}
+
+// usersFile holds users loaded from the users file,
+// along with the file state used to detect changes.
+type usersFile struct {
+	mutex   sync.Mutex
+	path    string
+	users   map[string]*User
+	modTime time.Time
+	size    int64
+}
+
+func (UsersAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.users",
+		New: func() caddy.Module { return new(UsersAuthCallout) },
+	}
+}
+
+// Provision sets up the auth callout handler.
+// It is called by the auth callout caddy module when the handler is loaded from config.
+// It should not be called directly by other modules.
+func (c *UsersAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("users")
+	return c.provision()
+}
+
+// provision validates configured users and loads the users file.
+func (c *UsersAuthCallout) provision() error {
+	for name, user := range c.Users {
+		if err := validateUser(name, user); err != nil {
+			return err
+		}
+	}
+	if c.File == "" {
+		if len(c.Users) == 0 {
+			return errors.New("users or users file is required")
+		}
+		return nil
+	}
+	c.file = &usersFile{path: c.File}
+	info, err := os.Stat(c.File)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %s", err.Error())
+	}
+	return c.file.load(info)
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+// The account for which the user is authenticated is the user account,
+// or the handler account when the user has no account.
+func (c *UsersAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	username := request.Claims.ConnectOptions.Username
+	password := request.Claims.ConnectOptions.Password
+	user := c.lookup(username)
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errors.New("invalid username or password")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, errors.New("invalid username or password")
+	}
+	// Initialize user claims
+	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
+	userClaims.Name = username
+	template := user.Template
+	if template == nil {
+		template = c.Template
+	}
+	if template != nil {
+		// Apply the template
+		template.Render(request, userClaims)
+	}
+	account := user.Account
+	if account == "" {
+		account = c.Account
+	}
+	// The target account must be specified as JWT audience
+	userClaims.Audience = request.ReplaceAll(account, "")
+	if userClaims.Audience == "" {
+		// If the target account is still empty, deny access
+		return nil, errors.New("no target account specified")
+	}
+	c.logger.Info("authenticated user", zap.String("user", username), zap.String("account", userClaims.Audience))
+	return userClaims, nil
+}
+
+// lookup returns the user with given name, or nil when the user does not exist.
+// Users defined in config take precedence over users defined in the users file.
+// The users file is reloaded first when it changed since it was last loaded.
+func (c *UsersAuthCallout) lookup(name string) *User {
+	if user, ok := c.Users[name]; ok {
+		return user
+	}
+	if c.file == nil {
+		return nil
+	}
+	return c.file.lookup(c.logger, name)
+}
+
+// lookup returns the user with given name from the users file, or nil when the user does not exist.
+func (f *usersFile) lookup(logger *zap.Logger, name string) *User {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		logger.Error("failed to read users file", zap.String("file", f.path), zap.Error(err))
+	} else if !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+		if err := f.load(info); err != nil {
+			logger.Error("failed to reload users file", zap.String("file", f.path), zap.Error(err))
+		} else {
+			logger.Info("reloaded users file", zap.String("file", f.path), zap.Int("users", len(f.users)))
+		}
+	}
+	return f.users[name]
+}
+
+// load reads the users file. Users are only replaced when the whole file is valid.
+func (f *usersFile) load(info os.FileInfo) error {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %s", err.Error())
+	}
+	users, err := parseUsersFile(content)
+	if err != nil {
+		return fmt.Errorf("invalid users file: %s", err.Error())
+	}
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// parseUsersFile parses htpasswd-style content. Each line is "<user>:<bcrypt hash>[:<account>]".
+func parseUsersFile(content []byte) (map[string]*User, error) {
+	users := map[string]*User{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected <user>:<bcrypt hash>[:<account>]", number)
+		}
+		name := fields[0]
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %s", number, name)
+		}
+		user := &User{Password: fields[1]}
+		if len(fields) == 3 {
+			user.Account = fields[2]
+		}
+		if err := validateUser(name, user); err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err.Error())
+		}
+		users[name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// validateUser returns an error when user name is empty or password is not a bcrypt hash.
+func validateUser(name string, user *User) error {
+	if name == "" {
+		return errors.New("user name cannot be empty")
+	}
+	if user == nil {
+		return fmt.Errorf("user %s has no password", name)
+	}
+	if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+		return fmt.Errorf("user %s password is not a valid bcrypt hash", name)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	users [<file>] {
+//		file <path>
+//		account <account>
+//		template {
+//			...
+//		}
+//		user <name> <bcrypt hash> {
+//			account <account>
+//			template {
+//				...
+//			}
+//		}
+//	}
+func (c *UsersAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			c.File = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "file":
+				if !d.AllArgs(&c.File) {
+					return d.ArgErr()
+				}
+			case "account":
+				if !d.AllArgs(&c.Account) {
+					return d.ArgErr()
+				}
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				c.Template = template
+			case "user":
+				if err := c.parseUser(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseUser parses a user block. Syntax:
+//
+//	user <name> <bcrypt hash> {
+//		account <account>
+//		template {
+//			...
+//		}
+//	}
+func (c *UsersAuthCallout) parseUser(d *caddyfile.Dispenser) error {
+	var name string
+	user := &User{}
+	if !d.Args(&name, &user.Password) {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if _, ok := c.Users[name]; ok {
+		return d.Errf("duplicate user: %s", name)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "account":
+			if !d.AllArgs(&user.Account) {
+				return d.ArgErr()
+			}
+		case "template":
+			template, err := modules.ParseTemplate(d)
+			if err != nil {
+				return err
+			}
+			user.Template = template
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	if c.Users == nil {
+		c.Users = map[string]*User{}
+	}
+	c.Users[name] = user
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*UsersAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*UsersAuthCallout)(nil)
+)
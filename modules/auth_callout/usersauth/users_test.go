@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package usersauth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func newTestRequest(username string, password string) *modules.AuthorizationRequest {
+	request := authtest.NewRequest(username)
+	request.Claims.ConnectOptions.Password = password
+	return request
+}
+
+func TestUsersAuthCallout(t *testing.T) {
+	handler := &UsersAuthCallout{
+		logger:   zap.NewNop(),
+		Account:  "APP",
+		Template: &modules.Template{},
+		Users: map[string]*User{
+			"alice": {Password: newTestHash(t, "secret")},
+			"bob":   {Password: newTestHash(t, "other"), Account: "ADMIN", Template: &modules.Template{}},
+		},
+	}
+	handler.Template.Permissions.Pub.Allow = jwt.StringList{"users.{connect_opts.username}.>"}
+	handler.Users["bob"].Template.Permissions.Pub.Allow = jwt.StringList{">"}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest("alice", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" || claims.Name != "alice" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if len(claims.Pub.Allow) != 1 || claims.Pub.Allow[0] != "users.alice.>" {
+		t.Fatalf("unexpected publish permissions: %v", claims.Pub.Allow)
+	}
+	claims, err = handler.Handle(newTestRequest("bob", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "ADMIN" || len(claims.Pub.Allow) != 1 || claims.Pub.Allow[0] != ">" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if _, err := handler.Handle(newTestRequest("alice", "other")); err == nil {
+		t.Fatal("expected error for invalid password")
+	}
+	if _, err := handler.Handle(newTestRequest("carol", "secret")); err == nil {
+		t.Fatal("expected error for unknown user")
+	}
+}
+
+func TestUsersAuthCalloutFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users")
+	content := "# users\nalice:" + newTestHash(t, "secret") + "\n\nbob:" + newTestHash(t, "other") + ":ADMIN\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := &UsersAuthCallout{logger: zap.NewNop(), File: filename, Account: "APP"}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest("alice", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+	claims, err = handler.Handle(newTestRequest("bob", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "ADMIN" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+	// Replace the file, alice is removed and carol is added
+	content = "carol:" + newTestHash(t, "third") + "\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Second)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(newTestRequest("carol", "third")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(newTestRequest("alice", "secret")); err == nil {
+		t.Fatal("expected error for removed user")
+	}
+	// An invalid file is ignored and previous users are kept
+	if err := os.WriteFile(filename, []byte("carol:not-a-hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(time.Second)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(newTestRequest("carol", "third")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsersAuthCalloutInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(filename, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]*UsersAuthCallout{
+		"no users":       {},
+		"plain password": {Users: map[string]*User{"alice": {Password: "secret"}}},
+		"missing file":   {File: filepath.Join(t.TempDir(), "missing")},
+		"invalid file":   {File: filename},
+	}
+	for name, handler := range invalid {
+		if err := handler.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := parseUsersFile([]byte("alice:" + newTestHash(t, "a") + "\nalice:" + newTestHash(t, "b"))); err == nil {
+		t.Error("expected error for duplicate user")
+	}
+}
+
+func TestUsersAuthCalloutCaddyfile(t *testing.T) {
+	hash := newTestHash(t, "secret")
+	d := caddyfile.NewTestDispenser(`users /etc/nats/users {
+		account APP
+		user alice ` + hash + ` {
+			account ADMIN
+			template {
+				publish allow >
+			}
+		}
+	}`)
+	handler := &UsersAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.File != "/etc/nats/users" || handler.Account != "APP" {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	alice := handler.Users["alice"]
+	if alice == nil || alice.Password != hash || alice.Account != "ADMIN" || alice.Template == nil {
+		t.Fatalf("unexpected user: %+v", alice)
+	}
+	if len(alice.Template.Permissions.Pub.Allow) != 1 || alice.Template.Permissions.Pub.Allow[0] != ">" {
+		t.Fatalf("unexpected template: %+v", alice.Template)
+	}
+}
@@ -0,0 +1,339 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(WebhookAuthCallout{})
+}
+
+const (
+	defaultTimeout       = 2 * time.Second
+	defaultRetryInterval = 100 * time.Millisecond
+	// maxResponseSize is the maximum size of a webhook response body.
+	maxResponseSize = 1 << 20
+)
+
+// errDenied is returned when the webhook explicitly denies access.
+// Denied requests are never retried.
+var errDenied = errors.New("access denied")
+
+// TLSConfig is the TLS configuration used to connect to the webhook.
+// CAFile replaces system roots when set. CertFile and KeyFile
+// are the client certificate and key used for mutual TLS.
+type TLSConfig struct {
+	CAFile     string `json:"ca_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// Response is the JSON response expected from the webhook.
+// Access is granted when the webhook responds with a 2xx status code,
+// no error and an account. Expires is a unix timestamp in seconds.
+// Limits which are not defined in the response are not limited.
+type Response struct {
+	Error       string          `json:"error,omitempty"`
+	Account     string          `json:"account"`
+	Name        string          `json:"name,omitempty"`
+	Permissions jwt.Permissions `json:"permissions,omitempty"`
+	Limits      jwt.Limits      `json:"limits,omitempty"`
+	Expires     int64           `json:"expires,omitempty"`
+}
+
+// WebhookAuthCallout is a caddy module that implements the auth callout interface.
+// It is used to delegate authorization decisions to an HTTP service.
+// It is configured in the "nats.auth_callout.webhook" namespace.
+// Authorization request claims (client info, connect options, TLS info) are sent
+// as JSON in a POST request, and the webhook responds with a Response.
+// Requests failing with a network error or a 5xx or 429 status code are retried.
+// Header values may use placeholders such as {secrets.<name>}.
+type WebhookAuthCallout struct {
+	logger        *zap.Logger
+	client        *http.Client
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Timeout       time.Duration     `json:"timeout,omitempty"`
+	Retries       int               `json:"retries,omitempty"`
+	RetryInterval time.Duration     `json:"retry_interval,omitempty"`
+	TLS           *TLSConfig        `json:"tls,omitempty"`
+}
+
+func (WebhookAuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.webhook",
+		New: func() caddy.Module { return new(WebhookAuthCallout) },
+	}
+}
+
+// Provision sets up the auth callout handler.
+// It is called by the auth callout caddy module when the handler is loaded from config.
+// It should not be called directly by other modules.
+func (c *WebhookAuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("webhook")
+	return c.provision()
+}
+
+// provision validates the configuration and creates the HTTP client.
+func (c *WebhookAuthCallout) provision() error {
+	if c.URL == "" {
+		return errors.New("webhook url is required")
+	}
+	target, err := url.Parse(c.URL)
+	if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return fmt.Errorf("invalid webhook url: %s", c.URL)
+	}
+	if c.Retries < 0 {
+		return errors.New("webhook retries cannot be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.TLS != nil {
+		if target.Scheme != "https" {
+			return errors.New("webhook tls requires an https url")
+		}
+		tlsConfig, err := c.TLS.newConfig()
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	c.client = &http.Client{Transport: transport, Timeout: c.Timeout}
+	return nil
+}
+
+// newConfig creates a TLS client configuration.
+func (t *TLSConfig) newConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName, MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		content, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook ca file: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, errors.New("invalid webhook ca file: no certificate found")
+		}
+		config.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("webhook tls cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load webhook client certificate: %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+// The account for which the user is authenticated is the account in the webhook response.
+func (c *WebhookAuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	body, err := json.Marshal(request.Claims)
+	if err != nil {
+		return nil, errors.New("unable to encode authorization request")
+	}
+	// Initialize user claims, default limits are kept unless overridden by the response
+	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
+	response := &Response{Limits: userClaims.Limits}
+	for attempt := 0; ; attempt++ {
+		err = c.post(request, body, response)
+		if err == nil || errors.Is(err, errDenied) || attempt >= c.Retries {
+			break
+		}
+		c.logger.Warn("webhook request failed", zap.Int("attempt", attempt+1), zap.Error(err))
+		select {
+		case <-request.Context.Done():
+			return nil, request.Context.Err()
+		case <-time.After(c.RetryInterval):
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.Account == "" {
+		// If the target account is empty, deny access
+		return nil, errors.New("no target account specified")
+	}
+	userClaims.Audience = response.Account
+	userClaims.Name = response.Name
+	userClaims.Permissions = response.Permissions
+	userClaims.Limits = response.Limits
+	userClaims.Expires = response.Expires
+	c.logger.Info("authenticated user", zap.String("name", response.Name), zap.String("account", response.Account))
+	return userClaims, nil
+}
+
+// post sends the authorization request to the webhook and decodes the response.
+// It returns errDenied when the webhook denies access.
+func (c *WebhookAuthCallout) post(request *modules.AuthorizationRequest, body []byte, response *Response) error {
+	ctx, cancel := context.WithTimeout(request.Context, c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range c.Headers {
+		req.Header.Set(name, request.ReplaceAll(value, ""))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("unexpected webhook status: %d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%w: webhook status %d", errDenied, resp.StatusCode)
+	}
+	if err := json.Unmarshal(content, response); err != nil {
+		return fmt.Errorf("%w: invalid webhook response", errDenied)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("%w: %s", errDenied, response.Error)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	webhook <url> {
+//		header <name> <value>
+//		timeout <duration>
+//		retries <retries>
+//		retry_interval <duration>
+//		tls {
+//			ca_file <path>
+//			cert_file <path>
+//			key_file <path>
+//			server_name <name>
+//		}
+//	}
+func (c *WebhookAuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.Args(&c.URL) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "header":
+				var name, value string
+				if !d.AllArgs(&name, &value) {
+					return d.ArgErr()
+				}
+				if c.Headers == nil {
+					c.Headers = map[string]string{}
+				}
+				c.Headers[name] = value
+			case "timeout":
+				if err := modules.ParseDuration(d, &c.Timeout); err != nil {
+					return err
+				}
+			case "retries":
+				var retries string
+				if !d.AllArgs(&retries) {
+					return d.ArgErr()
+				}
+				value, err := strconv.Atoi(retries)
+				if err != nil {
+					return d.Errf("invalid retries: %s", retries)
+				}
+				c.Retries = value
+			case "retry_interval":
+				if err := modules.ParseDuration(d, &c.RetryInterval); err != nil {
+					return err
+				}
+			case "tls":
+				if err := c.parseTLS(d); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseTLS parses the webhook TLS block. Syntax:
+//
+//	tls {
+//		ca_file <path>
+//		cert_file <path>
+//		key_file <path>
+//		server_name <name>
+//	}
+func (c *WebhookAuthCallout) parseTLS(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	c.TLS = &TLSConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ca_file":
+			if !d.AllArgs(&c.TLS.CAFile) {
+				return d.ArgErr()
+			}
+		case "cert_file":
+			if !d.AllArgs(&c.TLS.CertFile) {
+				return d.ArgErr()
+			}
+		case "key_file":
+			if !d.AllArgs(&c.TLS.KeyFile) {
+				return d.ArgErr()
+			}
+		case "server_name":
+			if !d.AllArgs(&c.TLS.ServerName) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.AuthCallout   = (*WebhookAuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*WebhookAuthCallout)(nil)
+)
@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func newTestRequest(username string) *modules.AuthorizationRequest {
+	request := authtest.NewRequest(username)
+	request.Claims.ConnectOptions.Password = "secret"
+	request.Claims.ClientInformation.Host = "127.0.0.1"
+	return request
+}
+
+// newTestWebhook returns a handler which authorizes user "alice" and denies any other user.
+func newTestWebhook(t *testing.T) http.HandlerFunc {
+	t.Helper()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		request := jwt.AuthorizationRequestClaims{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.ConnectOptions.Username != "alice" || request.ClientInformation.Host != "127.0.0.1" {
+			json.NewEncoder(w).Encode(Response{Error: "unknown user"})
+			return
+		}
+		response := Response{Account: "APP", Name: request.ConnectOptions.Username, Expires: 4102444800}
+		response.Permissions.Pub.Allow = jwt.StringList{"users.alice.>"}
+		response.Limits.Payload = 1024
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func TestWebhookAuthCallout(t *testing.T) {
+	server := httptest.NewServer(newTestWebhook(t))
+	defer server.Close()
+	handler := &WebhookAuthCallout{
+		logger:  zap.NewNop(),
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "APP" || claims.Name != "alice" || claims.Expires != 4102444800 {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if len(claims.Pub.Allow) != 1 || claims.Pub.Allow[0] != "users.alice.>" {
+		t.Fatalf("unexpected publish permissions: %v", claims.Pub.Allow)
+	}
+	// Limits which are not in the response keep their default value
+	if claims.Limits.Payload != 1024 || claims.Limits.Subs != jwt.NoLimit || claims.Limits.Data != jwt.NoLimit {
+		t.Fatalf("unexpected limits: %+v", claims.Limits)
+	}
+	if _, err := handler.Handle(newTestRequest("bob")); err == nil {
+		t.Fatal("expected error for denied user")
+	}
+	handler.Headers = nil
+	if _, err := handler.Handle(newTestRequest("alice")); err == nil {
+		t.Fatal("expected error for unauthorized request")
+	}
+}
+
+func TestWebhookAuthCalloutRetries(t *testing.T) {
+	var calls int32
+	webhook := newTestWebhook(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		webhook(w, r)
+	}))
+	defer server.Close()
+	handler := &WebhookAuthCallout{
+		logger:        zap.NewNop(),
+		URL:           server.URL,
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		Retries:       1,
+		RetryInterval: time.Millisecond,
+	}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(newTestRequest("alice")); err == nil {
+		t.Fatal("expected error when retries are exhausted")
+	}
+	if _, err := handler.Handle(newTestRequest("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("unexpected number of calls: %d", calls)
+	}
+	// Denied requests are not retried
+	if _, err := handler.Handle(newTestRequest("bob")); err == nil {
+		t.Fatal("expected error for denied user")
+	}
+	if calls != 4 {
+		t.Fatalf("unexpected number of calls: %d", calls)
+	}
+}
+
+func TestWebhookAuthCalloutMutualTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "nats" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		newTestWebhook(t)(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+	certFile, keyFile := newTestClientCertificate(t, dir)
+	handler := &WebhookAuthCallout{
+		logger:  zap.NewNop(),
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		TLS:     &TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+	}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(newTestRequest("alice")); err != nil {
+		t.Fatal(err)
+	}
+	handler.TLS = &TLSConfig{CAFile: caFile}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(newTestRequest("alice")); err == nil {
+		t.Fatal("expected error without client certificate")
+	}
+}
+
+func TestWebhookAuthCalloutInvalid(t *testing.T) {
+	invalid := map[string]*WebhookAuthCallout{
+		"no url":           {},
+		"invalid url":      {URL: "ftp://example.com"},
+		"negative retries": {URL: "http://example.com", Retries: -1},
+		"tls over http":    {URL: "http://example.com", TLS: &TLSConfig{}},
+		"missing key":      {URL: "https://example.com", TLS: &TLSConfig{CertFile: "cert.pem"}},
+		"missing ca":       {URL: "https://example.com", TLS: &TLSConfig{CAFile: filepath.Join(t.TempDir(), "ca.pem")}},
+	}
+	for name, handler := range invalid {
+		if err := handler.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestWebhookAuthCalloutCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`webhook https://auth.example.com/nats {
+		header Authorization "Bearer {secrets.webhook}"
+		timeout 5s
+		retries 2
+		retry_interval 500ms
+		tls {
+			ca_file /etc/nats/ca.pem
+			cert_file /etc/nats/cert.pem
+			key_file /etc/nats/key.pem
+			server_name auth.internal
+		}
+	}`)
+	handler := &WebhookAuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.URL != "https://auth.example.com/nats" || handler.Headers["Authorization"] != "Bearer {secrets.webhook}" {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	if handler.Timeout != 5*time.Second || handler.Retries != 2 || handler.RetryInterval != 500*time.Millisecond {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	expected := TLSConfig{CAFile: "/etc/nats/ca.pem", CertFile: "/etc/nats/cert.pem", KeyFile: "/etc/nats/key.pem", ServerName: "auth.internal"}
+	if handler.TLS == nil || *handler.TLS != expected {
+		t.Fatalf("unexpected tls: %+v", handler.TLS)
+	}
+}
+
+// newTestClientCertificate writes a self-signed client certificate and key, and returns their paths.
+func newTestClientCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nats"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, filename string, blockType string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,431 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package x509auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddypki"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(X509AuthCallout{})
+}
+
+// Mapping maps client certificates onto an account and a template.
+// Patterns support shell wildcards (e.g. "spiffe://example.org/devices/*").
+// All patterns which are set must match. URI, DNS and SPIFFE ID patterns
+// match when at least one subject alternative name matches.
+// Account and template default to the handler account and template.
+type Mapping struct {
+	SubjectCN string            `json:"subject_cn,omitempty"`
+	SubjectO  string            `json:"subject_o,omitempty"`
+	SubjectOU string            `json:"subject_ou,omitempty"`
+	URI       string            `json:"uri,omitempty"`
+	DNS       string            `json:"dns,omitempty"`
+	SPIFFEID  string            `json:"spiffe_id,omitempty"`
+	Account   string            `json:"account,omitempty"`
+	Template  *modules.Template `json:"template,omitempty"`
+}
+
+// X509AuthCallout is a caddy module that implements the auth callout interface.
+// It is used to authenticate users presenting a TLS client certificate.
+// It is configured in the "nats.auth_callout.x509" namespace.
+// By default, the certificate must have been verified by the NATS server.
+// When CA or CAFile is set, the certificate is verified against the root certificate
+// of the caddy PKI certificate authority, or against the certificates of the CA file.
+// Certificates are mapped onto accounts and templates using the first matching mapping.
+// When no mapping is configured, all certificates are accepted.
+// Certificate fields are available to templates as {nats.tls.*} placeholders:
+// subject, subject.cn, subject.o, subject.ou, issuer, issuer.cn, serial, fingerprint,
+// san.uri, san.dns, san.email and spiffe_id. Values are joined with commas.
+type X509AuthCallout struct {
+	logger        *zap.Logger
+	roots         *x509.CertPool
+	intermediates []*x509.Certificate
+	CA            string            `json:"ca,omitempty"`
+	CAFile        string            `json:"ca_file,omitempty"`
+	Mappings      []*Mapping        `json:"mappings,omitempty"`
+	Account       string            `json:"account,omitempty"`
+	Template      *modules.Template `json:"template,omitempty"`
+}
+
+func (X509AuthCallout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.auth_callout.x509",
+		New: func() caddy.Module { return new(X509AuthCallout) },
+	}
+}
+
+// Provision sets up the auth callout handler.
+// It is called by the auth callout caddy module when the handler is loaded from config.
+// It should not be called directly by other modules.
+func (c *X509AuthCallout) Provision(app *modules.App) error {
+	c.logger = app.Context().Logger().Named("x509")
+	ctx := app.Context()
+	switch {
+	case c.CA != "" && c.CAFile != "":
+		return errors.New("x509 ca and ca_file cannot be set at the same time")
+	case c.CA != "":
+		unm, err := ctx.App("pki")
+		if err != nil {
+			return errors.New("failed to get pki app")
+		}
+		pki, ok := unm.(*caddypki.PKI)
+		if !ok {
+			return errors.New("pki app invalid type")
+		}
+		ca, err := pki.GetCA(ctx, c.CA)
+		if err != nil {
+			return err
+		}
+		c.roots = x509.NewCertPool()
+		c.roots.AddCert(ca.RootCertificate())
+		c.intermediates = []*x509.Certificate{ca.IntermediateCertificate()}
+	}
+	return c.provision()
+}
+
+// provision loads the CA file and validates mappings.
+func (c *X509AuthCallout) provision() error {
+	if c.CAFile != "" {
+		content, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read x509 ca file: %s", err.Error())
+		}
+		certs, err := parseCertificates(content)
+		if err != nil || len(certs) == 0 {
+			return errors.New("invalid x509 ca file: no certificate found")
+		}
+		c.roots = x509.NewCertPool()
+		for _, cert := range certs {
+			c.roots.AddCert(cert)
+		}
+	}
+	for _, mapping := range c.Mappings {
+		for _, pattern := range []string{mapping.SubjectCN, mapping.SubjectO, mapping.SubjectOU, mapping.URI, mapping.DNS, mapping.SPIFFEID} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid x509 mapping pattern: %s", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Handle is called by auth callout caddy module to authenticate a user.
+// It returns either user claims or an error.
+// The account for which the user is authenticated is the account of the first matching mapping,
+// or the handler account when the mapping has no account.
+func (c *X509AuthCallout) Handle(request *modules.AuthorizationRequest) (*jwt.UserClaims, error) {
+	cert, err := c.certificate(request.Claims.TLS)
+	if err != nil {
+		return nil, err
+	}
+	account := c.Account
+	template := c.Template
+	if len(c.Mappings) > 0 {
+		mapping := c.match(cert)
+		if mapping == nil {
+			return nil, errors.New("no mapping found for client certificate")
+		}
+		if mapping.Account != "" {
+			account = mapping.Account
+		}
+		if mapping.Template != nil {
+			template = mapping.Template
+		}
+	}
+	// Add replacers for certificate fields
+	request.AddReplacerMapper(certificateReplacer(cert))
+	// Initialize user claims
+	userClaims := jwt.NewUserClaims(request.Claims.UserNkey)
+	userClaims.Name = cert.Subject.CommonName
+	if id := spiffeID(cert); id != "" {
+		userClaims.Name = id
+	}
+	if template != nil {
+		// Apply the template
+		template.Render(request, userClaims)
+	}
+	// The target account must be specified as JWT audience
+	userClaims.Audience = request.ReplaceAll(account, "")
+	if userClaims.Audience == "" {
+		// If the target account is still empty, deny access
+		return nil, errors.New("no target account specified")
+	}
+	c.logger.Info("authenticated user", zap.String("subject", cert.Subject.String()), zap.String("account", userClaims.Audience))
+	return userClaims, nil
+}
+
+// certificate returns the client certificate. When no CA is configured, the certificate
+// must have been verified by the NATS server. Otherwise it is verified against the CA.
+func (c *X509AuthCallout) certificate(info *jwt.ClientTLS) (*x509.Certificate, error) {
+	if info == nil {
+		return nil, errors.New("no client certificate presented")
+	}
+	// Peer certificates are only sent by the server when they could not be verified
+	chain := info.Certs
+	if len(info.VerifiedChains) > 0 {
+		chain = info.VerifiedChains[0]
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no client certificate presented")
+	}
+	if c.roots == nil && len(info.VerifiedChains) == 0 {
+		return nil, errors.New("client certificate not verified")
+	}
+	certs, err := parseCertificates([]byte(strings.Join(chain, "")))
+	if err != nil || len(certs) == 0 {
+		return nil, errors.New("invalid client certificate")
+	}
+	if c.roots == nil {
+		return certs[0], nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range c.intermediates {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("client certificate not verified: %s", err.Error())
+	}
+	return certs[0], nil
+}
+
+// match returns the first mapping matching the certificate, or nil when no mapping matches.
+func (c *X509AuthCallout) match(cert *x509.Certificate) *Mapping {
+	uris := make([]string, len(cert.URIs))
+	for i, uri := range cert.URIs {
+		uris[i] = uri.String()
+	}
+	spiffeIDs := []string{}
+	if id := spiffeID(cert); id != "" {
+		spiffeIDs = append(spiffeIDs, id)
+	}
+	for _, mapping := range c.Mappings {
+		if matchAny(mapping.SubjectCN, []string{cert.Subject.CommonName}) &&
+			matchAny(mapping.SubjectO, cert.Subject.Organization) &&
+			matchAny(mapping.SubjectOU, cert.Subject.OrganizationalUnit) &&
+			matchAny(mapping.URI, uris) &&
+			matchAny(mapping.DNS, cert.DNSNames) &&
+			matchAny(mapping.SPIFFEID, spiffeIDs) {
+			return mapping
+		}
+	}
+	return nil
+}
+
+// matchAny returns true when pattern is empty, or when at least one value matches the pattern.
+func matchAny(pattern string, values []string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, value := range values {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// spiffeID returns the SPIFFE ID of the certificate, which is its first URI SAN
+// using the spiffe scheme, or an empty string.
+func spiffeID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// certificateReplacer returns a replacer mapper for certificate fields.
+func certificateReplacer(cert *x509.Certificate) func(key string) (any, bool) {
+	return func(key string) (any, bool) {
+		tlsPrefix := "nats.tls."
+		if !strings.HasPrefix(key, tlsPrefix) {
+			return nil, false
+		}
+		switch strings.TrimPrefix(key, tlsPrefix) {
+		case "subject":
+			return cert.Subject.String(), true
+		case "subject.cn":
+			return cert.Subject.CommonName, true
+		case "subject.o":
+			return strings.Join(cert.Subject.Organization, ","), true
+		case "subject.ou":
+			return strings.Join(cert.Subject.OrganizationalUnit, ","), true
+		case "issuer":
+			return cert.Issuer.String(), true
+		case "issuer.cn":
+			return cert.Issuer.CommonName, true
+		case "serial":
+			return cert.SerialNumber.String(), true
+		case "fingerprint":
+			sum := sha256.Sum256(cert.Raw)
+			return hex.EncodeToString(sum[:]), true
+		case "san.uri":
+			uris := make([]string, len(cert.URIs))
+			for i, uri := range cert.URIs {
+				uris[i] = uri.String()
+			}
+			return strings.Join(uris, ","), true
+		case "san.dns":
+			return strings.Join(cert.DNSNames, ","), true
+		case "san.email":
+			return strings.Join(cert.EmailAddresses, ","), true
+		case "spiffe_id":
+			return spiffeID(cert), true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// parseCertificates parses all PEM encoded certificates.
+func parseCertificates(content []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	x509 [<account>] {
+//		ca <pki ca id>
+//		ca_file <path>
+//		account <account>
+//		template {
+//			...
+//		}
+//		map {
+//			...
+//		}
+//	}
+func (c *X509AuthCallout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			c.Account = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "ca":
+				if !d.AllArgs(&c.CA) {
+					return d.ArgErr()
+				}
+			case "ca_file":
+				if !d.AllArgs(&c.CAFile) {
+					return d.ArgErr()
+				}
+			case "account":
+				if !d.AllArgs(&c.Account) {
+					return d.ArgErr()
+				}
+			case "template":
+				template, err := modules.ParseTemplate(d)
+				if err != nil {
+					return err
+				}
+				c.Template = template
+			case "map":
+				mapping, err := parseMapping(d)
+				if err != nil {
+					return err
+				}
+				c.Mappings = append(c.Mappings, mapping)
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseMapping parses a certificate mapping block. Syntax:
+//
+//	map {
+//		subject_cn <pattern>
+//		subject_o <pattern>
+//		subject_ou <pattern>
+//		uri <pattern>
+//		dns <pattern>
+//		spiffe_id <pattern>
+//		account <account>
+//		template {
+//			...
+//		}
+//	}
+func parseMapping(d *caddyfile.Dispenser) (*Mapping, error) {
+	mapping := &Mapping{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var dest *string
+		switch d.Val() {
+		case "subject_cn":
+			dest = &mapping.SubjectCN
+		case "subject_o":
+			dest = &mapping.SubjectO
+		case "subject_ou":
+			dest = &mapping.SubjectOU
+		case "uri":
+			dest = &mapping.URI
+		case "dns":
+			dest = &mapping.DNS
+		case "spiffe_id":
+			dest = &mapping.SPIFFEID
+		case "account":
+			dest = &mapping.Account
+		case "template":
+			template, err := modules.ParseTemplate(d)
+			if err != nil {
+				return nil, err
+			}
+			mapping.Template = template
+			continue
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+		if !d.AllArgs(dest) {
+			return nil, d.ArgErr()
+		}
+	}
+	return mapping, nil
+}
+
+var (
+	_ modules.AuthCallout   = (*X509AuthCallout)(nil)
+	_ caddyfile.Unmarshaler = (*X509AuthCallout)(nil)
+)
@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package x509auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/modules/auth_callout/internal/authtest"
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+// newTestCertificates returns a PEM encoded CA certificate, and a PEM encoded client
+// certificate issued by this CA with given common name and SAN URI.
+func newTestCertificates(t *testing.T, cn string, uri string) (string, string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Fleet"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{spiffe},
+		DNSNames:     []string{cn + ".devices.internal"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return string(caPEM), string(certPEM)
+}
+
+func newTestRequest(info *jwt.ClientTLS) *modules.AuthorizationRequest {
+	request := authtest.NewRequest("")
+	request.Claims.TLS = info
+	return request
+}
+
+func TestX509AuthCallout(t *testing.T) {
+	caPEM, certPEM := newTestCertificates(t, "device-1", "spiffe://example.org/devices/device-1")
+	handler := &X509AuthCallout{
+		logger:   zap.NewNop(),
+		Account:  "DEVICES",
+		Template: &modules.Template{},
+		Mappings: []*Mapping{
+			{SubjectCN: "admin-*", Account: "ADMIN"},
+			{SPIFFEID: "spiffe://example.org/devices/*", SubjectO: "Fleet"},
+		},
+	}
+	handler.Template.Permissions.Pub.Allow = jwt.StringList{"devices.{nats.tls.subject.cn}.>"}
+	handler.Template.Permissions.Sub.Allow = jwt.StringList{"{nats.tls.san.dns}"}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	// Certificate verified by the server
+	claims, err := handler.Handle(newTestRequest(&jwt.ClientTLS{VerifiedChains: []jwt.StringList{{certPEM, caPEM}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "DEVICES" || claims.Name != "spiffe://example.org/devices/device-1" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	if len(claims.Pub.Allow) != 1 || claims.Pub.Allow[0] != "devices.device-1.>" {
+		t.Fatalf("unexpected publish permissions: %v", claims.Pub.Allow)
+	}
+	if len(claims.Sub.Allow) != 1 || claims.Sub.Allow[0] != "device-1.devices.internal" {
+		t.Fatalf("unexpected subscribe permissions: %v", claims.Sub.Allow)
+	}
+	// Certificate not verified by the server
+	if _, err := handler.Handle(newTestRequest(&jwt.ClientTLS{Certs: jwt.StringList{certPEM}})); err == nil {
+		t.Fatal("expected error for unverified certificate")
+	}
+	// No certificate
+	if _, err := handler.Handle(newTestRequest(nil)); err == nil {
+		t.Fatal("expected error without certificate")
+	}
+	// Certificate without matching mapping
+	caPEM, certPEM = newTestCertificates(t, "device-2", "spiffe://other.org/devices/device-2")
+	if _, err := handler.Handle(newTestRequest(&jwt.ClientTLS{VerifiedChains: []jwt.StringList{{certPEM, caPEM}}})); err == nil {
+		t.Fatal("expected error without matching mapping")
+	}
+	// First matching mapping is used
+	caPEM, certPEM = newTestCertificates(t, "admin-1", "spiffe://example.org/devices/admin-1")
+	claims, err = handler.Handle(newTestRequest(&jwt.ClientTLS{VerifiedChains: []jwt.StringList{{certPEM, caPEM}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "ADMIN" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+}
+
+func TestX509AuthCalloutCAFile(t *testing.T) {
+	caPEM, certPEM := newTestCertificates(t, "device-1", "spiffe://example.org/devices/device-1")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte(caPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := &X509AuthCallout{logger: zap.NewNop(), Account: "{nats.tls.subject.o}", CAFile: caFile}
+	if err := handler.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := handler.Handle(newTestRequest(&jwt.ClientTLS{Certs: jwt.StringList{certPEM}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Audience != "Fleet" {
+		t.Fatalf("unexpected account: %s", claims.Audience)
+	}
+	// Certificate issued by another CA
+	_, otherPEM := newTestCertificates(t, "device-1", "spiffe://example.org/devices/device-1")
+	if _, err := handler.Handle(newTestRequest(&jwt.ClientTLS{Certs: jwt.StringList{otherPEM}})); err == nil {
+		t.Fatal("expected error for certificate issued by another CA")
+	}
+}
+
+func TestX509AuthCalloutInvalid(t *testing.T) {
+	invalid := map[string]*X509AuthCallout{
+		"missing ca file": {CAFile: filepath.Join(t.TempDir(), "ca.pem")},
+		"invalid pattern": {Mappings: []*Mapping{{SubjectCN: "[device"}}},
+	}
+	for name, handler := range invalid {
+		if err := handler.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestX509AuthCalloutCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`x509 DEVICES {
+		ca local
+		template {
+			publish allow devices.{nats.tls.subject.cn}.>
+		}
+		map {
+			spiffe_id spiffe://example.org/admin/*
+			subject_ou ops
+			account ADMIN
+			template {
+				publish allow >
+			}
+		}
+		map {
+			uri spiffe://example.org/devices/*
+			dns *.devices.internal
+		}
+	}`)
+	handler := &X509AuthCallout{}
+	if err := handler.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if handler.Account != "DEVICES" || handler.CA != "local" || handler.Template == nil || len(handler.Mappings) != 2 {
+		t.Fatalf("unexpected handler: %+v", handler)
+	}
+	admin := handler.Mappings[0]
+	if admin.SPIFFEID != "spiffe://example.org/admin/*" || admin.SubjectOU != "ops" || admin.Account != "ADMIN" || admin.Template == nil {
+		t.Fatalf("unexpected mapping: %+v", admin)
+	}
+	devices := handler.Mappings[1]
+	if devices.URI != "spiffe://example.org/devices/*" || devices.DNS != "*.devices.internal" || devices.Template != nil {
+		t.Fatalf("unexpected mapping: %+v", devices)
+	}
+}
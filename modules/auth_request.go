@@ -49,3 +49,32 @@ func (r *AuthorizationRequest) AddReplacerMapper(mapper func(key string) (any, b
 	repl := r.GetReplacer()
 	repl.Map(mapper)
 }
+
+type identityClaimsCtxKey struct{}
+
+// SetIdentityClaims stores identity claims extracted by a handler from the request, such as OIDC claims.
+// They are available to expressions evaluated later for the same request as the "claims" variable.
+func (r *AuthorizationRequest) SetIdentityClaims(claims map[string]any) {
+	r.Context = context.WithValue(r.Context, identityClaimsCtxKey{}, claims)
+}
+
+// GetIdentityClaims returns identity claims stored by a handler, or nil.
+func (r *AuthorizationRequest) GetIdentityClaims() map[string]any {
+	claims, _ := r.Context.Value(identityClaimsCtxKey{}).(map[string]any)
+	return claims
+}
+
+type sessionKeyCtxKey struct{}
+
+// SetSessionKey stores the key of the session from which the request is authorized,
+// such as the key of an oauth2 session persisted in a session store. The client
+// connection is disconnected when the session is deleted from its SessionSource.
+func (r *AuthorizationRequest) SetSessionKey(key string) {
+	r.Context = context.WithValue(r.Context, sessionKeyCtxKey{}, key)
+}
+
+// GetSessionKey returns the session key stored by a handler, or an empty string.
+func (r *AuthorizationRequest) GetSessionKey() string {
+	key, _ := r.Context.Value(sessionKeyCtxKey{}).(string)
+	return key
+}
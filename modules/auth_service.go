@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/charbonnierg/caddy-nats/embedded/natsauth"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"go.uber.org/zap"
 )
 
 type AuthService struct {
@@ -17,57 +20,152 @@ type AuthService struct {
 	conn              *nats.Conn
 	service           *natsauth.Service
 	defaultHandler    AuthCallout
+	keystore          Keystore
+	cache             *decisionCache
+	logger            *zap.Logger
 	InternalAccount   string             `json:"internal_account,omitempty"`
 	InternalUser      string             `json:"internal_user,omitempty"`
 	AuthAccount       string             `json:"auth_account,omitempty"`
 	AuthSigningKey    string             `json:"auth_signing_key"`
+	AuthXKey          string             `json:"auth_xkey,omitempty"`
 	SubjectRaw        string             `json:"subject,omitempty"`
 	Credentials       string             `json:"credentials,omitempty"`
 	Policies          ConnectionPolicies `json:"policies,omitempty"`
+	Cache             *DecisionCache     `json:"cache,omitempty"`
+	Audit             *Audit             `json:"audit,omitempty"`
 	DefaultHandlerRaw json.RawMessage    `json:"handler,omitempty" caddy:"namespace=nats.auth_callout inline_key=module"`
+	KeystoreRaw       json.RawMessage    `json:"keystore,omitempty" caddy:"namespace=nats.keystore inline_key=type"`
 }
 
+// Handle handles an authorization request. When the decision cache is enabled,
+// cached decisions are returned without running handlers.
+// Client connections authorized from a session are tracked, so that they
+// are disconnected when the session is revoked.
+// When the audit trail is enabled, an audit event is published for each decision.
 func (s *AuthService) Handle(claims *jwt.AuthorizationRequestClaims) (*jwt.UserClaims, error) {
+	start := time.Now()
+	var d decision
+	cached := false
+	if s.cache != nil {
+		d, cached = s.cache.get(claims)
+	}
+	if !cached {
+		d = s.handle(claims)
+		if s.cache != nil {
+			s.cache.set(claims, d)
+		}
+	}
+	if d.err == nil && d.sessionKey != "" && s.app != nil && s.app.sessions != nil {
+		s.app.sessions.track(d.sessionKey, claims.Server.ID, claims.ClientInformation.ID, d.claims.Audience, d.claims.Name)
+	}
+	if s.Audit != nil {
+		s.Audit.publish(s.conn, s.logger, newAuditEvent(claims, d, cached, time.Since(start)))
+	}
+	return d.claims, d.err
+}
+
+// PurgeCache removes all decisions from the decision cache,
+// and returns the number of removed decisions.
+func (s *AuthService) PurgeCache() int {
+	if s.cache == nil {
+		return 0
+	}
+	return s.cache.purge()
+}
+
+// forgetSession removes the cached decisions of a revoked session.
+func (s *AuthService) forgetSession(sessionKey string) {
+	if s.cache != nil {
+		s.cache.removeSession(sessionKey)
+	}
+}
+
+func (s *AuthService) handle(claims *jwt.AuthorizationRequestClaims) decision {
 	req := &AuthorizationRequest{
 		Claims:  claims,
 		Context: context.TODO(),
 	}
-	var handler AuthCallout
-	// Match handler for this request
-	matchedHandler, ok := s.Policies.Match(claims)
-	// Fail if no policy matched and there is no default handler
-	if !ok && s.defaultHandler == nil {
-		return nil, errors.New("no matching policy")
+	// Match handler for this request. Policy index is -1 when the default handler is used.
+	policy := -1
+	handler := s.defaultHandler
+	for idx, pol := range s.Policies {
+		if pol.Match(claims) {
+			policy = idx
+			handler = pol.handler
+			break
+		}
 	}
-	// Use default handler if no policy matched
-	if !ok {
-		handler = s.defaultHandler
-	} else {
-		handler = matchedHandler
+	// Fail if no policy matched and there is no default handler
+	if handler == nil {
+		return decision{policy: policy, err: errors.New("no matching policy")}
 	}
 	// Let handler handle the request
-	return handler.Handle(req)
+	user, err := handler.Handle(req)
+	if err == nil && user == nil {
+		err = errors.New("handler returned no user claims")
+	}
+	return decision{claims: user, sessionKey: req.GetSessionKey(), policy: policy, handler: handlerModuleID(handler), err: err}
 }
 
 // Provision will provision the auth callout service.
 // It implements the caddy.Provisioner interface.
 // It will load and validate the auth callout handler module.
 // It will load and validate the auth signing key.
+// It will load and validate the auth xkey (curve seed) used to decrypt requests
+// and encrypt responses when server is configured with an xkey.
+// It will load and validate the keystore used to sign user claims, if any.
+// It will create the decision cache, if any.
+// It will validate the audit configuration, if any.
+// When a keystore is configured, no internal account is created, and the
+// auth account (account public key in operator mode) must be configured.
 func (s *AuthService) Provision(app *App) error {
 	s.app = app
+	s.logger = app.logger.Named("auth_callout")
 	// Validate configuration
 	if s.AuthSigningKey != "" && s.InternalAccount != "" {
 		return errors.New("auth signing key and internal account are mutually exclusive")
 	}
-	if s.AuthSigningKey == "" && s.InternalAccount == "" {
+	if s.KeystoreRaw != nil && s.InternalAccount != "" {
+		return errors.New("keystore and internal account are mutually exclusive")
+	}
+	if s.KeystoreRaw != nil && s.AuthAccount == "" {
+		return errors.New("auth account is required when using a keystore")
+	}
+	if s.AuthSigningKey == "" && s.InternalAccount == "" && s.KeystoreRaw == nil {
 		s.InternalAccount = natsauth.DEFAULT_AUTH_CALLOUT_ACCOUNT
 	}
 	// Provision subjec to which auth requests will be sent
 	cfg := natsauth.NewConfig(s.Handle)
-	cfg.Logger = app.logger.Named("auth_callout")
+	cfg.Logger = s.logger
 	if s.SubjectRaw != "" {
 		cfg.Subject = s.SubjectRaw
 	}
+	if s.AuthAccount != "" {
+		cfg.Account = s.AuthAccount
+	}
+	// Provision keystore
+	if s.KeystoreRaw != nil {
+		unm, err := app.ctx.LoadModule(s, "KeystoreRaw")
+		if err != nil {
+			return fmt.Errorf("failed to load keystore: %s", err.Error())
+		}
+		keystore, ok := unm.(Keystore)
+		if !ok {
+			return errors.New("keystore invalid type")
+		}
+		if err := keystore.Provision(app); err != nil {
+			return fmt.Errorf("failed to provision keystore: %s", err.Error())
+		}
+		s.keystore = keystore
+		cfg.Keystore = keystore
+	}
+	// Validate audit configuration before the internal account is created,
+	// so that JetStream can be enabled for the audit stream
+	if s.Audit != nil {
+		if err := s.Audit.provision(); err != nil {
+			return err
+		}
+	}
 	// Generate an NATS server account if needed
 	// This account will be used to authenticate the auth callout
 	// A single user will be created in this account, password will
@@ -75,12 +173,24 @@ func (s *AuthService) Provision(app *App) error {
 	if err := s.setupInternalAuthAccount(); err != nil {
 		return err
 	}
-	// At this point, either a signing key was provided in configuration
+	// At this point, either a signing key or a keystore was provided in configuration
 	// or an internal account was created and the signing key is set
-	if s.AuthSigningKey == "" {
+	if s.AuthSigningKey == "" && s.keystore == nil {
 		return errors.New("internal error: auth signing key is not set but should be")
 	}
+	// A keystore is opened using the auth service connection, so make sure
+	// that the auth service is able to connect
+	if s.keystore != nil && s.Credentials == "" {
+		if _, _, ok := s.authUser(); !ok {
+			return errors.New("credentials or an auth_users entry are required when using a keystore")
+		}
+	}
+	// Make sure that auth xkey matches the xkey configured in server authorization map
+	if err := s.verifyXKey(); err != nil {
+		return err
+	}
 	cfg.SigningKey = s.AuthSigningKey
+	cfg.XKey = s.AuthXKey
 	// Provision default handler
 	if s.DefaultHandlerRaw != nil {
 		unm, err := app.ctx.LoadModule(s, "DefaultHandlerRaw")
@@ -91,12 +201,23 @@ func (s *AuthService) Provision(app *App) error {
 		if !ok {
 			return errors.New("default handler invalid type")
 		}
+		if err := handler.Provision(app); err != nil {
+			return fmt.Errorf("failed to provision default handler: %s", err.Error())
+		}
 		s.defaultHandler = handler
 	}
 	// Provision policies
 	if err := s.Policies.Provision(app); err != nil {
 		return err
 	}
+	// Provision decision cache
+	if s.Cache != nil {
+		cache, err := newDecisionCache(s.Cache)
+		if err != nil {
+			return err
+		}
+		s.cache = cache
+	}
 	// Create auth service
 	service, err := natsauth.NewService(cfg)
 	if err != nil {
@@ -117,9 +238,10 @@ func (s *AuthService) Start(server *server.Server) error {
 		if err := nats.UserCredentials(s.Credentials)(&opts); err != nil {
 			return err
 		}
-	} else {
+	} else if user, password, ok := s.authUser(); ok {
 		// Set password if any
-		s.setPassword(&opts)
+		opts.User = user
+		opts.Password = password
 	}
 	// Create connection
 	conn, err := opts.Connect()
@@ -127,49 +249,87 @@ func (s *AuthService) Start(server *server.Server) error {
 		return err
 	}
 	s.conn = conn
+	// Open keystore before handling any request
+	if s.keystore != nil {
+		if err := s.keystore.Open(conn); err != nil {
+			return err
+		}
+	}
+	// Create audit stream before handling any request
+	if s.Audit != nil {
+		if err := s.Audit.setupStream(conn); err != nil {
+			return err
+		}
+	}
 	// Subscribe to auth callout subject
 	return s.service.Listen(conn)
 }
 
 func (s *AuthService) Stop() error {
+	var err error
+	if s.keystore != nil {
+		err = s.keystore.Close()
+	}
 	if s.conn != nil {
 		s.conn.Close()
 	}
+	return err
+}
+
+// verifyXKey verifies that the auth xkey (curve seed) matches the public xkey
+// configured in the server authorization map, if any. Without this check,
+// a mismatch would silently fail every authorization request.
+func (s *AuthService) verifyXKey() error {
+	if s.app.Options == nil || s.app.Options.Authorization == nil || s.app.Options.Authorization.AuthCallout == nil {
+		return nil
+	}
+	expected := s.app.Options.Authorization.AuthCallout.XKey
+	if expected == "" {
+		return nil
+	}
+	if s.AuthXKey == "" {
+		return errors.New("auth xkey is required when authorization auth_callout xkey is configured")
+	}
+	kp, err := nkeys.FromCurveSeed([]byte(s.AuthXKey))
+	if err != nil {
+		return errors.New("invalid auth xkey seed")
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		return errors.New("failed to get auth xkey public key")
+	}
+	if pk != expected {
+		return fmt.Errorf("auth xkey public key %s does not match authorization auth_callout xkey %s", pk, expected)
+	}
 	return nil
 }
 
-func (s *AuthService) setPassword(opts *nats.Options) {
-	// The goal is to "guess" the user and password to use for the auth callout
-	if s.app.Options != nil && s.app.Options.Authorization != nil {
-		auth := s.app.Options.Authorization
-		accs := s.app.Options.Accounts
-		config := auth.AuthCallout
-		if config != nil && config.AuthUsers != nil {
-			if auth.Users != nil {
-				for _, user := range auth.Users {
-					for _, authUser := range config.AuthUsers {
-						if user.User == authUser {
-							opts.User = user.User
-							opts.Password = user.Password
-							return
-						}
-					}
-				}
-			} else {
-				for _, acc := range accs {
-					if acc.Name == config.Account {
-						for _, user := range acc.Users {
-							for _, authUser := range config.AuthUsers {
-								if user.User == authUser {
-									opts.User = user.User
-									opts.Password = user.Password
-									return
-								}
-							}
-						}
-					}
-				}
+// authUser returns the user and password used by the auth callout service
+// to connect to the embedded NATS server. The goal is to "guess" them from
+// the auth users of the authorization auth callout configuration.
+func (s *AuthService) authUser() (string, string, bool) {
+	if s.app.Options == nil || s.app.Options.Authorization == nil {
+		return "", "", false
+	}
+	auth := s.app.Options.Authorization
+	config := auth.AuthCallout
+	if config == nil || config.AuthUsers == nil {
+		return "", "", false
+	}
+	users := auth.Users
+	if users == nil {
+		for _, acc := range s.app.Options.Accounts {
+			if acc.Name == config.Account {
+				users = acc.Users
+			}
+		}
+	}
+	for _, user := range users {
+		for _, authUser := range config.AuthUsers {
+			if user.User == authUser {
+				return user.User, user.Password, true
 			}
 		}
 	}
+	return "", "", false
 }
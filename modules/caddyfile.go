@@ -0,0 +1,637 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/nats-io/jwt/v2"
+)
+
+func init() {
+	httpcaddyfile.RegisterGlobalOption("nats", parseGlobalOption)
+}
+
+// parseGlobalOption parses the nats global option. Syntax:
+//
+//	nats {
+//		ready_timeout <duration>
+//		server {
+//			...
+//		}
+//		auth_service {
+//			...
+//		}
+//	}
+func parseGlobalOption(d *caddyfile.Dispenser, existingVal interface{}) (interface{}, error) {
+	app := new(App)
+	if existingVal != nil {
+		existing, ok := existingVal.(httpcaddyfile.App)
+		if !ok {
+			return nil, d.Errf("existing nats option of unexpected type: %T", existingVal)
+		}
+		if err := json.Unmarshal(existing.Value, app); err != nil {
+			return nil, d.Errf("failed to decode existing nats option: %v", err)
+		}
+	}
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "nats",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// UnmarshalCaddyfile sets up the nats app from Caddyfile tokens.
+// It implements the caddyfile.Unmarshaler interface.
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "ready_timeout":
+				if err := ParseDuration(d, &a.ReadyTimeout); err != nil {
+					return err
+				}
+			case "server":
+				if a.Options == nil {
+					a.Options = &natsoptions.Options{}
+				}
+				if err := parseServerOptions(d, a.Options); err != nil {
+					return err
+				}
+			case "auth_service":
+				if a.AuthService == nil {
+					a.AuthService = &AuthService{}
+				}
+				if err := parseAuthService(d, a.AuthService); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseAuthService parses the auth_service block of the nats global option. Syntax:
+//
+//	auth_service {
+//		internal_account <account>
+//		internal_user <user>
+//		auth_account <account>
+//		auth_signing_key <seed>
+//		auth_xkey <seed>
+//		subject <subject>
+//		credentials <path>
+//		cache {
+//			ttl <duration>
+//			negative_ttl <duration>
+//			max_entries <count>
+//		}
+//		audit [<subject>] {
+//			stream [<name>] {
+//				...
+//			}
+//		}
+//		keystore <type> {
+//			...
+//		}
+//		handler <module> {
+//			...
+//		}
+//		policy {
+//			match <matcher> {
+//				...
+//			}
+//			handler <module> {
+//				...
+//			}
+//		}
+//	}
+//
+// The dispenser is expected to be positioned on the auth_service token.
+func parseAuthService(d *caddyfile.Dispenser, s *AuthService) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "internal_account":
+			if err := parseString(d, &s.InternalAccount); err != nil {
+				return err
+			}
+		case "internal_user":
+			if err := parseString(d, &s.InternalUser); err != nil {
+				return err
+			}
+		case "auth_account":
+			if err := parseString(d, &s.AuthAccount); err != nil {
+				return err
+			}
+		case "auth_signing_key":
+			if err := parseString(d, &s.AuthSigningKey); err != nil {
+				return err
+			}
+		case "auth_xkey":
+			if err := parseString(d, &s.AuthXKey); err != nil {
+				return err
+			}
+		case "subject":
+			if err := parseString(d, &s.SubjectRaw); err != nil {
+				return err
+			}
+		case "credentials":
+			if err := parseString(d, &s.Credentials); err != nil {
+				return err
+			}
+		case "cache":
+			if s.Cache == nil {
+				s.Cache = &DecisionCache{}
+			}
+			if err := parseDecisionCache(d, s.Cache); err != nil {
+				return err
+			}
+		case "audit":
+			if s.Audit == nil {
+				s.Audit = &Audit{}
+			}
+			if err := parseAudit(d, s.Audit); err != nil {
+				return err
+			}
+		case "keystore":
+			raw, err := parseModule(d, "nats.keystore.", "type")
+			if err != nil {
+				return err
+			}
+			s.KeystoreRaw = raw
+		case "handler":
+			raw, err := ParseHandler(d)
+			if err != nil {
+				return err
+			}
+			s.DefaultHandlerRaw = raw
+		case "policy":
+			policy, err := parsePolicy(d)
+			if err != nil {
+				return err
+			}
+			s.Policies = append(s.Policies, policy)
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseDecisionCache parses the cache block of the auth_service. Syntax:
+//
+//	cache {
+//		ttl <duration>
+//		negative_ttl <duration>
+//		max_entries <count>
+//	}
+//
+// The dispenser is expected to be positioned on the cache token.
+func parseDecisionCache(d *caddyfile.Dispenser, c *DecisionCache) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ttl":
+			if err := ParseDuration(d, &c.TTL); err != nil {
+				return err
+			}
+		case "negative_ttl":
+			if err := ParseDuration(d, &c.NegativeTTL); err != nil {
+				return err
+			}
+		case "max_entries":
+			if err := parseInt(d, &c.MaxEntries); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseAudit parses the audit block of the auth_service. Syntax:
+//
+//	audit [<subject>] {
+//		stream [<name>] {
+//			max_age <duration>
+//			max_bytes <size>
+//			max_msgs <count>
+//			storage file|memory
+//			replicas <count>
+//		}
+//	}
+//
+// The dispenser is expected to be positioned on the audit token.
+func parseAudit(d *caddyfile.Dispenser, a *Audit) error {
+	if d.NextArg() {
+		a.Subject = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "stream":
+			if a.Stream == nil {
+				a.Stream = &AuditStream{}
+			}
+			if err := parseAuditStream(d, a.Stream); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseAuditStream parses the stream block of the audit block.
+// The dispenser is expected to be positioned on the stream token.
+func parseAuditStream(d *caddyfile.Dispenser, stream *AuditStream) error {
+	if d.NextArg() {
+		stream.Name = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "max_age":
+			err = ParseDuration(d, &stream.MaxAge)
+		case "max_bytes":
+			err = parseSize(d, &stream.MaxBytes)
+		case "max_msgs":
+			err = parseInt64(d, &stream.MaxMsgs)
+		case "storage":
+			err = parseEnum(d, &stream.Storage)
+		case "replicas":
+			err = parseInt(d, &stream.Replicas)
+		default:
+			return d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePolicy parses a connection policy block.
+// All matchers of a policy must match for the policy handler to be used.
+// The dispenser is expected to be positioned on the policy token.
+func parsePolicy(d *caddyfile.Dispenser) (*ConnectionPolicy, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	pol := &ConnectionPolicy{}
+	matchers := map[string]json.RawMessage{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "match":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			name := d.Val()
+			if _, ok := matchers[name]; ok {
+				return nil, d.Errf("duplicate matcher: %s", name)
+			}
+			raw, err := parseMatcher(d)
+			if err != nil {
+				return nil, err
+			}
+			matchers[name] = raw
+		case "handler":
+			raw, err := ParseHandler(d)
+			if err != nil {
+				return nil, err
+			}
+			pol.HandlerRaw = raw
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	if len(matchers) > 0 {
+		pol.MatchersRaw = append(pol.MatchersRaw, matchers)
+	}
+	if pol.HandlerRaw == nil {
+		return nil, d.Err("policy handler is required")
+	}
+	return pol, nil
+}
+
+// ParseTemplate parses a user claims template block. Syntax:
+//
+//	template {
+//		publish allow|deny <subjects...>
+//		subscribe allow|deny <subjects...>
+//		allow_responses [<max>] [<ttl>]
+//		max_payload <size>
+//		max_subscriptions <count>
+//		max_data <size>
+//		source <cidrs...>
+//		locale <locale>
+//		allowed_connection_types <types...>
+//		bearer_token
+//	}
+//
+// The dispenser is expected to be positioned on the template token.
+func ParseTemplate(d *caddyfile.Dispenser) (*Template, error) {
+	t := &Template{}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "publish", "subscribe":
+			perm := &t.Permissions.Pub
+			if d.Val() == "subscribe" {
+				perm = &t.Permissions.Sub
+			}
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			kind := d.Val()
+			subjects := d.RemainingArgs()
+			if len(subjects) == 0 {
+				return nil, d.ArgErr()
+			}
+			switch kind {
+			case "allow":
+				perm.Allow = append(perm.Allow, subjects...)
+			case "deny":
+				perm.Deny = append(perm.Deny, subjects...)
+			default:
+				return nil, d.Errf("expected allow or deny, got: %s", kind)
+			}
+		case "allow_responses":
+			resp := &jwt.ResponsePermission{MaxMsgs: 1}
+			args := d.RemainingArgs()
+			if len(args) > 2 {
+				return nil, d.ArgErr()
+			}
+			if len(args) > 0 {
+				max, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, d.Errf("invalid max responses: %v", err)
+				}
+				resp.MaxMsgs = max
+			}
+			if len(args) > 1 {
+				ttl, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return nil, d.Errf("invalid responses ttl: %v", err)
+				}
+				resp.Expires = ttl
+			}
+			t.Permissions.Resp = resp
+		case "max_payload":
+			if err := parseSize(d, &t.Payload); err != nil {
+				return nil, err
+			}
+		case "max_data":
+			if err := parseSize(d, &t.Data); err != nil {
+				return nil, err
+			}
+		case "max_subscriptions":
+			if err := parseInt64(d, &t.Subs); err != nil {
+				return nil, err
+			}
+		case "source":
+			if err := parseStrings(d, (*[]string)(&t.Src)); err != nil {
+				return nil, err
+			}
+		case "locale":
+			if err := parseString(d, &t.Locale); err != nil {
+				return nil, err
+			}
+		case "allowed_connection_types":
+			if err := parseStrings(d, (*[]string)(&t.AllowedConnectionTypes)); err != nil {
+				return nil, err
+			}
+		case "bearer_token":
+			if err := parseBool(d, &t.BearerToken); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, d.Errf("unrecognized subdirective: %s", d.Val())
+		}
+	}
+	return t, nil
+}
+
+// ParseHandler parses an auth callout handler module and returns its JSON representation.
+// It can be used by handlers which are composed of other handlers.
+// The dispenser is expected to be positioned on the token preceding the handler module name.
+func ParseHandler(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	return parseModule(d, "nats.auth_callout.", "module")
+}
+
+// ParseDuration parses a single duration argument. Durations use the caddy
+// syntax, which also accepts days (e.g. "1d").
+// It can be used by handlers to parse their durations.
+func ParseDuration(d *caddyfile.Dispenser, dest *time.Duration) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	value, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return d.Errf("invalid duration value: %s", d.Val())
+	}
+	*dest = value
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseModule parses a guest module in the given namespace and returns its JSON
+// representation, holding the module name under the inline key.
+// The dispenser is expected to be positioned on the token preceding the module name.
+func parseModule(d *caddyfile.Dispenser, namespace string, inlineKey string) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, namespace+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, inlineKey, name, nil), nil
+}
+
+// parseString parses a single string argument.
+func parseString(d *caddyfile.Dispenser, dest *string) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	*dest = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseStrings parses one or more string arguments.
+// Values are appended to existing values, so that directive can be repeated.
+func parseStrings(d *caddyfile.Dispenser, dest *[]string) error {
+	values := d.RemainingArgs()
+	if len(values) == 0 {
+		return d.ArgErr()
+	}
+	*dest = append(*dest, values...)
+	return nil
+}
+
+// parseBool parses an optional boolean argument.
+// When no argument is provided, value is set to true.
+func parseBool(d *caddyfile.Dispenser, dest *bool) error {
+	if !d.NextArg() {
+		*dest = true
+		return nil
+	}
+	value, err := strconv.ParseBool(d.Val())
+	if err != nil {
+		return d.Errf("invalid boolean value: %s", d.Val())
+	}
+	*dest = value
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseInt parses a single integer argument.
+func parseInt(d *caddyfile.Dispenser, dest *int) error {
+	var value int64
+	if err := parseInt64(d, &value); err != nil {
+		return err
+	}
+	*dest = int(value)
+	return nil
+}
+
+// parseInt32 parses a single 32 bits integer argument.
+func parseInt32(d *caddyfile.Dispenser, dest *int32) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	value, err := strconv.ParseInt(d.Val(), 10, 32)
+	if err != nil {
+		return d.Errf("invalid integer value: %s", d.Val())
+	}
+	*dest = int32(value)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseInt64 parses a single 64 bits integer argument.
+func parseInt64(d *caddyfile.Dispenser, dest *int64) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	value, err := strconv.ParseInt(d.Val(), 10, 64)
+	if err != nil {
+		return d.Errf("invalid integer value: %s", d.Val())
+	}
+	*dest = value
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseSize parses a single size argument, either as a number of bytes
+// or as a size with a unit suffix (e.g. 1MB, 2GiB). Units are interpreted
+// the same way as in NATS server configuration files: K, M, G and T are
+// decimal units while KB, MB, GB, TB and their IEC variants (KiB, MiB, ...)
+// are binary units.
+func parseSize(d *caddyfile.Dispenser, dest *int64) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	value, err := parseSizeValue(d.Val())
+	if err != nil {
+		return d.Errf("invalid size value: %s", d.Val())
+	}
+	*dest = value
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// sizeUnits maps size suffixes to their multiplier, following the
+// NATS server configuration parser.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1 << 10,
+	"ki":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1 << 20,
+	"mi":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1 << 30,
+	"gi":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1000 * 1000 * 1000 * 1000,
+	"tb":  1 << 40,
+	"ti":  1 << 40,
+	"tib": 1 << 40,
+}
+
+// parseSizeValue parses a size with an optional unit suffix.
+func parseSizeValue(value string) (int64, error) {
+	digits := 0
+	for digits < len(value) && value[digits] >= '0' && value[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	num, err := strconv.ParseInt(value[:digits], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(value[digits:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit: %s", value[digits:])
+	}
+	if num > math.MaxInt64/unit {
+		return 0, fmt.Errorf("size is too large: %s", value)
+	}
+	return num * unit, nil
+}
+
+var (
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
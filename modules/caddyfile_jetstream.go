@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/nats-io/nats.go"
+)
+
+// parseStream parses an account stream. Syntax:
+//
+//	stream <name> {
+//		description <description>
+//		subjects <subjects...>
+//		retention limits|interest|workqueue
+//		storage file|memory
+//		replicas <count>
+//		discard old|new
+//		max_consumers <count>
+//		max_msgs <count>
+//		max_msgs_per_subject <count>
+//		max_bytes <size>
+//		max_msg_size <size>
+//		max_age <duration>
+//		duplicate_window <duration>
+//		allow_rollup
+//		allow_direct
+//		deny_delete
+//		deny_purge
+//		consumer <durable> {
+//			...
+//		}
+//	}
+func parseStream(d *caddyfile.Dispenser) (*natsoptions.Stream, error) {
+	stream := &natsoptions.Stream{}
+	if err := parseString(d, &stream.Name); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "description":
+			err = parseString(d, &stream.Description)
+		case "subjects":
+			err = parseStrings(d, &stream.Subjects)
+		case "retention":
+			err = parseEnum(d, &stream.Retention)
+		case "storage":
+			err = parseEnum(d, &stream.Storage)
+		case "replicas":
+			err = parseInt(d, &stream.Replicas)
+		case "discard":
+			err = parseEnum(d, &stream.Discard)
+		case "max_consumers":
+			err = parseInt(d, &stream.MaxConsumers)
+		case "max_msgs":
+			err = parseInt64(d, &stream.MaxMsgs)
+		case "max_msgs_per_subject":
+			err = parseInt64(d, &stream.MaxMsgsPerSubject)
+		case "max_bytes":
+			err = parseSize(d, &stream.MaxBytes)
+		case "max_msg_size":
+			err = parseSize32(d, &stream.MaxMsgSize)
+		case "max_age":
+			err = ParseDuration(d, &stream.MaxAge)
+		case "duplicate_window":
+			err = ParseDuration(d, &stream.Duplicates)
+		case "allow_rollup":
+			err = parseBool(d, &stream.AllowRollup)
+		case "allow_direct":
+			err = parseBool(d, &stream.AllowDirect)
+		case "deny_delete":
+			err = parseBool(d, &stream.DenyDelete)
+		case "deny_purge":
+			err = parseBool(d, &stream.DenyPurge)
+		case "consumer":
+			var consumer *nats.ConsumerConfig
+			consumer, err = parseConsumer(d)
+			if err == nil {
+				stream.Consumers = append(stream.Consumers, consumer)
+			}
+		default:
+			return nil, d.Errf("unrecognized stream subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+// parseConsumer parses a durable stream consumer. Syntax:
+//
+//	consumer <durable> {
+//		description <description>
+//		filter_subjects <subjects...>
+//		deliver_policy all|last|new|last_per_subject
+//		ack_policy none|all|explicit
+//		replay_policy instant|original
+//		ack_wait <duration>
+//		max_deliver <count>
+//		max_ack_pending <count>
+//		max_waiting <count>
+//		deliver_subject <subject>
+//		deliver_group <group>
+//		inactive_threshold <duration>
+//		replicas <count>
+//		memory_storage
+//	}
+func parseConsumer(d *caddyfile.Dispenser) (*nats.ConsumerConfig, error) {
+	consumer := &nats.ConsumerConfig{}
+	if err := parseString(d, &consumer.Durable); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "description":
+			err = parseString(d, &consumer.Description)
+		case "filter_subjects":
+			err = parseStrings(d, &consumer.FilterSubjects)
+		case "deliver_policy":
+			err = parseEnum(d, &consumer.DeliverPolicy)
+		case "ack_policy":
+			err = parseEnum(d, &consumer.AckPolicy)
+		case "replay_policy":
+			err = parseEnum(d, &consumer.ReplayPolicy)
+		case "ack_wait":
+			err = ParseDuration(d, &consumer.AckWait)
+		case "max_deliver":
+			err = parseInt(d, &consumer.MaxDeliver)
+		case "max_ack_pending":
+			err = parseInt(d, &consumer.MaxAckPending)
+		case "max_waiting":
+			err = parseInt(d, &consumer.MaxWaiting)
+		case "deliver_subject":
+			err = parseString(d, &consumer.DeliverSubject)
+		case "deliver_group":
+			err = parseString(d, &consumer.DeliverGroup)
+		case "inactive_threshold":
+			err = ParseDuration(d, &consumer.InactiveThreshold)
+		case "replicas":
+			err = parseInt(d, &consumer.Replicas)
+		case "memory_storage":
+			err = parseBool(d, &consumer.MemoryStorage)
+		default:
+			return nil, d.Errf("unrecognized consumer subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return consumer, nil
+}
+
+// parseKeyValueStore parses an account key value store. Syntax:
+//
+//	key_value <bucket> {
+//		description <description>
+//		history <count>
+//		ttl <duration>
+//		max_bytes <size>
+//		max_value_size <size>
+//		storage file|memory
+//		replicas <count>
+//	}
+func parseKeyValueStore(d *caddyfile.Dispenser) (*natsoptions.KeyValueStore, error) {
+	kv := &natsoptions.KeyValueStore{}
+	if err := parseString(d, &kv.Bucket); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "description":
+			err = parseString(d, &kv.Description)
+		case "history":
+			var history int
+			err = parseInt(d, &history)
+			if err == nil && (history < 1 || history > nats.KeyValueMaxHistory) {
+				return nil, d.Errf("history must be between 1 and %d", nats.KeyValueMaxHistory)
+			}
+			kv.History = uint8(history)
+		case "ttl":
+			err = ParseDuration(d, &kv.TTL)
+		case "max_bytes":
+			err = parseSize(d, &kv.MaxBytes)
+		case "max_value_size":
+			err = parseSize32(d, &kv.MaxValueSize)
+		case "storage":
+			err = parseEnum(d, &kv.Storage)
+		case "replicas":
+			err = parseInt(d, &kv.Replicas)
+		default:
+			return nil, d.Errf("unrecognized key_value subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kv, nil
+}
+
+// parseObjectStore parses an account object store. Syntax:
+//
+//	object_store <bucket> {
+//		description <description>
+//		ttl <duration>
+//		max_bytes <size>
+//		storage file|memory
+//		replicas <count>
+//	}
+func parseObjectStore(d *caddyfile.Dispenser) (*natsoptions.ObjectStore, error) {
+	obj := &natsoptions.ObjectStore{}
+	if err := parseString(d, &obj.Bucket); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "description":
+			err = parseString(d, &obj.Description)
+		case "ttl":
+			err = ParseDuration(d, &obj.TTL)
+		case "max_bytes":
+			err = parseSize(d, &obj.MaxBytes)
+		case "storage":
+			err = parseEnum(d, &obj.Storage)
+		case "replicas":
+			err = parseInt(d, &obj.Replicas)
+		default:
+			return nil, d.Errf("unrecognized object_store subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// parseEnum parses a single argument into a JetStream enum type
+// (storage, retention, discard, deliver, ack or replay policy)
+// using its JSON representation.
+func parseEnum(d *caddyfile.Dispenser, dest json.Unmarshaler) error {
+	var value string
+	if err := parseString(d, &value); err != nil {
+		return err
+	}
+	if err := dest.UnmarshalJSON([]byte(strconv.Quote(value))); err != nil {
+		return d.Errf("invalid value: %s", value)
+	}
+	return nil
+}
@@ -0,0 +1,1418 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// parseServerOptions parses the server block of the nats global option. Syntax:
+//
+//	server {
+//		name <name>
+//		tags <key=value...>
+//		host <host>
+//		port <port>
+//		advertise <address>
+//		debug
+//		trace
+//		http_port <port>
+//		tls [<subjects...>] {
+//			...
+//		}
+//		no_auth_user <user>
+//		always_enable_nonce
+//		system_account <account>
+//		operators <jwts...>
+//		account <name> {
+//			...
+//		}
+//		authorization {
+//			...
+//		}
+//		full_resolver {
+//			...
+//		}
+//		jetstream [<store_dir>] {
+//			...
+//		}
+//		websocket {
+//			...
+//		}
+//		leafnode {
+//			...
+//		}
+//		mqtt {
+//			...
+//		}
+//		cluster <name> {
+//			...
+//		}
+//		gateway <name> {
+//			...
+//		}
+//		metrics {
+//			...
+//		}
+//	}
+//
+// The dispenser is expected to be positioned on the server token.
+func parseServerOptions(d *caddyfile.Dispenser, o *natsoptions.Options) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "name":
+			err = parseString(d, &o.ServerName)
+		case "tags":
+			if o.ServerTags == nil {
+				o.ServerTags = map[string]string{}
+			}
+			err = parseTags(d, o.ServerTags)
+		case "host":
+			err = parseString(d, &o.Host)
+		case "port":
+			err = parseInt(d, &o.Port)
+		case "advertise":
+			err = parseString(d, &o.Advertise)
+		case "debug":
+			err = parseBool(d, &o.Debug)
+		case "trace":
+			err = parseBool(d, &o.Trace)
+		case "trace_verbose":
+			err = parseBool(d, &o.TraceVerbose)
+		case "http_host":
+			err = parseString(d, &o.HTTPHost)
+		case "http_port":
+			err = parseInt(d, &o.HTTPPort)
+		case "https_port":
+			err = parseInt(d, &o.HTTPSPort)
+		case "http_base_path":
+			err = parseString(d, &o.HTTPBasePath)
+		case "disable_logging":
+			err = parseBool(d, &o.NoLog)
+		case "no_tls":
+			err = parseBool(d, &o.NoTLS)
+		case "tls":
+			o.TLS, err = parseTLSMap(d, o.TLS)
+		case "disable_sublist_cache":
+			err = parseBool(d, &o.NoSublistCache)
+		case "max_connections":
+			err = parseInt(d, &o.MaxConn)
+		case "max_payload":
+			err = parseSize32(d, &o.MaxPayload)
+		case "max_pending":
+			err = parseSize(d, &o.MaxPending)
+		case "max_closed_clients":
+			err = parseInt(d, &o.MaxClosedClients)
+		case "max_subscriptions":
+			err = parseInt(d, &o.MaxSubs)
+		case "max_subscriptions_tokens":
+			var value int
+			err = parseInt(d, &value)
+			if err == nil && (value < 0 || value > 255) {
+				err = d.Errf("invalid max subscriptions tokens: %d", value)
+			}
+			o.MaxSubsTokens = uint8(value)
+		case "max_control_line":
+			err = parseSize32(d, &o.MaxControlLine)
+		case "max_traced_msg_len":
+			err = parseInt(d, &o.MaxTracedMsgLen)
+		case "max_pings_out":
+			err = parseInt(d, &o.MaxPingsOut)
+		case "ping_interval":
+			err = ParseDuration(d, &o.PingInterval)
+		case "write_deadline":
+			err = ParseDuration(d, &o.WriteDeadline)
+		case "no_auth_user":
+			err = parseString(d, &o.NoAuthUser)
+		case "always_enable_nonce":
+			err = parseBool(d, &o.AlwaysEnableNonce)
+		case "operators":
+			err = parseStrings(d, &o.Operators)
+		case "system_account":
+			err = parseString(d, &o.SystemAccount)
+		case "account":
+			var acc *natsoptions.Account
+			acc, err = parseAccount(d)
+			if err == nil {
+				o.Accounts = append(o.Accounts, acc)
+			}
+		case "authorization":
+			o.Authorization, err = parseAuthorizationMap(d)
+		case "full_resolver":
+			o.FullResolver, err = parseFullResolver(d)
+		case "cache_resolver":
+			o.CacheResolver, err = parseCacheResolver(d)
+		case "memory_resolver":
+			o.MemoryResolver, err = parseMemoryResolver(d)
+		case "cluster":
+			o.Cluster, err = parseCluster(d)
+		case "gateway":
+			o.Gateway, err = parseGateway(d)
+		case "websocket":
+			o.Websocket, err = parseWebsocket(d)
+		case "mqtt":
+			o.MQTT, err = parseMQTT(d)
+		case "jetstream":
+			o.JetStream, err = parseJetStream(d)
+		case "leafnode":
+			o.Leafnode, err = parseLeafnode(d)
+		case "metrics":
+			o.Metrics, err = parseMetrics(d)
+		default:
+			return d.Errf("unrecognized server subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTags parses one or more key=value arguments.
+func parseTags(d *caddyfile.Dispenser, tags map[string]string) error {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return d.ArgErr()
+	}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return d.Errf("invalid tag, expected key=value: %s", arg)
+		}
+		tags[key] = value
+	}
+	return nil
+}
+
+// parseSize32 parses a single size argument into a 32 bits integer.
+func parseSize32(d *caddyfile.Dispenser, dest *int32) error {
+	var value int64
+	if err := parseSize(d, &value); err != nil {
+		return err
+	}
+	if value > int64(^uint32(0)>>1) {
+		return d.Errf("size is too large: %d", value)
+	}
+	*dest = int32(value)
+	return nil
+}
+
+// parseTLSMap parses a tls block. Syntax:
+//
+//	tls [<subjects...>] {
+//		subjects <subjects...>
+//		allow_non_tls
+//		cert_file <path>
+//		key_file <path>
+//		ca_file <path>
+//		client_ca <caddy pki ca id>
+//		cert_store <store>
+//		cert_match <value>
+//		cert_match_by <field>
+//		verify
+//		insecure
+//		map
+//		check_known_urls
+//		timeout <duration>
+//		rate_limit <count>
+//		ciphers <ciphers...>
+//		curve_preferences <curves...>
+//		pinned_certs <fingerprints...>
+//	}
+//
+// When subjects are provided, certificates are managed by caddy.
+// For cluster routes and gateways, client_ca (or ca_file) enables
+// mutual TLS with caddy managed certificates.
+func parseTLSMap(d *caddyfile.Dispenser, m *natsoptions.TLSMap) (*natsoptions.TLSMap, error) {
+	if m == nil {
+		m = &natsoptions.TLSMap{}
+	}
+	m.Subjects = append(m.Subjects, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "subjects":
+			err = parseStrings(d, &m.Subjects)
+		case "allow_non_tls":
+			err = parseBool(d, &m.AllowNonTLS)
+		case "cert_file":
+			err = parseString(d, &m.CertFile)
+		case "key_file":
+			err = parseString(d, &m.KeyFile)
+		case "ca_file":
+			err = parseString(d, &m.CaFile)
+		case "client_ca":
+			err = parseString(d, &m.ClientCA)
+		case "cert_store":
+			err = parseString(d, &m.CertStore)
+		case "cert_match":
+			err = parseString(d, &m.CertMatch)
+		case "cert_match_by":
+			err = parseString(d, &m.CertMatchBy)
+		case "verify":
+			err = parseBool(d, &m.Verify)
+		case "insecure":
+			err = parseBool(d, &m.Insecure)
+		case "map":
+			err = parseBool(d, &m.Map)
+		case "check_known_urls":
+			err = parseBool(d, &m.CheckKnownURLs)
+		case "timeout":
+			err = ParseDuration(d, &m.Timeout)
+		case "rate_limit":
+			err = parseInt64(d, &m.RateLimit)
+		case "ciphers":
+			err = parseStrings(d, &m.Ciphers)
+		case "curve_preferences":
+			err = parseStrings(d, &m.CurvePreferences)
+		case "pinned_certs":
+			err = parseStrings(d, &m.PinnedCerts)
+		default:
+			return nil, d.Errf("unrecognized tls subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parsePermissions parses a permissions block. Syntax:
+//
+//	permissions {
+//		publish allow|deny <subjects...>
+//		subscribe allow|deny <subjects...>
+//		allow_responses [<max>] [<ttl>]
+//	}
+func parsePermissions(d *caddyfile.Dispenser) (*server.Permissions, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	perms := &server.Permissions{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "publish":
+			if perms.Publish == nil {
+				perms.Publish = &server.SubjectPermission{}
+			}
+			if err := parseSubjectPermission(d, perms.Publish); err != nil {
+				return nil, err
+			}
+		case "subscribe":
+			if perms.Subscribe == nil {
+				perms.Subscribe = &server.SubjectPermission{}
+			}
+			if err := parseSubjectPermission(d, perms.Subscribe); err != nil {
+				return nil, err
+			}
+		case "allow_responses":
+			resp := &server.ResponsePermission{MaxMsgs: server.DEFAULT_ALLOW_RESPONSE_MAX_MSGS, Expires: server.DEFAULT_ALLOW_RESPONSE_EXPIRATION}
+			args := d.RemainingArgs()
+			if len(args) > 2 {
+				return nil, d.ArgErr()
+			}
+			if len(args) > 0 {
+				max, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, d.Errf("invalid max responses: %v", err)
+				}
+				resp.MaxMsgs = max
+			}
+			if len(args) > 1 {
+				ttl, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return nil, d.Errf("invalid responses ttl: %v", err)
+				}
+				resp.Expires = ttl
+			}
+			perms.Response = resp
+		default:
+			return nil, d.Errf("unrecognized permissions subdirective: %s", d.Val())
+		}
+	}
+	return perms, nil
+}
+
+// parseRoutePermissions parses a cluster permissions block. Syntax:
+//
+//	permissions {
+//		imports allow|deny <subjects...>
+//		exports allow|deny <subjects...>
+//	}
+//
+// Subdirective is named imports because import is reserved by the Caddyfile.
+func parseRoutePermissions(d *caddyfile.Dispenser) (*server.RoutePermissions, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	perms := &server.RoutePermissions{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "imports":
+			if perms.Import == nil {
+				perms.Import = &server.SubjectPermission{}
+			}
+			if err := parseSubjectPermission(d, perms.Import); err != nil {
+				return nil, err
+			}
+		case "exports":
+			if perms.Export == nil {
+				perms.Export = &server.SubjectPermission{}
+			}
+			if err := parseSubjectPermission(d, perms.Export); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, d.Errf("unrecognized cluster permissions subdirective: %s", d.Val())
+		}
+	}
+	return perms, nil
+}
+
+// parseSubjectPermission parses allow or deny subjects.
+func parseSubjectPermission(d *caddyfile.Dispenser, perm *server.SubjectPermission) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	kind := d.Val()
+	subjects := d.RemainingArgs()
+	if len(subjects) == 0 {
+		return d.ArgErr()
+	}
+	switch kind {
+	case "allow":
+		perm.Allow = append(perm.Allow, subjects...)
+	case "deny":
+		perm.Deny = append(perm.Deny, subjects...)
+	default:
+		return d.Errf("expected allow or deny, got: %s", kind)
+	}
+	return nil
+}
+
+// parseUser parses a user. Syntax:
+//
+//	user <name> [<password>] {
+//		password <password>
+//		permissions {
+//			...
+//		}
+//		allowed_connection_types <types...>
+//	}
+func parseUser(d *caddyfile.Dispenser) (natsoptions.User, error) {
+	user := natsoptions.User{}
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 2:
+		user.Password = args[1]
+		fallthrough
+	case 1:
+		user.User = args[0]
+	default:
+		return user, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "password":
+			err = parseString(d, &user.Password)
+		case "permissions":
+			user.Permissions, err = parsePermissions(d)
+		case "allowed_connection_types":
+			err = parseStrings(d, &user.AllowedConnectionTypes)
+		default:
+			return user, d.Errf("unrecognized user subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return user, err
+		}
+	}
+	return user, nil
+}
+
+// parseAccount parses an account. Syntax:
+//
+//	account <name> {
+//		nkey <public key>
+//		jetstream
+//		user <name> [<password>] {
+//			...
+//		}
+//		default_permissions {
+//			...
+//		}
+//		export stream|service <subject> {
+//			accounts <accounts...>
+//			token_required
+//			response_type singleton|stream|chunked
+//			response_threshold <duration>
+//		}
+//		imports stream|service <subject> <account> {
+//			prefix <prefix>
+//			to <subject>
+//			token <token>
+//			share
+//		}
+//		mapping <subject> <destination> [<weight>]
+//		limits {
+//			...
+//		}
+//		stream <name> {
+//			...
+//		}
+//		key_value <bucket> {
+//			...
+//		}
+//		object_store <bucket> {
+//			...
+//		}
+//	}
+func parseAccount(d *caddyfile.Dispenser) (*natsoptions.Account, error) {
+	acc := &natsoptions.Account{}
+	if err := parseString(d, &acc.Name); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "nkey":
+			err = parseString(d, &acc.NKey)
+		case "jetstream":
+			err = parseBool(d, &acc.JetStream)
+		case "user":
+			var user natsoptions.User
+			user, err = parseUser(d)
+			if err == nil {
+				acc.Users = append(acc.Users, user)
+			}
+		case "default_permissions":
+			acc.DefaultPermissions, err = parsePermissions(d)
+		case "export":
+			var export *natsoptions.Export
+			export, err = parseExport(d)
+			if err == nil {
+				acc.Exports = append(acc.Exports, export)
+			}
+		case "imports":
+			// "import" is reserved by the Caddyfile lexer
+			var imp *natsoptions.Import
+			imp, err = parseImport(d)
+			if err == nil {
+				acc.Imports = append(acc.Imports, imp)
+			}
+		case "mapping":
+			err = parseMapping(d, acc)
+		case "limits":
+			acc.Limits, err = parseAccountLimits(d)
+		case "stream":
+			var stream *natsoptions.Stream
+			stream, err = parseStream(d)
+			if err == nil {
+				acc.Streams = append(acc.Streams, stream)
+			}
+		case "key_value":
+			var kv *natsoptions.KeyValueStore
+			kv, err = parseKeyValueStore(d)
+			if err == nil {
+				acc.KeyValueStores = append(acc.KeyValueStores, kv)
+			}
+		case "object_store":
+			var obj *natsoptions.ObjectStore
+			obj, err = parseObjectStore(d)
+			if err == nil {
+				acc.ObjectStores = append(acc.ObjectStores, obj)
+			}
+		default:
+			return nil, d.Errf("unrecognized account subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// parseExport parses an account export.
+func parseExport(d *caddyfile.Dispenser) (*natsoptions.Export, error) {
+	export := &natsoptions.Export{}
+	args := d.RemainingArgs()
+	if len(args) != 2 {
+		return nil, d.ArgErr()
+	}
+	switch args[0] {
+	case "stream":
+		export.Stream = args[1]
+	case "service":
+		export.Service = args[1]
+	default:
+		return nil, d.Errf("expected stream or service, got: %s", args[0])
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "accounts":
+			err = parseStrings(d, &export.Accounts)
+		case "token_required":
+			err = parseBool(d, &export.TokenRequired)
+		case "response_type":
+			err = parseString(d, &export.ResponseType)
+		case "response_threshold":
+			err = ParseDuration(d, &export.ResponseThreshold)
+		default:
+			return nil, d.Errf("unrecognized export subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return export, nil
+}
+
+// parseImport parses an account import.
+func parseImport(d *caddyfile.Dispenser) (*natsoptions.Import, error) {
+	imp := &natsoptions.Import{}
+	args := d.RemainingArgs()
+	if len(args) != 3 {
+		return nil, d.ArgErr()
+	}
+	switch args[0] {
+	case "stream":
+		imp.Stream = args[1]
+	case "service":
+		imp.Service = args[1]
+	default:
+		return nil, d.Errf("expected stream or service, got: %s", args[0])
+	}
+	imp.Account = args[2]
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "prefix":
+			err = parseString(d, &imp.Prefix)
+		case "to":
+			err = parseString(d, &imp.To)
+		case "token":
+			err = parseString(d, &imp.Token)
+		case "share":
+			err = parseBool(d, &imp.Share)
+		default:
+			return nil, d.Errf("unrecognized import subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return imp, nil
+}
+
+// parseMapping parses a subject mapping destination and adds it to the account.
+// Mapping directive can be repeated for the same subject to define weighted destinations.
+// When weight is omitted, destination weight is 100, so weights must be specified
+// explicitly when several destinations are defined for the same subject.
+func parseMapping(d *caddyfile.Dispenser, acc *natsoptions.Account) error {
+	args := d.RemainingArgs()
+	if len(args) < 2 || len(args) > 3 {
+		return d.ArgErr()
+	}
+	dest := &server.MapDest{Subject: args[1], Weight: 100}
+	if len(args) == 3 {
+		weight, err := strconv.ParseUint(strings.TrimSuffix(args[2], "%"), 10, 8)
+		if err != nil || weight > 100 {
+			return d.Errf("invalid mapping weight: %s", args[2])
+		}
+		dest.Weight = uint8(weight)
+	}
+	for _, mapping := range acc.Mappings {
+		if mapping.Subject == args[0] {
+			total := int(dest.Weight)
+			for _, existing := range mapping.MapDest {
+				total += int(existing.Weight)
+			}
+			if total > 100 {
+				return d.Errf("total weight of mapping %s exceeds 100: %d", args[0], total)
+			}
+			mapping.MapDest = append(mapping.MapDest, dest)
+			return nil
+		}
+	}
+	acc.Mappings = append(acc.Mappings, &natsoptions.SubjectMapping{Subject: args[0], MapDest: []*server.MapDest{dest}})
+	return nil
+}
+
+// parseAccountLimits parses account limits. Syntax:
+//
+//	limits {
+//		max_connections <count>
+//		max_leafnodes <count>
+//		max_subscriptions <count>
+//		max_payload <size>
+//		jetstream {
+//			max_memory <size>
+//			max_store <size>
+//			max_streams <count>
+//			max_consumers <count>
+//			max_ack_pending <count>
+//			memory_max_stream_bytes <size>
+//			store_max_stream_bytes <size>
+//			max_bytes_required
+//			tier R<replicas> {
+//				...
+//			}
+//		}
+//	}
+func parseAccountLimits(d *caddyfile.Dispenser) (*natsoptions.AccountLimits, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	limits := &natsoptions.AccountLimits{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "max_connections":
+			err = parseInt32(d, &limits.MaxConnections)
+		case "max_leafnodes":
+			err = parseInt32(d, &limits.MaxLeafnodes)
+		case "max_subscriptions":
+			err = parseInt32(d, &limits.MaxSubscriptions)
+		case "max_payload":
+			err = parseSize32(d, &limits.MaxPayload)
+		case "jetstream":
+			limits.JetStream, err = parseAccountJetStreamLimits(d)
+		default:
+			return nil, d.Errf("unrecognized limits subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return limits, nil
+}
+
+// parseAccountJetStreamLimits parses account jetstream limits.
+// Tiered limits are parsed from tier blocks, other subdirectives
+// are parsed as global limits.
+func parseAccountJetStreamLimits(d *caddyfile.Dispenser) (*natsoptions.AccountJetStreamLimits, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	limits := &natsoptions.AccountJetStreamLimits{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() != "tier" {
+			if err := parseJetStreamTierLimit(d, &limits.JetStreamTierLimits); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var tier string
+		if !d.Args(&tier) {
+			return nil, d.ArgErr()
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		tierLimits := &natsoptions.JetStreamTierLimits{}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if err := parseJetStreamTierLimit(d, tierLimits); err != nil {
+				return nil, err
+			}
+		}
+		if limits.Tiers == nil {
+			limits.Tiers = map[string]*natsoptions.JetStreamTierLimits{}
+		}
+		limits.Tiers[tier] = tierLimits
+	}
+	return limits, nil
+}
+
+// parseJetStreamTierLimit parses a single jetstream limit.
+func parseJetStreamTierLimit(d *caddyfile.Dispenser, limits *natsoptions.JetStreamTierLimits) error {
+	switch d.Val() {
+	case "max_memory":
+		return parseSize(d, &limits.MaxMemory)
+	case "max_store":
+		return parseSize(d, &limits.MaxStore)
+	case "max_streams":
+		return parseInt(d, &limits.MaxStreams)
+	case "max_consumers":
+		return parseInt(d, &limits.MaxConsumers)
+	case "max_ack_pending":
+		return parseInt(d, &limits.MaxAckPending)
+	case "memory_max_stream_bytes":
+		return parseSize(d, &limits.MemoryMaxStreamBytes)
+	case "store_max_stream_bytes":
+		return parseSize(d, &limits.StoreMaxStreamBytes)
+	case "max_bytes_required":
+		return parseBool(d, &limits.MaxBytesRequired)
+	default:
+		return d.Errf("unrecognized jetstream limits subdirective: %s", d.Val())
+	}
+}
+
+// parseAuthorizationMap parses an authorization block. Syntax:
+//
+//	authorization {
+//		token <token>
+//		user <user>
+//		password <password>
+//		users <user> [<password>] {
+//			...
+//		}
+//		timeout <duration>
+//		auth_callout {
+//			issuer <public key>
+//			account <account>
+//			auth_users <users...>
+//			xkey <public key>
+//		}
+//	}
+func parseAuthorizationMap(d *caddyfile.Dispenser) (*natsoptions.AuthorizationMap, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	auth := &natsoptions.AuthorizationMap{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "token":
+			err = parseString(d, &auth.Token)
+		case "user":
+			err = parseString(d, &auth.User)
+		case "password":
+			err = parseString(d, &auth.Password)
+		case "users":
+			var user natsoptions.User
+			user, err = parseUser(d)
+			if err == nil {
+				auth.Users = append(auth.Users, user)
+			}
+		case "timeout":
+			err = ParseDuration(d, &auth.Timeout)
+		case "auth_callout":
+			auth.AuthCallout, err = parseAuthCalloutMap(d)
+		default:
+			return nil, d.Errf("unrecognized authorization subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// parseAuthCalloutMap parses an auth_callout block.
+func parseAuthCalloutMap(d *caddyfile.Dispenser) (*natsoptions.AuthCalloutMap, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	callout := &natsoptions.AuthCalloutMap{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "issuer":
+			err = parseString(d, &callout.Issuer)
+		case "account":
+			err = parseString(d, &callout.Account)
+		case "auth_users":
+			err = parseStrings(d, &callout.AuthUsers)
+		case "xkey":
+			err = parseString(d, &callout.XKey)
+		default:
+			return nil, d.Errf("unrecognized auth_callout subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return callout, nil
+}
+
+// parseFullResolver parses a full_resolver block.
+func parseFullResolver(d *caddyfile.Dispenser) (*natsoptions.FullAccountResolver, error) {
+	resolver := &natsoptions.FullAccountResolver{}
+	if d.NextArg() {
+		resolver.Path = d.Val()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "path":
+			err = parseString(d, &resolver.Path)
+		case "limit":
+			err = parseInt64(d, &resolver.Limit)
+		case "interval":
+			err = ParseDuration(d, &resolver.SyncInterval)
+		case "allow_delete":
+			err = parseBool(d, &resolver.AllowDelete)
+		case "hard_delete":
+			err = parseBool(d, &resolver.HardDelete)
+		case "preload":
+			err = parseStrings(d, &resolver.Preload)
+		default:
+			return nil, d.Errf("unrecognized full_resolver subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// parseCacheResolver parses a cache_resolver block.
+func parseCacheResolver(d *caddyfile.Dispenser) (*natsoptions.CacheAccountResolver, error) {
+	resolver := &natsoptions.CacheAccountResolver{}
+	if d.NextArg() {
+		resolver.Path = d.Val()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "path":
+			err = parseString(d, &resolver.Path)
+		case "limit":
+			err = parseInt(d, &resolver.Limit)
+		case "ttl":
+			err = ParseDuration(d, &resolver.TTL)
+		case "preload":
+			err = parseStrings(d, &resolver.Preload)
+		default:
+			return nil, d.Errf("unrecognized cache_resolver subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// parseMemoryResolver parses a memory_resolver block.
+func parseMemoryResolver(d *caddyfile.Dispenser) (*natsoptions.MemoryAccountResolver, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	resolver := &natsoptions.MemoryAccountResolver{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "limit":
+			err = parseInt(d, &resolver.Limit)
+		case "preload":
+			err = parseStrings(d, &resolver.Preload)
+		default:
+			return nil, d.Errf("unrecognized memory_resolver subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// parseCluster parses a cluster block. Syntax:
+//
+//	cluster <name> {
+//		host <host>
+//		port <port>
+//		advertise <address>
+//		routes <urls...>
+//		tls [<subjects...>] {
+//			...
+//		}
+//		no_tls
+//		no_advertise
+//		authorization {
+//			user <user>
+//			password <password>
+//			timeout <duration>
+//		}
+//		password_seed <seed>
+//		allowed_password_keys <public keys...>
+//		permissions {
+//			imports allow|deny <subjects...>
+//			exports allow|deny <subjects...>
+//		}
+//		connect_retries <count>
+//		pool_size <size>
+//		compression <mode> [<rtt thresholds...>]
+//	}
+func parseCluster(d *caddyfile.Dispenser) (*natsoptions.Cluster, error) {
+	cluster := &natsoptions.Cluster{}
+	if err := parseString(d, &cluster.Name); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "host":
+			err = parseString(d, &cluster.Host)
+		case "port":
+			err = parseInt(d, &cluster.Port)
+		case "advertise":
+			err = parseString(d, &cluster.Advertise)
+		case "routes":
+			err = parseStrings(d, &cluster.Routes)
+		case "tls":
+			cluster.TLS, err = parseTLSMap(d, cluster.TLS)
+		case "no_tls":
+			err = parseBool(d, &cluster.NoTLS)
+		case "no_advertise":
+			err = parseBool(d, &cluster.NoAdvertise)
+		case "authorization":
+			cluster.Authorization, err = parseAuthorizationMap(d)
+		case "password_seed":
+			err = parseString(d, &cluster.PasswordSeed)
+		case "allowed_password_keys":
+			err = parseStrings(d, &cluster.AllowedPasswordKeys)
+		case "permissions":
+			cluster.Permissions, err = parseRoutePermissions(d)
+		case "connect_retries":
+			err = parseInt(d, &cluster.ConnectRetries)
+		case "pool_size":
+			err = parseInt(d, &cluster.PoolSize)
+		case "compression":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cluster.Compression = &natsoptions.ClusterCompression{Mode: d.Val()}
+			for d.NextArg() {
+				threshold, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return nil, d.Errf("invalid rtt threshold: %v", err)
+				}
+				cluster.Compression.RTTThresholds = append(cluster.Compression.RTTThresholds, threshold)
+			}
+		default:
+			return nil, d.Errf("unrecognized cluster subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cluster, nil
+}
+
+// parseGateway parses a gateway block. Syntax:
+//
+//	gateway <name> {
+//		host <host>
+//		port <port>
+//		listen <host:port>
+//		advertise <address>
+//		authorization {
+//			user <user>
+//			password <password>
+//			timeout <duration>
+//		}
+//		tls [<subjects...>] {
+//			...
+//		}
+//		connect_retries <count>
+//		reject_unknown_cluster
+//		remote <name> <urls...> {
+//			tls {
+//				...
+//			}
+//		}
+//	}
+func parseGateway(d *caddyfile.Dispenser) (*natsoptions.Gateway, error) {
+	gateway := &natsoptions.Gateway{}
+	if err := parseString(d, &gateway.Name); err != nil {
+		return nil, err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "host":
+			err = parseString(d, &gateway.Host)
+		case "port":
+			err = parseInt(d, &gateway.Port)
+		case "listen":
+			var listen string
+			if err := parseString(d, &listen); err != nil {
+				return nil, err
+			}
+			host, port, err := net.SplitHostPort(listen)
+			if err != nil {
+				return nil, d.Errf("invalid listen address: %v", err)
+			}
+			gateway.Host = host
+			if gateway.Port, err = strconv.Atoi(port); err != nil {
+				return nil, d.Errf("invalid listen port: %s", port)
+			}
+		case "advertise":
+			err = parseString(d, &gateway.Advertise)
+		case "authorization":
+			gateway.Authorization, err = parseAuthorizationMap(d)
+		case "tls":
+			gateway.TLS, err = parseTLSMap(d, gateway.TLS)
+		case "connect_retries":
+			err = parseInt(d, &gateway.ConnectRetries)
+		case "reject_unknown_cluster":
+			err = parseBool(d, &gateway.RejectUnknown)
+		case "remote":
+			var remote natsoptions.RemoteGateway
+			remote, err = parseRemoteGateway(d)
+			if err == nil {
+				gateway.Gateways = append(gateway.Gateways, remote)
+			}
+		default:
+			return nil, d.Errf("unrecognized gateway subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gateway, nil
+}
+
+// parseRemoteGateway parses a remote gateway.
+func parseRemoteGateway(d *caddyfile.Dispenser) (natsoptions.RemoteGateway, error) {
+	remote := natsoptions.RemoteGateway{}
+	if !d.NextArg() {
+		return remote, d.ArgErr()
+	}
+	remote.Name = d.Val()
+	urls := d.RemainingArgs()
+	switch len(urls) {
+	case 0:
+		return remote, d.ArgErr()
+	case 1:
+		remote.Url = urls[0]
+	default:
+		remote.Urls = urls
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "tls":
+			remote.TLS, err = parseTLSMap(d, remote.TLS)
+		default:
+			return remote, d.Errf("unrecognized gateway remote subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return remote, err
+		}
+	}
+	return remote, nil
+}
+
+// parseWebsocket parses a websocket block. Syntax:
+//
+//	websocket {
+//		host <host>
+//		port <port>
+//		advertise <address>
+//		no_tls
+//		tls [<subjects...>] {
+//			...
+//		}
+//		username <user>
+//		password <password>
+//		no_auth_user <user>
+//		compression
+//		same_origin
+//		allowed_origins <origins...>
+//		jwt_cookie <cookie>
+//	}
+func parseWebsocket(d *caddyfile.Dispenser) (*natsoptions.Websocket, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	ws := &natsoptions.Websocket{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "host":
+			err = parseString(d, &ws.Host)
+		case "port":
+			err = parseInt(d, &ws.Port)
+		case "advertise":
+			err = parseString(d, &ws.Advertise)
+		case "no_tls":
+			err = parseBool(d, &ws.NoTLS)
+		case "tls":
+			ws.TLS, err = parseTLSMap(d, ws.TLS)
+		case "username":
+			err = parseString(d, &ws.Username)
+		case "password":
+			err = parseString(d, &ws.Password)
+		case "no_auth_user":
+			err = parseString(d, &ws.NoAuthUser)
+		case "compression":
+			err = parseBool(d, &ws.Compression)
+		case "same_origin":
+			err = parseBool(d, &ws.SameOrigin)
+		case "allowed_origins":
+			err = parseStrings(d, &ws.AllowedOrigins)
+		case "jwt_cookie":
+			err = parseString(d, &ws.JWTCookie)
+		default:
+			return nil, d.Errf("unrecognized websocket subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// parseMQTT parses an mqtt block. Syntax:
+//
+//	mqtt {
+//		host <host>
+//		port <port>
+//		jetstream_domain <domain>
+//		stream_replicas <count>
+//		username <user>
+//		password <password>
+//		no_auth_user <user>
+//		auth_timeout <seconds>
+//		no_tls
+//		tls [<subjects...>] {
+//			...
+//		}
+//	}
+func parseMQTT(d *caddyfile.Dispenser) (*natsoptions.MQTT, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	mqtt := &natsoptions.MQTT{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "host":
+			err = parseString(d, &mqtt.Host)
+		case "port":
+			err = parseInt(d, &mqtt.Port)
+		case "jetstream_domain":
+			err = parseString(d, &mqtt.JSDomain)
+		case "stream_replicas":
+			err = parseInt(d, &mqtt.StreamReplicas)
+		case "username":
+			err = parseString(d, &mqtt.Username)
+		case "password":
+			err = parseString(d, &mqtt.Password)
+		case "no_auth_user":
+			err = parseString(d, &mqtt.NoAuthUser)
+		case "auth_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			mqtt.AuthTimeout, err = strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("invalid auth timeout: %s", d.Val())
+			}
+		case "no_tls":
+			err = parseBool(d, &mqtt.NoTLS)
+		case "tls":
+			mqtt.TLS, err = parseTLSMap(d, mqtt.TLS)
+		default:
+			return nil, d.Errf("unrecognized mqtt subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mqtt, nil
+}
+
+// parseJetStream parses a jetstream block. Syntax:
+//
+//	jetstream [<store_dir>] {
+//		domain <domain>
+//		unique_tag <tag>
+//		store_dir <path>
+//		max_memory <size>
+//		max_file <size>
+//	}
+func parseJetStream(d *caddyfile.Dispenser) (*natsoptions.JetStream, error) {
+	js := &natsoptions.JetStream{}
+	if d.NextArg() {
+		js.StoreDir = d.Val()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "domain":
+			err = parseString(d, &js.Domain)
+		case "unique_tag":
+			err = parseString(d, &js.UniqueTag)
+		case "store_dir":
+			err = parseString(d, &js.StoreDir)
+		case "max_memory":
+			err = parseSize(d, &js.MaxMemory)
+		case "max_file":
+			err = parseSize(d, &js.MaxFile)
+		default:
+			return nil, d.Errf("unrecognized jetstream subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return js, nil
+}
+
+// parseLeafnode parses a leafnode block. Syntax:
+//
+//	leafnode {
+//		host <host>
+//		port <port>
+//		advertise <address>
+//		no_tls
+//		tls [<subjects...>] {
+//			...
+//		}
+//		remote <urls...> {
+//			hub
+//			account <account>
+//			credentials <path>
+//			deny_imports <subjects...>
+//			deny_exports <subjects...>
+//			no_randomize
+//			websocket_compression
+//			websocket_no_masking
+//		}
+//	}
+func parseLeafnode(d *caddyfile.Dispenser) (*natsoptions.Leafnode, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	leaf := &natsoptions.Leafnode{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "host":
+			err = parseString(d, &leaf.Host)
+		case "port":
+			err = parseInt(d, &leaf.Port)
+		case "advertise":
+			err = parseString(d, &leaf.Advertise)
+		case "no_tls":
+			err = parseBool(d, &leaf.NoTLS)
+		case "tls":
+			leaf.TLS, err = parseTLSMap(d, leaf.TLS)
+		case "remote":
+			var remote natsoptions.Remote
+			remote, err = parseRemote(d)
+			if err == nil {
+				leaf.Remotes = append(leaf.Remotes, remote)
+			}
+		default:
+			return nil, d.Errf("unrecognized leafnode subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leaf, nil
+}
+
+// parseRemote parses a leafnode remote.
+func parseRemote(d *caddyfile.Dispenser) (natsoptions.Remote, error) {
+	remote := natsoptions.Remote{}
+	urls := d.RemainingArgs()
+	switch len(urls) {
+	case 0:
+		return remote, d.ArgErr()
+	case 1:
+		remote.Url = urls[0]
+	default:
+		remote.Urls = urls
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "hub":
+			err = parseBool(d, &remote.Hub)
+		case "account":
+			err = parseString(d, &remote.Account)
+		case "credentials":
+			err = parseString(d, &remote.Credentials)
+		case "deny_imports":
+			err = parseStrings(d, &remote.DenyImports)
+		case "deny_exports":
+			err = parseStrings(d, &remote.DenyExports)
+		case "no_randomize":
+			err = parseBool(d, &remote.NoRandomize)
+		case "websocket_compression":
+			err = parseBool(d, &remote.Websocket.Compression)
+		case "websocket_no_masking":
+			err = parseBool(d, &remote.Websocket.NoMasking)
+		default:
+			return remote, d.Errf("unrecognized remote subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return remote, err
+		}
+	}
+	return remote, nil
+}
+
+// parseMetrics parses a metrics block. Syntax:
+//
+//	metrics {
+//		server_label <label>
+//		server_url <url>
+//		healthz
+//		connz
+//		connz_detailed
+//		subz
+//		routez
+//		gatewayz
+//		leafz
+//		replicator_varz
+//		jsz_filter <filter>
+//	}
+func parseMetrics(d *caddyfile.Dispenser) (*natsoptions.Metrics, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	metrics := &natsoptions.Metrics{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "server_label":
+			err = parseString(d, &metrics.ServerLabel)
+		case "server_url":
+			err = parseString(d, &metrics.ServerUrl)
+		case "healthz":
+			err = parseBool(d, &metrics.Healthz)
+		case "connz":
+			err = parseBool(d, &metrics.Connz)
+		case "connz_detailed":
+			err = parseBool(d, &metrics.ConnzDetailed)
+		case "subz":
+			err = parseBool(d, &metrics.Subz)
+		case "routez":
+			err = parseBool(d, &metrics.Routez)
+		case "gatewayz":
+			err = parseBool(d, &metrics.Gatewayz)
+		case "leafz":
+			err = parseBool(d, &metrics.Leafz)
+		case "replicator_varz":
+			err = parseBool(d, &metrics.ReplicatorVarz)
+		case "jsz_filter":
+			err = parseString(d, &metrics.JszFilter)
+		default:
+			return nil, d.Errf("unrecognized metrics subdirective: %s", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,462 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/charbonnierg/caddy-nats/modules"
+	_ "github.com/charbonnierg/caddy-nats/modules/auth_callout"
+	"github.com/nats-io/nats.go"
+)
+
+func adaptNatsApp(t *testing.T, input string) *modules.App {
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	out, _, err := adapter.Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("failed to adapt caddyfile: %s", err.Error())
+	}
+	config := struct {
+		Apps map[string]json.RawMessage `json:"apps"`
+	}{}
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatalf("failed to decode adapted config: %s", err.Error())
+	}
+	raw, ok := config.Apps["nats"]
+	if !ok {
+		t.Fatalf("nats app is missing from adapted config: %s", string(out))
+	}
+	app := &modules.App{}
+	if err := json.Unmarshal(raw, app); err != nil {
+		t.Fatalf("failed to decode nats app: %s", err.Error())
+	}
+	return app
+}
+
+func TestCaddyfileServerOptions(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		ready_timeout 5s
+		server {
+			name test
+			port 4223
+			http_port 8223
+			max_payload 2MB
+			jetstream /tmp/js {
+				max_memory 1GB
+			}
+			websocket {
+				port 10443
+				tls localhost
+			}
+			account APP {
+				jetstream
+				user app secret {
+					permissions {
+						publish allow foo.>
+						subscribe deny bar
+					}
+				}
+				export service svc.> {
+					accounts OTHER
+				}
+				limits {
+					max_connections 10
+				}
+			}
+			account OTHER {
+				imports service svc.> APP {
+					to other.svc.>
+				}
+			}
+		}
+	}
+}`)
+	if app.ReadyTimeout.Seconds() != 5 {
+		t.Errorf("unexpected ready timeout: %s", app.ReadyTimeout)
+	}
+	opts := app.Options
+	if opts == nil {
+		t.Fatal("server options are missing")
+	}
+	if opts.ServerName != "test" || opts.Port != 4223 || opts.HTTPPort != 8223 {
+		t.Errorf("unexpected server options: %+v", opts)
+	}
+	if opts.MaxPayload != 2*1024*1024 {
+		t.Errorf("unexpected max payload: %d", opts.MaxPayload)
+	}
+	if opts.JetStream == nil || opts.JetStream.StoreDir != "/tmp/js" || opts.JetStream.MaxMemory != 1024*1024*1024 {
+		t.Errorf("unexpected jetstream options: %+v", opts.JetStream)
+	}
+	if opts.Websocket == nil || opts.Websocket.Port != 10443 || opts.Websocket.TLS == nil || len(opts.Websocket.TLS.Subjects) != 1 {
+		t.Errorf("unexpected websocket options: %+v", opts.Websocket)
+	}
+	if len(opts.Accounts) != 2 {
+		t.Fatalf("unexpected number of accounts: %d", len(opts.Accounts))
+	}
+	acc := opts.Accounts[0]
+	if acc.Name != "APP" || !acc.JetStream || len(acc.Users) != 1 || len(acc.Exports) != 1 {
+		t.Errorf("unexpected account: %+v", acc)
+	}
+	user := acc.Users[0]
+	if user.User != "app" || user.Password != "secret" || user.Permissions == nil || user.Permissions.Publish.Allow[0] != "foo.>" || user.Permissions.Subscribe.Deny[0] != "bar" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	if acc.Limits == nil || acc.Limits.MaxConnections != 10 {
+		t.Errorf("unexpected account limits: %+v", acc.Limits)
+	}
+	imp := opts.Accounts[1].Imports
+	if len(imp) != 1 || imp[0].Service != "svc.>" || imp[0].Account != "APP" || imp[0].To != "other.svc.>" {
+		t.Errorf("unexpected imports: %+v", imp)
+	}
+}
+
+func TestCaddyfileManagedTLS(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		server {
+			name test
+			jetstream
+			mqtt {
+				tls mqtt.example.com
+			}
+			cluster test {
+				tls route.example.com {
+					client_ca local
+				}
+			}
+		}
+	}
+}`)
+	opts := app.Options
+	if opts.MQTT == nil || opts.MQTT.TLS == nil || len(opts.MQTT.TLS.Subjects) != 1 || opts.MQTT.TLS.Subjects[0] != "mqtt.example.com" {
+		t.Errorf("unexpected mqtt options: %+v", opts.MQTT)
+	}
+	if opts.Cluster == nil || opts.Cluster.TLS == nil || opts.Cluster.TLS.Subjects[0] != "route.example.com" || opts.Cluster.TLS.ClientCA != "local" {
+		t.Errorf("unexpected cluster options: %+v", opts.Cluster)
+	}
+}
+
+func TestCaddyfileClusterAuthorization(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		server {
+			cluster test {
+				routes nats-route://node-1:6222 nats-route://node-2:6222
+				authorization {
+					user route
+					password secret
+				}
+				permissions {
+					imports allow foo.>
+					exports deny secret.>
+				}
+				tls {
+					cert_file route.pem
+					key_file route.key
+					pinned_certs abc
+				}
+			}
+		}
+	}
+}`)
+	cluster := app.Options.Cluster
+	if cluster == nil || cluster.Authorization == nil || cluster.Authorization.User != "route" || cluster.Authorization.Password != "secret" {
+		t.Fatalf("unexpected cluster authorization: %+v", cluster)
+	}
+	if cluster.Permissions == nil || cluster.Permissions.Import.Allow[0] != "foo.>" || cluster.Permissions.Export.Deny[0] != "secret.>" {
+		t.Errorf("unexpected cluster permissions: %+v", cluster.Permissions)
+	}
+	if cluster.TLS == nil || len(cluster.TLS.PinnedCerts) != 1 {
+		t.Errorf("unexpected cluster tls: %+v", cluster.TLS)
+	}
+}
+
+func TestCaddyfileGateway(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		server {
+			cluster east
+			gateway east {
+				listen 0.0.0.0:7222
+				authorization {
+					user gw
+					password secret
+				}
+				tls gateway.example.com {
+					client_ca local
+				}
+				reject_unknown_cluster
+				remote west nats://west-1:7222 nats://west-2:7222
+			}
+		}
+	}
+}`)
+	gw := app.Options.Gateway
+	if gw == nil || gw.Name != "east" || gw.Host != "0.0.0.0" || gw.Port != 7222 || !gw.RejectUnknown {
+		t.Fatalf("unexpected gateway options: %+v", gw)
+	}
+	if gw.Authorization == nil || gw.Authorization.User != "gw" || gw.TLS == nil || gw.TLS.ClientCA != "local" {
+		t.Errorf("unexpected gateway options: %+v", gw)
+	}
+	if len(gw.Gateways) != 1 || gw.Gateways[0].Name != "west" || len(gw.Gateways[0].Urls) != 2 {
+		t.Errorf("unexpected remote gateways: %+v", gw.Gateways)
+	}
+}
+
+func TestCaddyfileAuthService(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		auth_service {
+			internal_account AUTH
+			policy {
+				match connect_opts {
+					username SYS
+				}
+				handler allow SYS
+			}
+			handler deny
+			cache {
+				ttl 30s
+				negative_ttl 2s
+				max_entries 100
+			}
+			audit auth.events {
+				stream EVENTS {
+					max_age 24h
+					max_bytes 1GB
+					storage memory
+				}
+			}
+		}
+	}
+}`)
+	svc := app.AuthService
+	if svc == nil {
+		t.Fatal("auth service is missing")
+	}
+	if svc.InternalAccount != "AUTH" {
+		t.Errorf("unexpected internal account: %s", svc.InternalAccount)
+	}
+	if string(svc.DefaultHandlerRaw) != `{"module":"deny"}` {
+		t.Errorf("unexpected default handler: %s", string(svc.DefaultHandlerRaw))
+	}
+	if len(svc.Policies) != 1 {
+		t.Fatalf("unexpected number of policies: %d", len(svc.Policies))
+	}
+	policy := svc.Policies[0]
+	if string(policy.HandlerRaw) != `{"account":"SYS","module":"allow"}` {
+		t.Errorf("unexpected policy handler: %s", string(policy.HandlerRaw))
+	}
+	if len(policy.MatchersRaw) != 1 || string(policy.MatchersRaw[0]["connect_opts"]) != `{"username":"SYS"}` {
+		t.Errorf("unexpected policy matchers: %+v", policy.MatchersRaw)
+	}
+	if svc.Cache == nil || svc.Cache.TTL != 30*time.Second || svc.Cache.NegativeTTL != 2*time.Second || svc.Cache.MaxEntries != 100 {
+		t.Errorf("unexpected cache: %+v", svc.Cache)
+	}
+	if svc.Audit == nil || svc.Audit.Subject != "auth.events" || svc.Audit.Stream == nil {
+		t.Fatalf("unexpected audit: %+v", svc.Audit)
+	}
+	if stream := svc.Audit.Stream; stream.Name != "EVENTS" || stream.MaxAge != 24*time.Hour || stream.MaxBytes != 1<<30 || stream.Storage != nats.MemoryStorage {
+		t.Errorf("unexpected audit stream: %+v", stream)
+	}
+}
+
+func TestCaddyfileUnknownSubdirective(t *testing.T) {
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	_, _, err := adapter.Adapt([]byte(`{
+	nats {
+		server {
+			unknown
+		}
+	}
+}`), nil)
+	if err == nil {
+		t.Fatal("expected an error for unknown subdirective")
+	}
+}
+
+func TestCaddyfileMappingWeights(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		server {
+			account APP {
+				mapping foo bar 40
+				mapping foo baz 60%
+			}
+		}
+	}
+}`)
+	mappings := app.Options.Accounts[0].Mappings
+	if len(mappings) != 1 || len(mappings[0].MapDest) != 2 {
+		t.Fatalf("unexpected mappings: %+v", mappings)
+	}
+	if mappings[0].MapDest[0].Weight != 40 || mappings[0].MapDest[1].Weight != 60 {
+		t.Errorf("unexpected mapping weights: %+v", mappings[0].MapDest)
+	}
+	adapter := caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}}
+	_, _, err := adapter.Adapt([]byte(`{
+	nats {
+		server {
+			account APP {
+				mapping foo bar
+				mapping foo baz
+			}
+		}
+	}
+}`), nil)
+	if err == nil {
+		t.Fatal("expected an error when mapping weights exceed 100")
+	}
+}
+
+func TestCaddyfileJetStreamResources(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		server {
+			jetstream
+			account APP {
+				jetstream
+				stream EVENTS {
+					subjects events.>
+					storage memory
+					retention workqueue
+					max_age 1h
+					consumer worker {
+						ack_policy explicit
+						max_ack_pending 10
+					}
+				}
+				key_value config {
+					history 5
+					max_bytes 1MB
+				}
+				object_store files {
+					storage memory
+				}
+			}
+		}
+	}
+}`)
+	acc := app.Options.Accounts[0]
+	if len(acc.Streams) != 1 || len(acc.KeyValueStores) != 1 || len(acc.ObjectStores) != 1 {
+		t.Fatalf("unexpected jetstream resources: %+v", acc)
+	}
+	stream := acc.Streams[0]
+	if stream.Name != "EVENTS" || stream.Storage != nats.MemoryStorage || stream.Retention != nats.WorkQueuePolicy || stream.MaxAge != time.Hour {
+		t.Errorf("unexpected stream: %+v", stream.StreamConfig)
+	}
+	if len(stream.Consumers) != 1 || stream.Consumers[0].Durable != "worker" || stream.Consumers[0].AckPolicy != nats.AckExplicitPolicy || stream.Consumers[0].MaxAckPending != 10 {
+		t.Errorf("unexpected consumers: %+v", stream.Consumers)
+	}
+	if acc.KeyValueStores[0].Bucket != "config" || acc.KeyValueStores[0].History != 5 || acc.KeyValueStores[0].MaxBytes != 1024*1024 {
+		t.Errorf("unexpected key value store: %+v", acc.KeyValueStores[0])
+	}
+	if acc.ObjectStores[0].Bucket != "files" || acc.ObjectStores[0].Storage != nats.MemoryStorage {
+		t.Errorf("unexpected object store: %+v", acc.ObjectStores[0])
+	}
+}
+
+func TestCaddyfileJetStreamTieredLimits(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		server {
+			jetstream
+			account APP {
+				jetstream
+				limits {
+					jetstream {
+						tier R1 {
+							max_store 1GB
+							max_ack_pending 100
+						}
+						tier R3 {
+							max_streams 2
+						}
+					}
+				}
+			}
+		}
+	}
+}`)
+	limits := app.Options.Accounts[0].Limits.JetStream
+	if len(limits.Tiers) != 2 {
+		t.Fatalf("unexpected tiered limits: %+v", limits.Tiers)
+	}
+	if limits.Tiers["R1"].MaxStore != 1024*1024*1024 || limits.Tiers["R1"].MaxAckPending != 100 || limits.Tiers["R3"].MaxStreams != 2 {
+		t.Errorf("unexpected tiered limits: R1=%+v R3=%+v", limits.Tiers["R1"], limits.Tiers["R3"])
+	}
+}
+
+func TestCaddyfilePolicyLogicalMatchers(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		auth_service {
+			policy {
+				match any {
+					connect_opts {
+						username alice
+					}
+					connect_opts {
+						username bob
+					}
+				}
+				match not {
+					client_info {
+						kind Leafnode
+					}
+				}
+				handler allow APP
+			}
+		}
+	}
+}`)
+	policy := app.AuthService.Policies[0]
+	if len(policy.MatchersRaw) != 1 {
+		t.Fatalf("unexpected policy matchers: %+v", policy.MatchersRaw)
+	}
+	if string(policy.MatchersRaw[0]["any"]) != `{"matchers":[{"connect_opts":{"username":"alice"}},{"connect_opts":{"username":"bob"}}]}` {
+		t.Errorf("unexpected any matcher: %s", policy.MatchersRaw[0]["any"])
+	}
+	if string(policy.MatchersRaw[0]["not"]) != `{"matchers":[{"client_info":{"kind":"Leafnode"}}]}` {
+		t.Errorf("unexpected not matcher: %s", policy.MatchersRaw[0]["not"])
+	}
+}
+
+func TestCaddyfilePolicyConnectionMatchers(t *testing.T) {
+	app := adaptNatsApp(t, `{
+	nats {
+		auth_service {
+			policy {
+				match remote_ip 10.0.0.0/8 192.168.1.10
+				match connection_type WEBSOCKET MQTT
+				match client_cert verified
+				match regexp {
+					name ^web-[0-9]+$
+				}
+				match glob {
+					username svc-*
+				}
+				handler allow APP
+			}
+		}
+	}
+}`)
+	matchers := app.AuthService.Policies[0].MatchersRaw[0]
+	expected := map[string]string{
+		"remote_ip":       `{"ranges":["10.0.0.0/8","192.168.1.10"]}`,
+		"connection_type": `{"types":["WEBSOCKET","MQTT"]}`,
+		"client_cert":     `{"verified":true}`,
+		"regexp":          `{"name":"^web-[0-9]+$"}`,
+		"glob":            `{"username":"svc-*"}`,
+	}
+	for name, value := range expected {
+		if string(matchers[name]) != value {
+			t.Errorf("unexpected %s matcher: %s", name, matchers[name])
+		}
+	}
+}
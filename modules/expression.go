@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/nats-io/jwt/v2"
+)
+
+// Expression is a CEL expression evaluated over an authorization request.
+// The following variables are available to expressions:
+//
+//   - client_info: client information sent by the server (e.g. client_info.host, client_info.kind)
+//   - connect_opts: client connect options (e.g. connect_opts.user, connect_opts.name)
+//   - tls: client TLS information (e.g. tls.version, tls.verified_chains), empty without TLS
+//   - user_nkey: the public key generated by the server for the user
+//   - claims: identity claims extracted by a handler, such as OIDC claims, empty by default
+//
+// Maps use the field names of the authorization request sent by the server.
+// The CEL strings extension is available (e.g. lowerAscii, split, replace).
+type Expression struct {
+	source  string
+	program cel.Program
+}
+
+var expressionEnv *cel.Env
+
+func init() {
+	env, err := cel.NewEnv(
+		cel.Variable("client_info", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("connect_opts", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("tls", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("user_nkey", cel.StringType),
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+	)
+	if err != nil {
+		panic(err)
+	}
+	expressionEnv = env
+}
+
+// CompileExpression parses and type-checks a CEL expression.
+// The expression must evaluate to the output type, or to a dynamic type
+// in which case the type is checked when the expression is evaluated.
+func CompileExpression(source string, output *cel.Type) (*Expression, error) {
+	ast, issues := expressionEnv.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %s: %s", source, issues.Err().Error())
+	}
+	if !output.IsAssignableType(ast.OutputType()) && !ast.OutputType().IsAssignableType(output) {
+		return nil, fmt.Errorf("invalid expression %s: expected %s, got %s", source, output, ast.OutputType())
+	}
+	program, err := expressionEnv.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %s: %s", source, err.Error())
+	}
+	return &Expression{source: source, program: program}, nil
+}
+
+// Eval evaluates the expression and converts the result to the type of dest.
+// Identity claims may be nil.
+func (e *Expression) Eval(request *jwt.AuthorizationRequestClaims, claims map[string]any, dest any) error {
+	vars, err := expressionVars(request, claims)
+	if err != nil {
+		return err
+	}
+	out, _, err := e.program.Eval(vars)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate expression %s: %s", e.source, err.Error())
+	}
+	target := reflect.ValueOf(dest).Elem()
+	value, err := out.ConvertToNative(target.Type())
+	if err != nil {
+		return fmt.Errorf("failed to evaluate expression %s: %s", e.source, err.Error())
+	}
+	target.Set(reflect.ValueOf(value))
+	return nil
+}
+
+// EvalBool evaluates an expression which returns a boolean.
+// It returns false when the expression cannot be evaluated.
+func (e *Expression) EvalBool(request *jwt.AuthorizationRequestClaims, claims map[string]any) bool {
+	var result bool
+	if err := e.Eval(request, claims, &result); err != nil {
+		return false
+	}
+	return result
+}
+
+// expressionVars returns the variables available to expressions.
+func expressionVars(request *jwt.AuthorizationRequestClaims, claims map[string]any) (map[string]any, error) {
+	vars := map[string]any{
+		"user_nkey": request.UserNkey,
+		"claims":    claims,
+	}
+	if claims == nil {
+		vars["claims"] = map[string]any{}
+	}
+	for name, value := range map[string]any{
+		"client_info":  request.ClientInformation,
+		"connect_opts": request.ConnectOptions,
+		"tls":          request.TLS,
+	} {
+		dest := map[string]any{}
+		if err := toMap(value, &dest); err != nil {
+			return nil, err
+		}
+		vars[name] = dest
+	}
+	return vars, nil
+}
+
+// toMap converts a struct to a map using its JSON representation.
+func toMap(value any, dest *map[string]any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if string(raw) == "null" {
+		return nil
+	}
+	return json.Unmarshal(raw, dest)
+}
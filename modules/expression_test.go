@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestExpressionMatcher(t *testing.T) {
+	matcher := &ExpressionMatcher{Expression: `connect_opts.user.startsWith("svc-") && client_info.kind == "Client" && !has(tls.certs)`}
+	if err := matcher.provision(); err != nil {
+		t.Fatal(err)
+	}
+	request := jwt.NewAuthorizationRequestClaims("UABC")
+	request.ConnectOptions.Username = "svc-orders"
+	request.ClientInformation.Kind = "Client"
+	if !matcher.Match(request) {
+		t.Error("expected expression matcher to match")
+	}
+	request.ConnectOptions.Username = "alice"
+	if matcher.Match(request) {
+		t.Error("expected expression matcher not to match")
+	}
+	// Expressions which fail to evaluate do not match
+	matcher = &ExpressionMatcher{Expression: `tls.version == "1.3"`}
+	if err := matcher.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if matcher.Match(request) {
+		t.Error("expected expression matcher not to match without TLS")
+	}
+	request.TLS = &jwt.ClientTLS{Version: "1.3"}
+	if !matcher.Match(request) {
+		t.Error("expected expression matcher to match with TLS")
+	}
+}
+
+func TestCompileExpression(t *testing.T) {
+	for name, test := range map[string]struct {
+		source string
+		output *cel.Type
+	}{
+		"syntax error":       {`connect_opts.user ==`, cel.BoolType},
+		"unknown variable":   {`user == "alice"`, cel.BoolType},
+		"invalid output":     {`"alice"`, cel.BoolType},
+		"invalid list":       {`[1, 2]`, cel.ListType(cel.StringType)},
+		"unknown function":   {`connect_opts.user.reverse() == "a"`, cel.BoolType},
+		"invalid comparison": {`user_nkey == 1`, cel.BoolType},
+	} {
+		if _, err := CompileExpression(test.source, test.output); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	for _, source := range []string{`claims.role`, `[connect_opts.user]`, `["a", "b"]`} {
+		output := cel.StringType
+		if source[0] == '[' {
+			output = cel.ListType(cel.StringType)
+		}
+		if _, err := CompileExpression(source, output); err != nil {
+			t.Errorf("%s: unexpected error: %s", source, err.Error())
+		}
+	}
+}
@@ -39,11 +39,32 @@ func (s *AuthService) setupInternalAuthAccount() error {
 		if s.InternalUser == "" {
 			s.InternalUser = pk
 		}
+		// Generate a curve keypair so that auth requests and responses are encrypted
+		if s.AuthXKey == "" {
+			xkp, err := nkeys.CreateCurveKeys()
+			if err != nil {
+				return errors.New("failed to create internal auth xkey")
+			}
+			xseed, err := xkp.Seed()
+			if err != nil {
+				return errors.New("failed to get internal auth xkey seed")
+			}
+			s.AuthXKey = string(xseed)
+		}
+		xkp, err := nkeys.FromCurveSeed([]byte(s.AuthXKey))
+		if err != nil {
+			return errors.New("invalid auth xkey seed")
+		}
+		xpk, err := xkp.PublicKey()
+		if err != nil {
+			return errors.New("failed to get internal auth xkey public key")
+		}
 		auth := natsoptions.AuthorizationMap{
 			AuthCallout: &natsoptions.AuthCalloutMap{
 				Issuer:    pk,
 				Account:   s.InternalAccount,
 				AuthUsers: []string{pk},
+				XKey:      xpk,
 			},
 		}
 		user := natsoptions.User{
@@ -52,6 +73,10 @@ func (s *AuthService) setupInternalAuthAccount() error {
 		acc := natsoptions.Account{
 			Name: s.InternalAccount, Users: []natsoptions.User{user},
 		}
+		// The audit stream is created in the auth account
+		if s.Audit != nil && s.Audit.Stream != nil {
+			acc.JetStream = true
+		}
 		s.AuthSigningKey = string(seed)
 		s.app.Options.Authorization = &auth
 		s.app.Options.Accounts = append(s.app.Options.Accounts, &acc)
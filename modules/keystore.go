@@ -0,0 +1,20 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"github.com/charbonnierg/caddy-nats/embedded/natsauth"
+	"github.com/nats-io/nats.go"
+)
+
+// Keystore is a keystore module used by the auth service to retrieve
+// the signing key of the target account of each authorization request.
+// Open is called when the auth service starts, before it listens for
+// authorization requests, with the auth service connection.
+// Close is called when the auth service stops.
+type Keystore interface {
+	natsauth.Keystore
+	Provision(app *App) error
+	Open(conn *nats.Conn) error
+	Close() error
+}
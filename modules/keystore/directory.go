@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/embedded/natsauth"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	caddy.RegisterModule(DirectoryKeystore{})
+}
+
+// A keystore reading account signing keys from a directory.
+// Each file is named after an account (account name or account public key
+// in operator mode) followed by the extension (".nk" by default), and holds
+// either a raw seed or a decorated nkey.
+type DirectoryKeystore struct {
+	keystore  *natsauth.DirKeystore
+	Directory string `json:"directory,omitempty"`
+	Extension string `json:"extension,omitempty"`
+}
+
+func (DirectoryKeystore) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.keystore.directory",
+		New: func() caddy.Module { return new(DirectoryKeystore) },
+	}
+}
+
+func (k *DirectoryKeystore) Provision(app *modules.App) error {
+	if k.Directory == "" {
+		return errors.New("keystore directory is required")
+	}
+	info, err := os.Stat(k.Directory)
+	if err != nil {
+		return fmt.Errorf("invalid keystore directory: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid keystore directory: %s is not a directory", k.Directory)
+	}
+	k.keystore = natsauth.NewDirKeystore(k.Directory, k.Extension)
+	return nil
+}
+
+func (k *DirectoryKeystore) Get(account string) (string, error) {
+	return k.keystore.Get(account)
+}
+
+// Open is a no-op, keys are read from the directory on each request.
+func (k *DirectoryKeystore) Open(conn *nats.Conn) error {
+	return nil
+}
+
+// Close is a no-op.
+func (k *DirectoryKeystore) Close() error {
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the keystore from Caddyfile tokens. Syntax:
+//
+//	directory [<path>] {
+//		path <path>
+//		extension <extension>
+//	}
+func (k *DirectoryKeystore) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			k.Directory = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "path":
+				if !d.AllArgs(&k.Directory) {
+					return d.ArgErr()
+				}
+			case "extension":
+				if !d.AllArgs(&k.Extension) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.Keystore      = (*DirectoryKeystore)(nil)
+	_ caddyfile.Unmarshaler = (*DirectoryKeystore)(nil)
+)
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package keystore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/embedded/natsauth"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/charbonnierg/caddy-nats/oauthproxy/session_store/jetstream"
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	caddy.RegisterModule(JetStreamKeystore{})
+}
+
+// A keystore reading account signing keys from a JetStream key value bucket.
+// Keys of the bucket are account names (or account public keys in operator mode)
+// and values are account seeds. The bucket must exist, it is never created.
+// By default, the bucket is opened using the auth service connection, so it
+// must be accessible to the auth callout user. When a client with servers or
+// credentials is configured, a dedicated connection is used instead.
+type JetStreamKeystore struct {
+	app      *modules.App
+	keystore *natsauth.KVKeystore
+	Bucket   string            `json:"bucket,omitempty"`
+	Client   *jetstream.Client `json:"client,omitempty"`
+}
+
+func (JetStreamKeystore) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.keystore.jetstream",
+		New: func() caddy.Module { return new(JetStreamKeystore) },
+	}
+}
+
+func (k *JetStreamKeystore) Provision(app *modules.App) error {
+	k.app = app
+	if k.Bucket == "" {
+		return errors.New("keystore bucket is required")
+	}
+	return nil
+}
+
+func (k *JetStreamKeystore) Get(account string) (string, error) {
+	if k.keystore == nil {
+		return "", errors.New("keystore bucket is not opened")
+	}
+	return k.keystore.Get(account)
+}
+
+// Open opens the keystore bucket. It is called by the auth service once
+// the embedded NATS server is started, before listening for requests.
+func (k *JetStreamKeystore) Open(conn *nats.Conn) error {
+	var js nats.JetStreamContext
+	var err error
+	if k.useDedicatedConnection() {
+		if k.Client.Internal {
+			if err := k.Client.ConfigureInProcessServer(k.app.Server()); err != nil {
+				return err
+			}
+		}
+		js, err = k.Client.Connect()
+	} else {
+		js, err = conn.JetStream(k.jetStreamOptions()...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open keystore bucket %s: %s", k.Bucket, err.Error())
+	}
+	bucket, err := js.KeyValue(k.Bucket)
+	if err != nil {
+		return fmt.Errorf("failed to open keystore bucket %s: %s", k.Bucket, err.Error())
+	}
+	k.keystore = natsauth.NewKVKeystore(bucket)
+	return nil
+}
+
+// Close closes the dedicated connection, if any.
+func (k *JetStreamKeystore) Close() error {
+	if k.useDedicatedConnection() {
+		k.Client.Close()
+	}
+	k.keystore = nil
+	return nil
+}
+
+// useDedicatedConnection returns true when the keystore client is configured
+// with servers or credentials and must not use the auth service connection.
+func (k *JetStreamKeystore) useDedicatedConnection() bool {
+	c := k.Client
+	if c == nil {
+		return false
+	}
+	return !c.Internal || c.Username != "" || c.Token != "" || c.Credentials != "" || c.Seed != "" || c.Jwt != ""
+}
+
+// jetStreamOptions returns the JetStream options to use with the auth service connection.
+func (k *JetStreamKeystore) jetStreamOptions() []nats.JSOpt {
+	opts := []nats.JSOpt{}
+	if k.Client == nil {
+		return opts
+	}
+	if k.Client.JSPrefix != "" {
+		opts = append(opts, nats.APIPrefix(k.Client.JSPrefix))
+	}
+	if k.Client.JSDomain != "" {
+		opts = append(opts, nats.Domain(k.Client.JSDomain))
+	}
+	return opts
+}
+
+// UnmarshalCaddyfile sets up the keystore from Caddyfile tokens. Syntax:
+//
+//	jetstream <bucket> {
+//		servers <urls...>
+//		username <username>
+//		password <password>
+//		credentials <path>
+//		jetstream_domain <domain>
+//	}
+//
+// When no servers nor credentials are configured, the keystore uses the auth service connection.
+func (k *JetStreamKeystore) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.Args(&k.Bucket) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		client := &jetstream.Client{}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "servers":
+				client.Servers = d.RemainingArgs()
+				if len(client.Servers) == 0 {
+					return d.ArgErr()
+				}
+			case "username":
+				if !d.AllArgs(&client.Username) {
+					return d.ArgErr()
+				}
+			case "password":
+				if !d.AllArgs(&client.Password) {
+					return d.ArgErr()
+				}
+			case "credentials":
+				if !d.AllArgs(&client.Credentials) {
+					return d.ArgErr()
+				}
+			case "jetstream_domain":
+				if !d.AllArgs(&client.JSDomain) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+		client.Internal = client.Servers == nil
+		k.Client = client
+	}
+	return nil
+}
+
+var (
+	_ modules.Keystore      = (*JetStreamKeystore)(nil)
+	_ caddyfile.Unmarshaler = (*JetStreamKeystore)(nil)
+)
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package keystore
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/charbonnierg/caddy-nats/embedded/natsauth"
+	"github.com/charbonnierg/caddy-nats/modules"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func init() {
+	caddy.RegisterModule(StaticKeystore{})
+}
+
+// A keystore holding account signing keys in configuration.
+// Keys are account names (or account public keys in operator mode)
+// and values are account seeds.
+type StaticKeystore struct {
+	keystore natsauth.StaticKeystore
+	Keys     map[string]string `json:"keys,omitempty"`
+}
+
+func (StaticKeystore) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.keystore.static",
+		New: func() caddy.Module { return new(StaticKeystore) },
+	}
+}
+
+func (k *StaticKeystore) Provision(app *modules.App) error {
+	repl := caddy.NewReplacer()
+	k.keystore = natsauth.StaticKeystore{}
+	for account, seed := range k.Keys {
+		seed = repl.ReplaceAll(seed, "")
+		if _, err := nkeys.FromSeed([]byte(seed)); err != nil {
+			return fmt.Errorf("invalid signing key for account %s", account)
+		}
+		k.keystore[account] = seed
+	}
+	return nil
+}
+
+func (k *StaticKeystore) Get(account string) (string, error) {
+	return k.keystore.Get(account)
+}
+
+// Open is a no-op, keys are held in configuration.
+func (k *StaticKeystore) Open(conn *nats.Conn) error {
+	return nil
+}
+
+// Close is a no-op.
+func (k *StaticKeystore) Close() error {
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the keystore from Caddyfile tokens. Syntax:
+//
+//	static {
+//		<account> <seed>
+//	}
+func (k *StaticKeystore) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			account := d.Val()
+			var seed string
+			if !d.AllArgs(&seed) {
+				return d.ArgErr()
+			}
+			if k.Keys == nil {
+				k.Keys = map[string]string{}
+			}
+			k.Keys[account] = seed
+		}
+	}
+	return nil
+}
+
+var (
+	_ modules.Keystore      = (*StaticKeystore)(nil)
+	_ caddyfile.Unmarshaler = (*StaticKeystore)(nil)
+)
@@ -3,7 +3,10 @@
 package modules
 
 import (
+	"strconv"
+
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/nats-io/jwt/v2"
 )
 
@@ -83,7 +86,94 @@ func (c *ConnectOptsMatcher) Match(request *jwt.AuthorizationRequestClaims) bool
 	return true
 }
 
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	client_info {
+//		host <host>
+//		user <user>
+//		kind <kind>
+//		type <type>
+//	}
+func (m *ClientInfoMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var dest *string
+			switch d.Val() {
+			case "host":
+				dest = &m.Host
+			case "user":
+				dest = &m.User
+			case "kind":
+				dest = &m.Kind
+			case "type":
+				dest = &m.Type
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+			if !d.AllArgs(dest) {
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	connect_opts {
+//		name <name>
+//		username <username>
+//		password <password>
+//		lang <lang>
+//		version <version>
+//		protocol <protocol>
+//	}
+func (c *ConnectOptsMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var dest *string
+			switch d.Val() {
+			case "name":
+				dest = &c.Name
+			case "username":
+				dest = &c.User
+			case "password":
+				dest = &c.Password
+			case "lang":
+				dest = &c.Lang
+			case "version":
+				dest = &c.Version
+			case "protocol":
+				var protocol string
+				if !d.AllArgs(&protocol) {
+					return d.ArgErr()
+				}
+				value, err := strconv.Atoi(protocol)
+				if err != nil {
+					return d.Errf("invalid protocol: %s", protocol)
+				}
+				c.Protocol = value
+				continue
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+			if !d.AllArgs(dest) {
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
 var (
-	_ Matcher = (*ClientInfoMatcher)(nil)
-	_ Matcher = (*ConnectOptsMatcher)(nil)
+	_ Matcher               = (*ClientInfoMatcher)(nil)
+	_ Matcher               = (*ConnectOptsMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*ClientInfoMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*ConnectOptsMatcher)(nil)
 )
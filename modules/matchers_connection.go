@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/jwt/v2"
+)
+
+func init() {
+	caddy.RegisterModule(RemoteIPMatcher{})
+	caddy.RegisterModule(ConnectionTypeMatcher{})
+	caddy.RegisterModule(ClientCertMatcher{})
+}
+
+// RemoteIPMatcher matches the client host against a list of IP addresses or CIDR ranges.
+type RemoteIPMatcher struct {
+	prefixes []netip.Prefix
+	Ranges   []string `json:"ranges,omitempty"`
+}
+
+func (RemoteIPMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.remote_ip",
+		New: func() caddy.Module { return new(RemoteIPMatcher) },
+	}
+}
+
+// Provision parses the IP ranges.
+func (m *RemoteIPMatcher) Provision(ctx caddy.Context) error {
+	return m.provision()
+}
+
+func (m *RemoteIPMatcher) provision() error {
+	if len(m.Ranges) == 0 {
+		return errors.New("remote_ip matcher requires at least one range")
+	}
+	m.prefixes = make([]netip.Prefix, 0, len(m.Ranges))
+	for _, value := range m.Ranges {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return fmt.Errorf("invalid IP address %s: %s", value, err.Error())
+			}
+			m.prefixes = append(m.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR range %s: %s", value, err.Error())
+		}
+		m.prefixes = append(m.prefixes, prefix.Masked())
+	}
+	return nil
+}
+
+func (m *RemoteIPMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	addr, err := netip.ParseAddr(request.ClientInformation.Host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range m.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionTypeMatcher matches the type of the client connection.
+// Types are jwt connection types: STANDARD, WEBSOCKET, MQTT and LEAFNODE.
+// LEAFNODE matches all leafnode connections, including websocket leafnodes.
+type ConnectionTypeMatcher struct {
+	Types []string `json:"types,omitempty"`
+}
+
+func (ConnectionTypeMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.connection_type",
+		New: func() caddy.Module { return new(ConnectionTypeMatcher) },
+	}
+}
+
+// Provision validates the connection types.
+func (m *ConnectionTypeMatcher) Provision(ctx caddy.Context) error {
+	return m.provision()
+}
+
+func (m *ConnectionTypeMatcher) provision() error {
+	if len(m.Types) == 0 {
+		return errors.New("connection_type matcher requires at least one type")
+	}
+	for idx, value := range m.Types {
+		value = strings.ToUpper(value)
+		switch value {
+		case jwt.ConnectionTypeStandard, jwt.ConnectionTypeWebsocket, jwt.ConnectionTypeMqtt, jwt.ConnectionTypeLeafnode:
+			m.Types[idx] = value
+		default:
+			return fmt.Errorf("invalid connection type: %s", value)
+		}
+	}
+	return nil
+}
+
+func (m *ConnectionTypeMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	connectionType := connectionTypeOf(request)
+	if connectionType == "" {
+		return false
+	}
+	for _, value := range m.Types {
+		if value == connectionType {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionTypeOf returns the jwt connection type of an authorization request
+// according to the client kind and type set by the server.
+func connectionTypeOf(request *jwt.AuthorizationRequestClaims) string {
+	switch request.ClientInformation.Kind {
+	case "Leafnode":
+		return jwt.ConnectionTypeLeafnode
+	case "Client":
+		switch request.ClientInformation.Type {
+		case "nats":
+			return jwt.ConnectionTypeStandard
+		case "websocket":
+			return jwt.ConnectionTypeWebsocket
+		case "mqtt":
+			return jwt.ConnectionTypeMqtt
+		}
+	}
+	return ""
+}
+
+// ClientCertMatcher matches clients which presented a TLS client certificate.
+// When verified is true, the certificate chain must have been verified by the server.
+type ClientCertMatcher struct {
+	Verified bool `json:"verified,omitempty"`
+}
+
+func (ClientCertMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.client_cert",
+		New: func() caddy.Module { return new(ClientCertMatcher) },
+	}
+}
+
+func (m *ClientCertMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	if request.TLS == nil {
+		return false
+	}
+	if len(request.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	return !m.Verified && len(request.TLS.Certs) > 0
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	remote_ip <ranges...>
+func (m *RemoteIPMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		values := d.RemainingArgs()
+		if len(values) == 0 {
+			return d.ArgErr()
+		}
+		m.Ranges = append(m.Ranges, values...)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	connection_type <types...>
+func (m *ConnectionTypeMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		values := d.RemainingArgs()
+		if len(values) == 0 {
+			return d.ArgErr()
+		}
+		m.Types = append(m.Types, values...)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	client_cert [verified]
+func (m *ClientCertMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			if d.Val() != "verified" {
+				return d.Errf("unrecognized argument: %s", d.Val())
+			}
+			m.Verified = true
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+var (
+	_ Matcher               = (*RemoteIPMatcher)(nil)
+	_ Matcher               = (*ConnectionTypeMatcher)(nil)
+	_ Matcher               = (*ClientCertMatcher)(nil)
+	_ caddy.Provisioner     = (*RemoteIPMatcher)(nil)
+	_ caddy.Provisioner     = (*ConnectionTypeMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*RemoteIPMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*ConnectionTypeMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*ClientCertMatcher)(nil)
+)
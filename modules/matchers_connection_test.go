@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestRemoteIPMatcher(t *testing.T) {
+	matcher := &RemoteIPMatcher{Ranges: []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}}
+	if err := matcher.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"10.1.2.3":          true,
+		"192.168.1.10":      true,
+		"192.168.1.11":      false,
+		"::ffff:10.1.2.3":   true,
+		"fd12::1":           true,
+		"172.16.0.1":        false,
+		"":                  false,
+		"not an ip address": false,
+	} {
+		request := jwt.NewAuthorizationRequestClaims("UABC")
+		request.ClientInformation.Host = host
+		if matcher.Match(request) != expected {
+			t.Errorf("%s: expected match to be %t", host, expected)
+		}
+	}
+	for _, ranges := range [][]string{nil, {"10.0.0.0/33"}, {"localhost"}} {
+		if err := (&RemoteIPMatcher{Ranges: ranges}).provision(); err == nil {
+			t.Errorf("%v: expected error", ranges)
+		}
+	}
+}
+
+func TestConnectionTypeMatcher(t *testing.T) {
+	matcher := &ConnectionTypeMatcher{Types: []string{"websocket", "LEAFNODE"}}
+	if err := matcher.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		kind     string
+		typ      string
+		expected bool
+	}{
+		{"Client", "websocket", true},
+		{"Client", "nats", false},
+		{"Client", "mqtt", false},
+		{"Leafnode", "", true},
+		{"JetStream", "", false},
+	} {
+		request := jwt.NewAuthorizationRequestClaims("UABC")
+		request.ClientInformation.Kind = test.kind
+		request.ClientInformation.Type = test.typ
+		if matcher.Match(request) != test.expected {
+			t.Errorf("%s %s: expected match to be %t", test.kind, test.typ, test.expected)
+		}
+	}
+	if err := (&ConnectionTypeMatcher{Types: []string{"LEAFNODE_WS"}}).provision(); err == nil {
+		t.Error("expected error for unsupported connection type")
+	}
+}
+
+func TestClientCertMatcher(t *testing.T) {
+	request := jwt.NewAuthorizationRequestClaims("UABC")
+	if (&ClientCertMatcher{}).Match(request) {
+		t.Error("expected no match without TLS")
+	}
+	request.TLS = &jwt.ClientTLS{Version: "1.3"}
+	if (&ClientCertMatcher{}).Match(request) {
+		t.Error("expected no match without certificate")
+	}
+	request.TLS.Certs = jwt.StringList{"cert"}
+	if !(&ClientCertMatcher{}).Match(request) {
+		t.Error("expected match with certificate")
+	}
+	if (&ClientCertMatcher{Verified: true}).Match(request) {
+		t.Error("expected no match with unverified certificate")
+	}
+	request.TLS = &jwt.ClientTLS{VerifiedChains: []jwt.StringList{{"cert", "ca"}}}
+	if !(&ClientCertMatcher{Verified: true}).Match(request) {
+		t.Error("expected match with verified certificate")
+	}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/cel-go/cel"
+	"github.com/nats-io/jwt/v2"
+)
+
+func init() {
+	caddy.RegisterModule(ExpressionMatcher{})
+}
+
+// ExpressionMatcher matches when a CEL expression evaluates to true.
+// Expressions which cannot be evaluated do not match.
+// See Expression for the variables available to expressions. Matchers are evaluated
+// before handlers, so the "claims" variable is always empty: OIDC claims can be checked
+// with the condition of the oauth2 handler, or by an expression handler chained after it.
+type ExpressionMatcher struct {
+	expression *Expression
+	Expression string `json:"expression"`
+}
+
+func (ExpressionMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.expression",
+		New: func() caddy.Module { return new(ExpressionMatcher) },
+	}
+}
+
+// Provision compiles and type-checks the expression.
+func (m *ExpressionMatcher) Provision(ctx caddy.Context) error {
+	return m.provision()
+}
+
+func (m *ExpressionMatcher) provision() error {
+	if m.Expression == "" {
+		return errors.New("expression matcher requires an expression")
+	}
+	expression, err := CompileExpression(m.Expression, cel.BoolType)
+	if err != nil {
+		return err
+	}
+	m.expression = expression
+	return nil
+}
+
+func (m *ExpressionMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	if m.expression == nil {
+		return false
+	}
+	return m.expression.EvalBool(request, nil)
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	expression <expression>
+func (m *ExpressionMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&m.Expression) {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+var (
+	_ Matcher               = (*ExpressionMatcher)(nil)
+	_ caddy.Provisioner     = (*ExpressionMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*ExpressionMatcher)(nil)
+)
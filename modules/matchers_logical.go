@@ -0,0 +1,271 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/jwt/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AnyMatcher{})
+	caddy.RegisterModule(AllMatcher{})
+	caddy.RegisterModule(NotMatcher{})
+}
+
+// Match returns true when all matchers match.
+// It returns false when there is no matcher.
+func (ms Matchers) Match(request *jwt.AuthorizationRequestClaims) bool {
+	if len(ms) == 0 {
+		return false
+	}
+	for _, m := range ms {
+		if !m.Match(request) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatcherSets is a list of matcher sets.
+// Matchers of a set are ANDed.
+type MatcherSets []Matchers
+
+// AnyMatch returns true when at least one matcher set matches.
+func (sets MatcherSets) AnyMatch(request *jwt.AuthorizationRequestClaims) bool {
+	for _, set := range sets {
+		if set.Match(request) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllMatch returns true when all matcher sets match.
+// It returns false when there is no matcher set.
+func (sets MatcherSets) AllMatch(request *jwt.AuthorizationRequestClaims) bool {
+	if len(sets) == 0 {
+		return false
+	}
+	for _, set := range sets {
+		if !set.Match(request) {
+			return false
+		}
+	}
+	return true
+}
+
+// AnyMatcher matches when at least one of its matcher sets matches.
+type AnyMatcher struct {
+	sets           MatcherSets
+	MatcherSetsRaw []map[string]json.RawMessage `json:"matchers,omitempty" caddy:"namespace=nats.matchers"`
+}
+
+func (AnyMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.any",
+		New: func() caddy.Module { return new(AnyMatcher) },
+	}
+}
+
+// Provision loads the matcher sets.
+func (m *AnyMatcher) Provision(ctx caddy.Context) error {
+	sets, err := loadMatcherSets(ctx, m, "MatcherSetsRaw")
+	if err != nil {
+		return err
+	}
+	m.sets = sets
+	return nil
+}
+
+func (m *AnyMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	return m.sets.AnyMatch(request)
+}
+
+// AllMatcher matches when all of its matcher sets match.
+// Unlike the matchers of a policy, the same matcher module can be used several times.
+type AllMatcher struct {
+	sets           MatcherSets
+	MatcherSetsRaw []map[string]json.RawMessage `json:"matchers,omitempty" caddy:"namespace=nats.matchers"`
+}
+
+func (AllMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.all",
+		New: func() caddy.Module { return new(AllMatcher) },
+	}
+}
+
+// Provision loads the matcher sets.
+func (m *AllMatcher) Provision(ctx caddy.Context) error {
+	sets, err := loadMatcherSets(ctx, m, "MatcherSetsRaw")
+	if err != nil {
+		return err
+	}
+	m.sets = sets
+	return nil
+}
+
+func (m *AllMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	return m.sets.AllMatch(request)
+}
+
+// NotMatcher matches when none of its matcher sets match.
+type NotMatcher struct {
+	sets           MatcherSets
+	MatcherSetsRaw []map[string]json.RawMessage `json:"matchers,omitempty" caddy:"namespace=nats.matchers"`
+}
+
+func (NotMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.not",
+		New: func() caddy.Module { return new(NotMatcher) },
+	}
+}
+
+// Provision loads the matcher sets.
+func (m *NotMatcher) Provision(ctx caddy.Context) error {
+	sets, err := loadMatcherSets(ctx, m, "MatcherSetsRaw")
+	if err != nil {
+		return err
+	}
+	m.sets = sets
+	return nil
+}
+
+func (m *NotMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	return !m.sets.AnyMatch(request)
+}
+
+// loadMatcherSets loads matcher sets from a field of type []map[string]json.RawMessage.
+func loadMatcherSets(ctx caddy.Context, structPointer any, fieldName string) (MatcherSets, error) {
+	unm, err := ctx.LoadModule(structPointer, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load matchers: %s", err.Error())
+	}
+	raw, ok := unm.([]map[string]interface{})
+	if !ok {
+		return nil, errors.New("matchers invalid type: must be an array of maps")
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("at least one matcher is required")
+	}
+	sets := make(MatcherSets, 0, len(raw))
+	for _, set := range raw {
+		matchers := Matchers{}
+		for _, m := range set {
+			matcher, ok := m.(Matcher)
+			if !ok {
+				return nil, errors.New("matcher invalid type: must be a matcher")
+			}
+			matchers = append(matchers, matcher)
+		}
+		sets = append(sets, matchers)
+	}
+	return sets, nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens.
+// Each matcher of the block is a matcher set. Syntax:
+//
+//	any {
+//		<matcher> ...
+//	}
+func (m *AnyMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	sets, err := parseMatcherSets(d, false)
+	if err != nil {
+		return err
+	}
+	m.MatcherSetsRaw = append(m.MatcherSetsRaw, sets...)
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens.
+// Each matcher of the block is a matcher set. Syntax:
+//
+//	all {
+//		<matcher> ...
+//	}
+func (m *AllMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	sets, err := parseMatcherSets(d, false)
+	if err != nil {
+		return err
+	}
+	m.MatcherSetsRaw = append(m.MatcherSetsRaw, sets...)
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens.
+// Matchers of the block form a single matcher set, so the matcher
+// negates the AND of all matchers. Syntax:
+//
+//	not {
+//		<matcher> ...
+//	}
+func (m *NotMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	sets, err := parseMatcherSets(d, true)
+	if err != nil {
+		return err
+	}
+	m.MatcherSetsRaw = append(m.MatcherSetsRaw, sets...)
+	return nil
+}
+
+// parseMatcherSets parses matchers of a logical matcher block.
+// When single is true, all matchers are added to a single matcher set,
+// else each matcher is added to its own matcher set.
+func parseMatcherSets(d *caddyfile.Dispenser, single bool) ([]map[string]json.RawMessage, error) {
+	sets := []map[string]json.RawMessage{}
+	for d.Next() {
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			name := d.Val()
+			raw, err := parseMatcher(d)
+			if err != nil {
+				return nil, err
+			}
+			if single && len(sets) > 0 {
+				if _, ok := sets[0][name]; ok {
+					return nil, d.Errf("duplicate matcher: %s", name)
+				}
+				sets[0][name] = raw
+				continue
+			}
+			sets = append(sets, map[string]json.RawMessage{name: raw})
+		}
+	}
+	if len(sets) == 0 {
+		return nil, d.Err("at least one matcher is required")
+	}
+	return sets, nil
+}
+
+// parseMatcher parses a matcher module and returns its JSON representation.
+// The dispenser is expected to be positioned on the matcher module name.
+func parseMatcher(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	unm, err := caddyfile.UnmarshalModule(d, "nats.matchers."+d.Val())
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSON(unm, nil), nil
+}
+
+var (
+	_ Matcher               = (*AnyMatcher)(nil)
+	_ Matcher               = (*AllMatcher)(nil)
+	_ Matcher               = (*NotMatcher)(nil)
+	_ caddy.Provisioner     = (*AnyMatcher)(nil)
+	_ caddy.Provisioner     = (*AllMatcher)(nil)
+	_ caddy.Provisioner     = (*NotMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*AnyMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*AllMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*NotMatcher)(nil)
+)
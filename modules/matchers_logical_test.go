@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func newMatcherRequest(username string, kind string) *jwt.AuthorizationRequestClaims {
+	claims := jwt.NewAuthorizationRequestClaims("UABC")
+	claims.ConnectOptions.Username = username
+	claims.ClientInformation.Kind = kind
+	return claims
+}
+
+func usernameMatcher(username string) Matchers {
+	return Matchers{&ConnectOptsMatcher{User: username}}
+}
+
+func TestAnyMatcher(t *testing.T) {
+	matcher := &AnyMatcher{sets: MatcherSets{usernameMatcher("alice"), usernameMatcher("bob")}}
+	if !matcher.Match(newMatcherRequest("alice", "Client")) || !matcher.Match(newMatcherRequest("bob", "Client")) {
+		t.Error("expected any matcher to match")
+	}
+	if matcher.Match(newMatcherRequest("eve", "Client")) {
+		t.Error("expected any matcher not to match")
+	}
+}
+
+func TestNotMatcher(t *testing.T) {
+	matcher := &NotMatcher{sets: MatcherSets{{&ClientInfoMatcher{Kind: "Leafnode"}}}}
+	if !matcher.Match(newMatcherRequest("alice", "Client")) {
+		t.Error("expected not matcher to match")
+	}
+	if matcher.Match(newMatcherRequest("alice", "Leafnode")) {
+		t.Error("expected not matcher not to match")
+	}
+}
+
+func TestNestedMatchers(t *testing.T) {
+	matcher := &AllMatcher{sets: MatcherSets{
+		{&NotMatcher{sets: MatcherSets{{&ClientInfoMatcher{Kind: "Leafnode"}}}}},
+		{&AnyMatcher{sets: MatcherSets{usernameMatcher("alice"), usernameMatcher("bob")}}},
+	}}
+	if !matcher.Match(newMatcherRequest("bob", "Client")) {
+		t.Error("expected nested matchers to match")
+	}
+	if matcher.Match(newMatcherRequest("bob", "Leafnode")) || matcher.Match(newMatcherRequest("eve", "Client")) {
+		t.Error("expected nested matchers not to match")
+	}
+	if (&AllMatcher{}).Match(newMatcherRequest("bob", "Client")) {
+		t.Error("expected empty all matcher not to match")
+	}
+}
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nats-io/jwt/v2"
+)
+
+func init() {
+	caddy.RegisterModule(RegexpMatcher{})
+	caddy.RegisterModule(GlobMatcher{})
+}
+
+// RegexpMatcher matches the client name, username and lang found in
+// connect options against regular expressions.
+// All configured expressions must match.
+type RegexpMatcher struct {
+	name     *regexp.Regexp
+	username *regexp.Regexp
+	lang     *regexp.Regexp
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+	Lang     string `json:"lang,omitempty"`
+}
+
+func (RegexpMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.regexp",
+		New: func() caddy.Module { return new(RegexpMatcher) },
+	}
+}
+
+// Provision compiles the regular expressions.
+func (m *RegexpMatcher) Provision(ctx caddy.Context) error {
+	return m.provision()
+}
+
+func (m *RegexpMatcher) provision() error {
+	if m.Name == "" && m.Username == "" && m.Lang == "" {
+		return errors.New("regexp matcher requires at least one expression")
+	}
+	for _, field := range []struct {
+		dest    **regexp.Regexp
+		pattern string
+	}{{&m.name, m.Name}, {&m.username, m.Username}, {&m.lang, m.Lang}} {
+		if field.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(field.pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression %s: %s", field.pattern, err.Error())
+		}
+		*field.dest = re
+	}
+	return nil
+}
+
+func (m *RegexpMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	if m.name != nil && !m.name.MatchString(request.ConnectOptions.Name) {
+		return false
+	}
+	if m.username != nil && !m.username.MatchString(request.ConnectOptions.Username) {
+		return false
+	}
+	if m.lang != nil && !m.lang.MatchString(request.ConnectOptions.Lang) {
+		return false
+	}
+	return m.name != nil || m.username != nil || m.lang != nil
+}
+
+// GlobMatcher matches the client name, username and lang found in
+// connect options against glob patterns (e.g. "web-*").
+// All configured patterns must match.
+type GlobMatcher struct {
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+	Lang     string `json:"lang,omitempty"`
+}
+
+func (GlobMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "nats.matchers.glob",
+		New: func() caddy.Module { return new(GlobMatcher) },
+	}
+}
+
+// Provision validates the glob patterns.
+func (m *GlobMatcher) Provision(ctx caddy.Context) error {
+	return m.provision()
+}
+
+func (m *GlobMatcher) provision() error {
+	if m.Name == "" && m.Username == "" && m.Lang == "" {
+		return errors.New("glob matcher requires at least one pattern")
+	}
+	for _, pattern := range []string{m.Name, m.Username, m.Lang} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %s: %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+func (m *GlobMatcher) Match(request *jwt.AuthorizationRequestClaims) bool {
+	if m.Name == "" && m.Username == "" && m.Lang == "" {
+		return false
+	}
+	if !globMatch(m.Name, request.ConnectOptions.Name) {
+		return false
+	}
+	if !globMatch(m.Username, request.ConnectOptions.Username) {
+		return false
+	}
+	if !globMatch(m.Lang, request.ConnectOptions.Lang) {
+		return false
+	}
+	return true
+}
+
+// globMatch returns true when pattern is empty or matches value.
+func globMatch(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	regexp {
+//		name <expression>
+//		username <expression>
+//		lang <expression>
+//	}
+func (m *RegexpMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return parsePatterns(d, &m.Name, &m.Username, &m.Lang)
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	glob {
+//		name <pattern>
+//		username <pattern>
+//		lang <pattern>
+//	}
+func (m *GlobMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return parsePatterns(d, &m.Name, &m.Username, &m.Lang)
+}
+
+// parsePatterns parses the name, username and lang patterns of a pattern matcher block.
+func parsePatterns(d *caddyfile.Dispenser, name *string, username *string, lang *string) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var dest *string
+			switch d.Val() {
+			case "name":
+				dest = name
+			case "username":
+				dest = username
+			case "lang":
+				dest = lang
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+			if !d.AllArgs(dest) {
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ Matcher               = (*RegexpMatcher)(nil)
+	_ Matcher               = (*GlobMatcher)(nil)
+	_ caddy.Provisioner     = (*RegexpMatcher)(nil)
+	_ caddy.Provisioner     = (*GlobMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*RegexpMatcher)(nil)
+	_ caddyfile.Unmarshaler = (*GlobMatcher)(nil)
+)
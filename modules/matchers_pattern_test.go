@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func newPatternRequest(name string, username string, lang string) *jwt.AuthorizationRequestClaims {
+	request := jwt.NewAuthorizationRequestClaims("UABC")
+	request.ConnectOptions.Name = name
+	request.ConnectOptions.Username = username
+	request.ConnectOptions.Lang = lang
+	return request
+}
+
+func TestRegexpMatcher(t *testing.T) {
+	matcher := &RegexpMatcher{Name: "^web-[0-9]+$", Lang: "^(go|rust)$"}
+	if err := matcher.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if !matcher.Match(newPatternRequest("web-1", "alice", "go")) {
+		t.Error("expected regexp matcher to match")
+	}
+	if matcher.Match(newPatternRequest("web-a", "alice", "go")) || matcher.Match(newPatternRequest("web-1", "alice", "python")) {
+		t.Error("expected regexp matcher not to match")
+	}
+	for name, invalid := range map[string]*RegexpMatcher{
+		"no expression":      {},
+		"invalid expression": {Username: "("},
+	} {
+		if err := invalid.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestGlobMatcher(t *testing.T) {
+	matcher := &GlobMatcher{Username: "svc-*"}
+	if err := matcher.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if !matcher.Match(newPatternRequest("", "svc-orders", "")) {
+		t.Error("expected glob matcher to match")
+	}
+	if matcher.Match(newPatternRequest("", "alice", "")) {
+		t.Error("expected glob matcher not to match")
+	}
+	for name, invalid := range map[string]*GlobMatcher{
+		"no pattern":      {},
+		"invalid pattern": {Name: "[web"},
+	} {
+		if err := invalid.provision(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+// MergeMode defines how the allow lists of user claims are combined by MergeUserClaims.
+type MergeMode int
+
+const (
+	// MergeGrant grants the subjects allowed by either claims: allow lists are combined.
+	// It is used when each claims grant access on their own, e.g. mappings of OIDC groups.
+	MergeGrant MergeMode = iota
+	// MergeRestrict only grants the subjects allowed by both claims: allow lists are intersected.
+	// It is used when all claims must agree, e.g. handlers of a chain in "all" mode.
+	MergeRestrict
+)
+
+// MergeUserClaims merges the permissions and limits of src into dest.
+// The mode only defines how publish and subscribe allow lists are combined.
+// Whatever the mode, restrictions accumulate, so that merged claims never relax
+// a restriction set by dest or src:
+//   - deny lists are combined;
+//   - source networks, connection types and times are intersected, where an empty
+//     list means "any", and an error is returned when nothing is left;
+//   - locales must be equal when both are set;
+//   - bearer token is only kept when both claims are bearer tokens;
+//   - the lowest limits and the earliest expiry are kept.
+//
+// Response permissions are kept when set by either claims with MergeGrant, and
+// only when set by both claims (using the lowest values) with MergeRestrict.
+func MergeUserClaims(dest *jwt.UserClaims, src *jwt.UserClaims, mode MergeMode) error {
+	if dest.Name == "" {
+		dest.Name = src.Name
+	}
+	if mode == MergeRestrict {
+		dest.Pub.Allow, dest.Pub.Deny = intersectAllow(dest.Pub.Allow, src.Pub.Allow, dest.Pub.Deny)
+		dest.Sub.Allow, dest.Sub.Deny = intersectAllow(dest.Sub.Allow, src.Sub.Allow, dest.Sub.Deny)
+		dest.Resp = intersectResponses(dest.Resp, src.Resp)
+	} else {
+		dest.Pub.Allow.Add(src.Pub.Allow...)
+		dest.Sub.Allow.Add(src.Sub.Allow...)
+		if dest.Resp == nil {
+			dest.Resp = src.Resp
+		}
+	}
+	dest.Pub.Deny.Add(src.Pub.Deny...)
+	dest.Sub.Deny.Add(src.Sub.Deny...)
+	dest.Tags.Add(src.Tags...)
+	networks, ok := intersectList(dest.Src, src.Src)
+	if !ok {
+		return errors.New("claims allow no common source network")
+	}
+	dest.Src = jwt.CIDRList(networks)
+	connectionTypes, ok := intersectList(dest.AllowedConnectionTypes, src.AllowedConnectionTypes)
+	if !ok {
+		return errors.New("claims allow no common connection type")
+	}
+	dest.AllowedConnectionTypes = connectionTypes
+	times, ok := intersectTimes(dest.Times, src.Times)
+	if !ok {
+		return errors.New("claims allow no common time range")
+	}
+	dest.Times = times
+	if dest.Locale == "" {
+		dest.Locale = src.Locale
+	} else if src.Locale != "" && src.Locale != dest.Locale {
+		return errors.New("claims use different locales")
+	}
+	dest.BearerToken = dest.BearerToken && src.BearerToken
+	if src.Expires != 0 && (dest.Expires == 0 || src.Expires < dest.Expires) {
+		dest.Expires = src.Expires
+	}
+	dest.Subs = minLimit(dest.Subs, src.Subs)
+	dest.Data = minLimit(dest.Data, src.Data)
+	dest.NatsLimits.Payload = minLimit(dest.NatsLimits.Payload, src.NatsLimits.Payload)
+	return nil
+}
+
+// intersectAllow returns the subjects allowed by both allow lists, and the deny list.
+// An empty allow list allows all subjects. When no subject is allowed by both lists,
+// all subjects are denied.
+func intersectAllow(a jwt.StringList, b jwt.StringList, deny jwt.StringList) (jwt.StringList, jwt.StringList) {
+	if len(a) == 0 {
+		return append(jwt.StringList{}, b...), deny
+	}
+	if len(b) == 0 {
+		return a, deny
+	}
+	allowed := jwt.StringList{}
+	for _, subject := range a {
+		if subjectIsCovered(subject, b) {
+			allowed.Add(subject)
+		}
+	}
+	for _, subject := range b {
+		if subjectIsCovered(subject, a) {
+			allowed.Add(subject)
+		}
+	}
+	if len(allowed) == 0 {
+		deny.Add(">")
+	}
+	return allowed, deny
+}
+
+// subjectIsCovered returns true when all subjects matched by subject
+// are matched by one of the patterns.
+func subjectIsCovered(subject string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if subjectIsSubset(subject, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectIsSubset returns true when all subjects matched by subject are matched by pattern.
+func subjectIsSubset(subject string, pattern string) bool {
+	subjectTokens := strings.Split(subject, ".")
+	patternTokens := strings.Split(pattern, ".")
+	for idx, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > idx
+		}
+		if idx >= len(subjectTokens) {
+			return false
+		}
+		switch subjectTokens[idx] {
+		case ">":
+			return false
+		case "*":
+			if token != "*" {
+				return false
+			}
+		default:
+			if token != "*" && token != subjectTokens[idx] {
+				return false
+			}
+		}
+	}
+	return len(subjectTokens) == len(patternTokens)
+}
+
+// intersectList returns the values found in both lists, where an empty list means any value.
+// It returns false when both lists are restricted and have no common value.
+func intersectList(a []string, b []string) (jwt.StringList, bool) {
+	if len(a) == 0 {
+		return append(jwt.StringList{}, b...), true
+	}
+	if len(b) == 0 {
+		return append(jwt.StringList{}, a...), true
+	}
+	common := jwt.StringList{}
+	for _, value := range a {
+		for _, other := range b {
+			if value == other {
+				common.Add(value)
+			}
+		}
+	}
+	return common, len(common) > 0
+}
+
+// intersectTimes returns the time ranges found in both lists, where an empty list means any time.
+// It returns false when both lists are restricted and have no common time range.
+func intersectTimes(a []jwt.TimeRange, b []jwt.TimeRange) ([]jwt.TimeRange, bool) {
+	if len(a) == 0 {
+		return b, true
+	}
+	if len(b) == 0 {
+		return a, true
+	}
+	common := []jwt.TimeRange{}
+	for _, value := range a {
+		for _, other := range b {
+			if value == other {
+				common = append(common, value)
+			}
+		}
+	}
+	return common, len(common) > 0
+}
+
+// intersectResponses returns response permissions allowed by both claims, using the lowest values.
+func intersectResponses(a *jwt.ResponsePermission, b *jwt.ResponsePermission) *jwt.ResponsePermission {
+	if a == nil || b == nil {
+		return nil
+	}
+	resp := *a
+	if b.MaxMsgs < resp.MaxMsgs {
+		resp.MaxMsgs = b.MaxMsgs
+	}
+	if b.Expires < resp.Expires {
+		resp.Expires = b.Expires
+	}
+	return &resp
+}
+
+// minLimit returns the lowest limit, where a negative limit is unlimited.
+func minLimit(a int64, b int64) int64 {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
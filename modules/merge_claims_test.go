@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestMergeUserClaimsGrant(t *testing.T) {
+	dest := jwt.NewUserClaims("UABC")
+	dest.Pub.Allow.Add("a.>")
+	dest.Src.Add("10.0.0.0/8", "192.168.0.0/16")
+	dest.Subs = 10
+	src := jwt.NewUserClaims("UABC")
+	src.Pub.Allow.Add("b.>")
+	src.Sub.Deny.Add("secret.>")
+	src.Resp = &jwt.ResponsePermission{MaxMsgs: 1}
+	src.Src.Add("10.0.0.0/8")
+	src.AllowedConnectionTypes.Add(jwt.ConnectionTypeWebsocket)
+	src.Locale = "Europe/Paris"
+	src.BearerToken = true
+	src.Data = 1024
+	if err := MergeUserClaims(dest, src, MergeGrant); err != nil {
+		t.Fatal(err)
+	}
+	if len(dest.Pub.Allow) != 2 || len(dest.Sub.Deny) != 1 || dest.Resp == nil {
+		t.Fatalf("unexpected permissions: %+v", dest.Permissions)
+	}
+	if len(dest.Src) != 1 || len(dest.AllowedConnectionTypes) != 1 || dest.Locale != "Europe/Paris" || dest.BearerToken {
+		t.Fatalf("unexpected restrictions: %+v", dest.UserPermissionLimits)
+	}
+	if dest.Subs != 10 || dest.Data != 1024 {
+		t.Fatalf("unexpected limits: %+v", dest.Limits)
+	}
+}
+
+func TestMergeUserClaimsRestrict(t *testing.T) {
+	dest := jwt.NewUserClaims("UABC")
+	dest.Pub.Allow.Add("a.>", "c.*")
+	dest.Resp = &jwt.ResponsePermission{MaxMsgs: 5}
+	src := jwt.NewUserClaims("UABC")
+	src.Pub.Allow.Add("a.b", "b.>", "c.>")
+	src.Sub.Allow.Add("inbox.>")
+	if err := MergeUserClaims(dest, src, MergeRestrict); err != nil {
+		t.Fatal(err)
+	}
+	if len(dest.Pub.Allow) != 2 || !dest.Pub.Allow.Contains("a.b") || !dest.Pub.Allow.Contains("c.*") {
+		t.Fatalf("unexpected publish permissions: %+v", dest.Pub)
+	}
+	// An empty allow list allows all subjects
+	if len(dest.Sub.Allow) != 1 || dest.Sub.Allow[0] != "inbox.>" {
+		t.Fatalf("unexpected subscribe permissions: %+v", dest.Sub)
+	}
+	if dest.Resp != nil {
+		t.Fatalf("unexpected response permissions: %+v", dest.Resp)
+	}
+	// No common subject denies all subjects
+	other := jwt.NewUserClaims("UABC")
+	other.Pub.Allow.Add("d.>")
+	if err := MergeUserClaims(dest, other, MergeRestrict); err != nil {
+		t.Fatal(err)
+	}
+	if len(dest.Pub.Allow) != 0 || !dest.Pub.Deny.Contains(">") {
+		t.Fatalf("unexpected publish permissions: %+v", dest.Pub)
+	}
+}
+
+func TestMergeUserClaimsConflicts(t *testing.T) {
+	for name, configure := range map[string]func(dest *jwt.UserClaims, src *jwt.UserClaims){
+		"source networks": func(dest *jwt.UserClaims, src *jwt.UserClaims) {
+			dest.Src.Add("10.0.0.0/8")
+			src.Src.Add("192.168.0.0/16")
+		},
+		"connection types": func(dest *jwt.UserClaims, src *jwt.UserClaims) {
+			dest.AllowedConnectionTypes.Add(jwt.ConnectionTypeStandard)
+			src.AllowedConnectionTypes.Add(jwt.ConnectionTypeWebsocket)
+		},
+		"times": func(dest *jwt.UserClaims, src *jwt.UserClaims) {
+			dest.Times = []jwt.TimeRange{{Start: "08:00:00", End: "12:00:00"}}
+			src.Times = []jwt.TimeRange{{Start: "14:00:00", End: "18:00:00"}}
+		},
+		"locales": func(dest *jwt.UserClaims, src *jwt.UserClaims) {
+			dest.Locale = "UTC"
+			src.Locale = "Europe/Paris"
+		},
+	} {
+		for _, mode := range []MergeMode{MergeGrant, MergeRestrict} {
+			dest := jwt.NewUserClaims("UABC")
+			src := jwt.NewUserClaims("UABC")
+			configure(dest, src)
+			if err := MergeUserClaims(dest, src, mode); err == nil {
+				t.Errorf("%s: expected an error with mode %d", name, mode)
+			}
+		}
+	}
+}
+
+func TestSubjectIsSubset(t *testing.T) {
+	for _, test := range []struct {
+		subject  string
+		pattern  string
+		expected bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.*", true},
+		{"a.b.c", "a.>", true},
+		{"a.*", "a.>", true},
+		{"a.>", "a.>", true},
+		{"a", "a.>", false},
+		{"a.>", "a.*", false},
+		{"a.*", "a.b", false},
+		{"a.b.c", "a.*", false},
+		{"a.b", "a.b.c", false},
+	} {
+		if subjectIsSubset(test.subject, test.pattern) != test.expected {
+			t.Errorf("expected subjectIsSubset(%s, %s) to be %t", test.subject, test.pattern, test.expected)
+		}
+	}
+}
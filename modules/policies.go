@@ -38,15 +38,7 @@ type ConnectionPolicy struct {
 }
 
 func (pol *ConnectionPolicy) Match(request *jwt.AuthorizationRequestClaims) bool {
-	var matched = false
-	for _, m := range pol.matchers {
-		if !m.Match(request) {
-			return false
-		} else {
-			matched = true
-		}
-	}
-	return matched
+	return Matchers(pol.matchers).Match(request)
 }
 
 func (pol *ConnectionPolicy) Handle(request *AuthorizationRequest) (*jwt.UserClaims, error) {
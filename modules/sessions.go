@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// SESSION_PRUNE_INTERVAL is the interval at which tracked connections which
+// are closed are forgotten.
+const SESSION_PRUNE_INTERVAL = time.Minute
+
+// SessionSource is implemented by modules which persist sessions, such as oauth2 endpoints,
+// and which notify when sessions are deleted (e.g. on sign-out or when revoked by an admin).
+// Handlers register session sources with the app using AddSessionSource, and set the key of
+// the session from which a request is authorized using AuthorizationRequest.SetSessionKey.
+type SessionSource interface {
+	WatchDeletedSessions(ctx context.Context, deleted func(key string)) error
+}
+
+// sessionTrackers holds the session tracker shared by nats apps, so that tracked client
+// connections are not lost when the config is reloaded.
+var sessionTrackers = caddy.NewUsagePool()
+
+// sessionTrackerKey is the key of the shared session tracker in sessionTrackers.
+const sessionTrackerKey = "sessions"
+
+// trackedClient is a client connection authorized from a session.
+type trackedClient struct {
+	account    string
+	name       string
+	authorized time.Time
+}
+
+// trackedClientKey identifies a client connection. Client IDs are only unique
+// for a server, and the server is replaced when the config is reloaded.
+type trackedClientKey struct {
+	server string
+	id     uint64
+}
+
+// sessionTracker remembers which client connections were authorized from which session.
+type sessionTracker struct {
+	mutex    sync.Mutex
+	sessions map[string]map[trackedClientKey]trackedClient
+	now      func() time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{sessions: map[string]map[trackedClientKey]trackedClient{}, now: time.Now}
+}
+
+// loadSessionTracker returns the session tracker shared by nats apps.
+// It must be released using releaseSessionTracker.
+func loadSessionTracker() (*sessionTracker, error) {
+	tracker, _, err := sessionTrackers.LoadOrNew(sessionTrackerKey, func() (caddy.Destructor, error) {
+		return newSessionTracker(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tracker.(*sessionTracker), nil
+}
+
+// releaseSessionTracker releases the session tracker shared by nats apps.
+func releaseSessionTracker() {
+	sessionTrackers.Delete(sessionTrackerKey)
+}
+
+// Destruct implements caddy.Destructor. Tracked client connections are
+// simply forgotten when the last app using the tracker is cleaned up.
+func (t *sessionTracker) Destruct() error {
+	return nil
+}
+
+// track remembers that a client connection of a server was authorized from a session.
+func (t *sessionTracker) track(key string, server string, clientID uint64, account string, name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	clients, ok := t.sessions[key]
+	if !ok {
+		clients = map[trackedClientKey]trackedClient{}
+		t.sessions[key] = clients
+	}
+	clients[trackedClientKey{server: server, id: clientID}] = trackedClient{account: account, name: name, authorized: t.now()}
+}
+
+// revoke forgets the client connections of a server authorized from a session, and returns them.
+func (t *sessionTracker) revoke(key string, server string) map[uint64]trackedClient {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	revoked := map[uint64]trackedClient{}
+	clients := t.sessions[key]
+	for clientKey, client := range clients {
+		if clientKey.server == server {
+			revoked[clientKey.id] = client
+			delete(clients, clientKey)
+		}
+	}
+	if len(clients) == 0 {
+		delete(t.sessions, key)
+	}
+	return revoked
+}
+
+// prune forgets client connections of a server which are closed. Connections authorized
+// less than grace ago are kept, because they may not be registered by the server yet.
+func (t *sessionTracker) prune(server string, connected func(clientID uint64) bool, grace time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	deadline := t.now().Add(-grace)
+	for key, clients := range t.sessions {
+		for clientKey, client := range clients {
+			if clientKey.server == server && client.authorized.Before(deadline) && !connected(clientKey.id) {
+				delete(clients, clientKey)
+			}
+		}
+		if len(clients) == 0 {
+			delete(t.sessions, key)
+		}
+	}
+}
+
+// forgetServer forgets all client connections of a server, once the server is stopped.
+func (t *sessionTracker) forgetServer(server string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, clients := range t.sessions {
+		for clientKey := range clients {
+			if clientKey.server == server {
+				delete(clients, clientKey)
+			}
+		}
+		if len(clients) == 0 {
+			delete(t.sessions, key)
+		}
+	}
+}
+
+// AddSessionSource registers a source of sessions. Client connections authorized
+// from a session are disconnected when the session is deleted from its source.
+// Sources are watched once the app is started.
+func (a *App) AddSessionSource(source SessionSource) {
+	for _, existing := range a.sessionSources {
+		if existing == source {
+			return
+		}
+	}
+	a.sessionSources = append(a.sessionSources, source)
+}
+
+// RevokeSession disconnects client connections authorized from a session.
+// Each disconnection is written to the audit log.
+func (a *App) RevokeSession(key string) {
+	if a.AuthService != nil {
+		a.AuthService.forgetSession(key)
+	}
+	srv := a.Server()
+	if srv == nil {
+		return
+	}
+	clients := a.sessions.revoke(key, srv.ID())
+	for clientID, client := range clients {
+		if err := srv.DisconnectClientByID(clientID); err != nil {
+			// Client is already disconnected
+			continue
+		}
+		a.logger.Named("audit").Info("disconnected client authorized from revoked session",
+			zap.String("session", key),
+			zap.Uint64("client_id", clientID),
+			zap.String("account", client.account),
+			zap.String("name", client.name),
+		)
+	}
+}
+
+// startSessionWatchers watches session sources for deleted sessions, and periodically
+// forgets tracked client connections which are closed, until the app context is done.
+func (a *App) startSessionWatchers() error {
+	if len(a.sessionSources) == 0 {
+		return nil
+	}
+	for _, source := range a.sessionSources {
+		if err := source.WatchDeletedSessions(a.ctx, a.RevokeSession); err != nil {
+			return err
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(SESSION_PRUNE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				srv := a.Server()
+				if srv == nil {
+					continue
+				}
+				a.sessions.prune(srv.ID(), func(clientID uint64) bool {
+					return srv.GetClient(clientID) != nil
+				}, SESSION_PRUNE_INTERVAL)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+)
+
+func TestSessionTracker(t *testing.T) {
+	tracker := newSessionTracker()
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+	tracker.track("session-1", "NSERVER", 1, "APP", "alice")
+	tracker.track("session-1", "NSERVER", 2, "APP", "alice")
+	tracker.track("session-2", "NSERVER", 3, "APP", "bob")
+	// Connection 2 is closed, connection 3 was authorized recently
+	now = now.Add(2 * time.Minute)
+	tracker.track("session-2", "NSERVER", 4, "APP", "bob")
+	connected := map[uint64]bool{1: true}
+	tracker.prune("NSERVER", func(clientID uint64) bool { return connected[clientID] }, time.Minute)
+	clients := tracker.revoke("session-1", "NSERVER")
+	if len(clients) != 1 || clients[1].name != "alice" {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+	if _, ok := tracker.sessions["session-1"]; ok {
+		t.Fatal("expected revoked session to be forgotten")
+	}
+	clients = tracker.revoke("session-2", "NSERVER")
+	if len(clients) != 1 || clients[4].account != "APP" {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+	if len(tracker.revoke("unknown", "NSERVER")) != 0 {
+		t.Fatal("expected no client for unknown session")
+	}
+}
+
+func TestSessionTrackerServers(t *testing.T) {
+	tracker := newSessionTracker()
+	// Client IDs of a server replaced on reload are reused by the new server
+	tracker.track("session-1", "NOLD", 1, "APP", "alice")
+	tracker.track("session-1", "NNEW", 1, "APP", "bob")
+	tracker.prune("NNEW", func(clientID uint64) bool { return false }, -time.Minute)
+	if len(tracker.sessions["session-1"]) != 1 {
+		t.Fatalf("expected clients of other servers to be kept: %+v", tracker.sessions)
+	}
+	tracker.track("session-1", "NNEW", 1, "APP", "bob")
+	clients := tracker.revoke("session-1", "NNEW")
+	if len(clients) != 1 || clients[1].name != "bob" {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+	tracker.forgetServer("NOLD")
+	if len(tracker.sessions) != 0 {
+		t.Fatalf("expected clients of stopped server to be forgotten: %+v", tracker.sessions)
+	}
+	// The tracker is shared by apps until the last one is cleaned up
+	first, err := loadSessionTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadSessionTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected session tracker to be shared")
+	}
+	releaseSessionTracker()
+	releaseSessionTracker()
+	if _, ok := sessionTrackers.References(sessionTrackerKey); ok {
+		t.Fatal("expected session tracker to be released")
+	}
+}
+
+func TestAuthServiceTracksSessions(t *testing.T) {
+	app := &App{sessions: newSessionTracker()}
+	service := &AuthService{app: app, defaultHandler: &sessionAuthCallout{}}
+	cache, err := newDecisionCache(&DecisionCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.cache = cache
+	app.AuthService = service
+	// The second connection is answered from the cache
+	for _, clientID := range []uint64{1, 2} {
+		request := newCacheTestRequest("UALICE", "alice")
+		request.ClientInformation.ID = clientID
+		if _, err := service.Handle(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(app.sessions.sessions["session-alice"]) != 2 {
+		t.Fatalf("unexpected tracked sessions: %+v", app.sessions.sessions)
+	}
+	service.forgetSession("session-alice")
+	if _, ok := cache.get(newCacheTestRequest("UALICE", "alice")); ok {
+		t.Fatal("expected decisions of revoked session to be removed from cache")
+	}
+}
+
+type sessionAuthCallout struct{}
+
+func (c *sessionAuthCallout) Handle(request *AuthorizationRequest) (*jwt.UserClaims, error) {
+	request.SetSessionKey("session-" + request.Claims.ConnectOptions.Username)
+	claims := jwt.NewUserClaims(request.Claims.UserNkey)
+	claims.Audience = "APP"
+	return claims, nil
+}
+
+func (c *sessionAuthCallout) Provision(app *App) error {
+	return nil
+}
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/certmagic"
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+	"go.uber.org/zap"
+)
+
+// certificateRotation is an event handler which reports the rotation of the
+// TLS certificates of NATS listeners when a certificate is obtained or renewed by caddy.
+type certificateRotation struct {
+	app *App
+}
+
+// Handle handles "cert_obtained" events emitted by the caddy tls app.
+// Listeners using caddy managed certificates look certificates up on each
+// TLS handshake (GetCertificate and GetClientCertificate), so new connections
+// already use the new certificate, and the server does not need to be reloaded.
+// The rotation is only logged for each affected listener.
+func (h *certificateRotation) Handle(ctx context.Context, e caddyevents.Event) error {
+	identifier, ok := e.Data["identifier"].(string)
+	if !ok || identifier == "" {
+		return nil
+	}
+	renewal, _ := e.Data["renewal"].(bool)
+	for _, listener := range h.app.listenersForCertificate(identifier) {
+		h.app.logger.Info("Rotated TLS certificate", zap.String("listener", listener), zap.String("identifier", identifier), zap.Bool("renewal", renewal))
+	}
+	return nil
+}
+
+// subscribeCertificateEvents subscribes to certificates events emitted by the caddy tls app.
+// It must be called during provisioning, because events app does not accept
+// new subscriptions once started.
+func (a *App) subscribeCertificateEvents() error {
+	if len(a.managedTLSListeners()) == 0 {
+		return nil
+	}
+	unm, err := a.ctx.App("events")
+	if err != nil {
+		return errors.New("failed to get events app")
+	}
+	events, ok := unm.(*caddyevents.App)
+	if !ok {
+		return errors.New("events app invalid type")
+	}
+	return events.On("cert_obtained", &certificateRotation{app: a})
+}
+
+// managedTLSListeners returns the TLS configurations of listeners using caddy managed certificates,
+// keyed by listener name.
+func (a *App) managedTLSListeners() map[string]*natsoptions.TLSMap {
+	listeners := map[string]*natsoptions.TLSMap{}
+	if a.Options == nil {
+		return listeners
+	}
+	if a.Options.TLS != nil && a.Options.TLS.Subjects != nil {
+		listeners["client"] = a.Options.TLS
+	}
+	if a.Options.Websocket != nil && a.Options.Websocket.TLS != nil && a.Options.Websocket.TLS.Subjects != nil {
+		listeners["websocket"] = a.Options.Websocket.TLS
+	}
+	if a.Options.Leafnode != nil && a.Options.Leafnode.TLS != nil && a.Options.Leafnode.TLS.Subjects != nil {
+		listeners["leafnode"] = a.Options.Leafnode.TLS
+	}
+	if a.Options.MQTT != nil && a.Options.MQTT.TLS != nil && a.Options.MQTT.TLS.Subjects != nil {
+		listeners["mqtt"] = a.Options.MQTT.TLS
+	}
+	if a.Options.Cluster != nil && a.Options.Cluster.TLS != nil && a.Options.Cluster.TLS.Subjects != nil {
+		listeners["cluster"] = a.Options.Cluster.TLS
+	}
+	if a.Options.Gateway != nil && a.Options.Gateway.TLS != nil && a.Options.Gateway.TLS.Subjects != nil {
+		listeners["gateway"] = a.Options.Gateway.TLS
+	}
+	return listeners
+}
+
+// listenersForCertificate returns the sorted names of the listeners
+// using a certificate for the given identifier.
+func (a *App) listenersForCertificate(identifier string) []string {
+	names := []string{}
+	for name, tlsMap := range a.managedTLSListeners() {
+		for _, subject := range tlsMap.Subjects {
+			if subject == identifier || certmagic.MatchWildcard(identifier, subject) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+var _ caddyevents.Handler = (*certificateRotation)(nil)
@@ -0,0 +1,35 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package modules
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/charbonnierg/caddy-nats/embedded/natsoptions"
+)
+
+func TestListenersForCertificate(t *testing.T) {
+	app := &App{Options: &natsoptions.Options{
+		TLS:       &natsoptions.TLSMap{Subjects: []string{"*.example.com"}},
+		Websocket: &natsoptions.Websocket{TLS: &natsoptions.TLSMap{Subjects: []string{"ws.example.com"}}},
+		Leafnode:  &natsoptions.Leafnode{TLS: &natsoptions.TLSMap{CertFile: "leaf.pem", KeyFile: "leaf.key"}},
+		MQTT:      &natsoptions.MQTT{TLS: &natsoptions.TLSMap{Subjects: []string{"mqtt.example.com"}}},
+		Cluster:   &natsoptions.Cluster{Name: "test", TLS: &natsoptions.TLSMap{Subjects: []string{"route.example.org"}}},
+	}}
+	if listeners := app.listenersForCertificate("ws.example.com"); !reflect.DeepEqual(listeners, []string{"client", "websocket"}) {
+		t.Errorf("unexpected listeners: %v", listeners)
+	}
+	if listeners := app.listenersForCertificate("nats.example.com"); !reflect.DeepEqual(listeners, []string{"client"}) {
+		t.Errorf("unexpected listeners: %v", listeners)
+	}
+	if listeners := app.listenersForCertificate("mqtt.example.com"); !reflect.DeepEqual(listeners, []string{"client", "mqtt"}) {
+		t.Errorf("unexpected listeners: %v", listeners)
+	}
+	if listeners := app.listenersForCertificate("route.example.org"); !reflect.DeepEqual(listeners, []string{"cluster"}) {
+		t.Errorf("unexpected listeners: %v", listeners)
+	}
+	if listeners := app.listenersForCertificate("example.org"); len(listeners) != 0 {
+		t.Errorf("unexpected listeners: %v", listeners)
+	}
+}
@@ -4,12 +4,19 @@ package oauthproxy
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/providers/util"
 	"go.uber.org/zap"
 )
@@ -119,11 +126,59 @@ func (e *Endpoint) DecodeSessionStateFromString(cookie string) (*sessions.Sessio
 	return e.DecodeSessionState(cookies)
 }
 
+// WatchesSessions returns true when the endpoint session store persists sessions
+// server side and notifies deleted sessions.
+func (e *Endpoint) WatchesSessions() bool {
+	_, ok := e.store.(SessionWatcher)
+	return ok
+}
+
+// WatchDeletedSessions calls deleted with the key of each session deleted from the
+// endpoint session store, until the context is done.
+// It returns an error if the session store does not notify deleted sessions.
+func (e *Endpoint) WatchDeletedSessions(ctx context.Context, deleted func(key string)) error {
+	watcher, ok := e.store.(SessionWatcher)
+	if !ok {
+		return fmt.Errorf("session store of endpoint %s does not notify deleted sessions", e.Name)
+	}
+	return watcher.WatchDeletedSessions(ctx, deleted)
+}
+
+// SessionKey returns the key under which the session of the given encoded cookie string
+// is persisted in the endpoint session store. It returns false when the session store
+// does not notify deleted sessions, or when the cookie is not a valid session ticket.
+func (e *Endpoint) SessionKey(cookie string) (string, bool) {
+	if !e.WatchesSessions() {
+		return "", false
+	}
+	cookies, err := parseCookies(cookie)
+	if err != nil {
+		return "", false
+	}
+	joined, err := joinCookies(cookies, e.opts.Cookie.Name)
+	if err != nil {
+		return "", false
+	}
+	// Persisted sessions are referenced by a signed ticket "<key>.<secret>"
+	value, _, ok := encryption.Validate(joined, e.opts.Cookie.Secret, e.opts.Cookie.Expire)
+	if !ok {
+		return "", false
+	}
+	key, _, ok := strings.Cut(string(value), ".")
+	if !ok || key == "" {
+		return "", false
+	}
+	return key, true
+}
+
+// GetOidcSessionClaimExtractor returns a claim extractor for the given session state,
+// using the profile URL of the provider which issued the session.
 func (e *Endpoint) GetOidcSessionClaimExtractor(state *sessions.SessionState) (util.ClaimExtractor, error) {
-	// FIXME: What should we do if we got multiple providers for this endpoint ?
-	// I guess we should first decode ID token, then check if the issuer matches
-	// a specific provider issuer, then use the profile URL from the provider.
-	profileURL, err := url.Parse(e.opts.Providers[0].ProfileURL)
+	provider, err := e.SessionProvider(state)
+	if err != nil {
+		return nil, err
+	}
+	profileURL, err := url.Parse(provider.ProfileURL)
 	if err != nil {
 		return nil, err
 	}
@@ -136,3 +191,91 @@ func (e *Endpoint) GetOidcSessionClaimExtractor(state *sessions.SessionState) (u
 	}
 	return extractor, nil
 }
+
+// SessionProvider returns the options of the provider which issued the given session state.
+// The provider is selected by matching the issuer of the session ID token with the issuer URL
+// of providers. Sessions without ID token (e.g. GitHub sessions) are matched with the first
+// provider without issuer URL. When the endpoint has a single provider, it is always used.
+// Lookups are cached by issuer.
+func (e *Endpoint) SessionProvider(state *sessions.SessionState) (*options.Provider, error) {
+	if len(e.opts.Providers) == 1 {
+		return &e.opts.Providers[0], nil
+	}
+	issuer := idTokenIssuer(state.IDToken)
+	return e.lookups.lookup(issuer, func() (*options.Provider, error) {
+		for idx := range e.opts.Providers {
+			provider := &e.opts.Providers[idx]
+			if normalizeIssuer(provider.OIDCConfig.IssuerURL) == issuer {
+				return provider, nil
+			}
+		}
+		if issuer == "" {
+			return nil, fmt.Errorf("no provider without issuer url for endpoint %s", e.Name)
+		}
+		return nil, fmt.Errorf("no provider with issuer url %s for endpoint %s", issuer, e.Name)
+	})
+}
+
+// providerCache caches providers by ID token issuer.
+type providerCache struct {
+	mutex     sync.RWMutex
+	providers map[string]*options.Provider
+}
+
+func newProviderCache() *providerCache {
+	return &providerCache{providers: map[string]*options.Provider{}}
+}
+
+// lookup returns the provider cached for an issuer, or finds and caches it.
+// Errors are not cached.
+func (c *providerCache) lookup(issuer string, find func() (*options.Provider, error)) (*options.Provider, error) {
+	c.mutex.RLock()
+	provider, ok := c.providers[issuer]
+	c.mutex.RUnlock()
+	if ok {
+		return provider, nil
+	}
+	provider, err := find()
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.providers[issuer] = provider
+	c.mutex.Unlock()
+	return provider, nil
+}
+
+// DecodeIDTokenClaims returns the claims of the ID token of a decoded session state.
+// The ID token was verified when the session was created, and the session state
+// is encrypted, so the token payload is decoded without verifying its signature.
+// It must not be used with ID tokens which do not come from a session state.
+func DecodeIDTokenClaims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token payload: %s", err.Error())
+	}
+	claims := map[string]any{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid id token payload: %s", err.Error())
+	}
+	return claims, nil
+}
+
+// idTokenIssuer returns the issuer of a session ID token, or an empty string.
+func idTokenIssuer(token string) string {
+	claims, err := DecodeIDTokenClaims(token)
+	if err != nil {
+		return ""
+	}
+	issuer, _ := claims["iss"].(string)
+	return normalizeIssuer(issuer)
+}
+
+// normalizeIssuer removes the trailing slash of an issuer URL.
+func normalizeIssuer(issuer string) string {
+	return strings.TrimSuffix(issuer, "/")
+}
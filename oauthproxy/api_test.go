@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package oauthproxy
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+func testIDToken(issuer string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + issuer + `"}`))
+	return "e30." + payload + ".c2ln"
+}
+
+func TestSessionProvider(t *testing.T) {
+	endpoint := &Endpoint{
+		Name: "test",
+		opts: &options.Options{Providers: options.Providers{
+			{ID: "azure", OIDCConfig: options.OIDCOptions{IssuerURL: "https://login.microsoftonline.com/tenant/v2.0/"}},
+			{ID: "github"},
+			{ID: "keycloak", OIDCConfig: options.OIDCOptions{IssuerURL: "https://idp.example.com/realms/staff"}},
+		}},
+		lookups: newProviderCache(),
+	}
+	for expected, state := range map[string]*sessions.SessionState{
+		"azure":    {IDToken: testIDToken("https://login.microsoftonline.com/tenant/v2.0")},
+		"keycloak": {IDToken: testIDToken("https://idp.example.com/realms/staff/")},
+		"github":   {AccessToken: "gho_token"},
+	} {
+		// Second lookup is answered from the cache
+		for i := 0; i < 2; i++ {
+			provider, err := endpoint.SessionProvider(state)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", expected, err.Error())
+			}
+			if provider.ID != expected {
+				t.Fatalf("expected provider %s, got %s", expected, provider.ID)
+			}
+		}
+	}
+	if len(endpoint.lookups.providers) != 3 {
+		t.Fatalf("unexpected cached providers: %+v", endpoint.lookups.providers)
+	}
+	if _, err := endpoint.SessionProvider(&sessions.SessionState{IDToken: testIDToken("https://unknown.example.com")}); err == nil {
+		t.Fatal("expected error for unknown issuer")
+	}
+}
+
+func TestDecodeIDTokenClaims(t *testing.T) {
+	claims, err := DecodeIDTokenClaims(testIDToken("https://idp.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != "https://idp.example.com" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+	for _, token := range []string{"", "gho_token", "e30.!!!.c2ln", "e30.bm90IGpzb24.c2ln"} {
+		if _, err := DecodeIDTokenClaims(token); err == nil {
+			t.Errorf("expected error for token %q", token)
+		}
+	}
+}
@@ -28,6 +28,7 @@ type Endpoint struct {
 	store   SessionStore
 	opts    *options.Options
 	proxy   *server.OAuthProxy
+	lookups *providerCache
 	Name    string          `json:"name,omitempty"`
 	Options *Options        `json:"options,omitempty"`
 	Store   json.RawMessage `json:"store,omitempty" caddy:"namespace=oauth2.session_store inline_key=type"`
@@ -72,6 +73,7 @@ func (e *Endpoint) provision(app *App) error {
 		return fmt.Errorf("no options found for endpoint %s", e.Name)
 	}
 	e.opts = e.Options.oauth2proxyOptions()
+	e.lookups = newProviderCache()
 	if e.opts.Cookie.Secret == "" {
 		secret, err := generateRandomASCIIString(32)
 		if err != nil {
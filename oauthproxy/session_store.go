@@ -1,6 +1,8 @@
 package oauthproxy
 
 import (
+	"context"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
@@ -16,6 +18,14 @@ type SessionStore interface {
 	Provision(opts *options.Cookie) error
 }
 
+// SessionWatcher is implemented by session stores which persist sessions
+// server side, and which can notify when sessions are deleted (e.g. on sign-out).
+type SessionWatcher interface {
+	// WatchDeletedSessions calls deleted with the key of each session deleted
+	// from the store, until the context is done. It returns once the watch is started.
+	WatchDeletedSessions(ctx context.Context, deleted func(key string)) error
+}
+
 type CookieStore struct {
 	store   sessionsapi.SessionStore
 	Minimal bool `json:"session_cookie_minimal"`
@@ -1,6 +1,7 @@
 package session_store
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -52,6 +53,13 @@ func (s *JetStreamStore) Store() sessionsapi.SessionStore {
 	return s.sessionsstore
 }
 
+// WatchDeletedSessions calls deleted with the key of each session deleted from the store.
+// It implements the oauthproxy.SessionWatcher interface.
+func (s *JetStreamStore) WatchDeletedSessions(ctx context.Context, deleted func(key string)) error {
+	return s.kvstore.WatchDeleted(ctx, deleted)
+}
+
 var (
-	_ oauthproxy.SessionStore = (*JetStreamStore)(nil)
+	_ oauthproxy.SessionStore   = (*JetStreamStore)(nil)
+	_ oauthproxy.SessionWatcher = (*JetStreamStore)(nil)
 )
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/persistence"
@@ -36,6 +37,40 @@ func (s *Store) Clear(ctx context.Context, key string) error {
 	return kv.Delete(key)
 }
 
+// WatchDeleted calls deleted with the key of each session deleted or purged
+// from the key value store, until the context is done.
+func (s *Store) WatchDeleted(ctx context.Context, deleted func(key string)) error {
+	kv, err := s.kvstore.kv()
+	if err != nil {
+		s.logger.Error("failed to get kv", zap.Error(err))
+		return err
+	}
+	watcher, err := kv.WatchAll(nats.UpdatesOnly(), nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					return
+				}
+				if entry == nil {
+					continue
+				}
+				if op := entry.Operation(); op == nats.KeyValueDelete || op == nats.KeyValuePurge {
+					deleted(entry.Key())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
 func (s *Store) Load(ctx context.Context, key string) ([]byte, error) {
 	kv, err := s.kvstore.kv()
 	if err != nil {
@@ -1,11 +1,16 @@
 package session_store
 
 import (
+	"context"
+	"errors"
+
 	"github.com/caddyserver/caddy/v2"
 	"github.com/charbonnierg/caddy-nats/oauthproxy"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions"
+	sessionsredis "github.com/oauth2-proxy/oauth2-proxy/v7/pkg/sessions/redis"
+	"github.com/redis/go-redis/v9"
 )
 
 func init() {
@@ -14,6 +19,7 @@ func init() {
 
 type RedisStore struct {
 	store                  sessionsapi.SessionStore
+	opts                   options.RedisStoreOptions
 	ConnectionURL          string   `json:"connection_url"`
 	Password               string   `json:"password"`
 	UseSentinel            bool     `json:"use_sentinel"`
@@ -50,6 +56,49 @@ func (s *RedisStore) Provision(opts *options.Cookie) error {
 		return err
 	}
 	s.store = store
+	s.opts = storeOpts.Redis
+	return nil
+}
+
+// WatchDeletedSessions calls deleted with the key of each session deleted from the store,
+// or expired, using redis keyspace notifications. Notifications must be enabled on the
+// redis server for generic and expired events (e.g. "notify-keyspace-events Egx").
+// It implements the oauthproxy.SessionWatcher interface.
+func (s *RedisStore) WatchDeletedSessions(ctx context.Context, deleted func(key string)) error {
+	client, err := sessionsredis.NewRedisClient(s.opts)
+	if err != nil {
+		return err
+	}
+	subscriber, ok := client.(interface {
+		PSubscribe(ctx context.Context, channels ...string) *redis.PubSub
+		Close() error
+	})
+	if !ok {
+		return errors.New("redis client does not support subscriptions")
+	}
+	pubsub := subscriber.PSubscribe(ctx, "__keyevent@*__:del", "__keyevent@*__:expired")
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		subscriber.Close()
+		return err
+	}
+	go func() {
+		// The client is only used by the watcher, so it is closed when the watcher exits
+		defer subscriber.Close()
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				deleted(msg.Payload)
+			}
+		}
+	}()
 	return nil
 }
 
@@ -61,5 +110,6 @@ func (RedisStore) CaddyModule() caddy.ModuleInfo {
 }
 
 var (
-	_ oauthproxy.SessionStore = (*RedisStore)(nil)
+	_ oauthproxy.SessionStore   = (*RedisStore)(nil)
+	_ oauthproxy.SessionWatcher = (*RedisStore)(nil)
 )